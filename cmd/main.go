@@ -7,14 +7,20 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
+	"gowsoos/internal/admin"
 	"gowsoos/internal/banner"
 	"gowsoos/internal/config"
 	"gowsoos/internal/metrics"
 	"gowsoos/internal/server"
+	"gowsoos/internal/systemd"
 )
 
+// statusInterval is how often the session count is reported to systemd
+const statusInterval = 10 * time.Second
+
 var (
 	Version = "dev"
 	Commit  = "unknown"
@@ -32,8 +38,8 @@ with SSL SNI support. Up to 20 times faster than Python similar proxies.`,
 		Version: fmt.Sprintf("%s (commit: %s, built: %s)", Version, Commit, Date),
 		RunE:   runProxy,
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
-			// Only print banner if not showing version or help
-			if !cmd.Flags().Changed("version") && !cmd.Flags().Changed("help") {
+			// Only print banner when starting the server, not for version, help or subcommands
+			if !cmd.HasParent() && !cmd.Flags().Changed("version") && !cmd.Flags().Changed("help") {
 				banner.PrintBanner()
 			}
 		},
@@ -49,13 +55,18 @@ with SSL SNI support. Up to 20 times faster than Python similar proxies.`,
 	rootCmd.Flags().String("tls-addr", ":443", "Set port for listening clients if using TLS mode")
 	rootCmd.Flags().String("dst-addr", "127.0.0.1:22", "Set internal IP for SSH server redirection")
 	rootCmd.Flags().String("custom-handshake", "", "Set custom HTTP code for response")
+	rootCmd.Flags().Bool("legacy-handshake", false, "Answer non-WebSocket injector payloads with a fixed 101 response")
 	rootCmd.Flags().Bool("tls", false, "Enable TLS")
 	rootCmd.Flags().String("private-key", "/etc/gowsoos/tls/private.pem", "Path to private certificate if using TLS")
 	rootCmd.Flags().String("public-key", "/etc/gowsoos/tls/public.key", "Path to public certificate if using TLS")
 	rootCmd.Flags().String("tls-mode", "handshake", "TLS mode: 'handshake' or 'stunnel'")
+	rootCmd.Flags().String("transport-mode", "raw", "Transport after the HTTP upgrade: 'raw' or 'framed'")
+	rootCmd.Flags().String("tls-transport-mode", "raw", "Transport after the TLS upgrade: 'raw' or 'framed'")
 	rootCmd.Flags().Bool("metrics", false, "Enable Prometheus metrics")
 	rootCmd.Flags().String("metrics-port", ":9090", "Metrics server port")
 
+	rootCmd.AddCommand(newUsageCommand())
+
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
@@ -96,17 +107,33 @@ func runProxy(cmd *cobra.Command, args []string) error {
 
 	// Create and start server
 	srv := server.NewServer(cfg, logger, m)
+	srv.SetVersion(admin.Version{Version: Version, Commit: Commit, Date: Date})
 
 	// Setup signal handling for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Status updates stop early after an upgrade, the new process reports from then on
+	notifier := systemd.NewNotifier()
+	statusCtx, stopStatus := context.WithCancel(ctx)
+	defer stopStatus()
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
+	// Subscribe to SIGHUP before starting so an early reload can't kill the process
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+
+	upgradeChan := make(chan os.Signal, 1)
+	if len(upgradeSignals) > 0 {
+		signal.Notify(upgradeChan, upgradeSignals...)
+	}
+
 	go func() {
 		sig := <-sigChan
 		logger.Info("Received shutdown signal", "signal", sig)
+		notifier.Stopping(fmt.Sprintf("Draining %d sessions", srv.ActiveSessions()))
 		srv.Stop()
 		cancel()
 	}()
@@ -116,6 +143,43 @@ func runProxy(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to start server: %w", err)
 	}
 
+	notifier.Ready(sessionStatus(srv))
+	// Live stays true while draining, the accept loops no longer beat then
+	go notifier.RunWatchdog(statusCtx, srv.Live)
+	go reportStatus(statusCtx, notifier, srv)
+
+	// Reload configuration on SIGHUP, established tunnels are kept
+	go func() {
+		for range reloadChan {
+			logger.Info("Received reload signal")
+			notifier.Reloading()
+			if err := reloadConfig(cmd, srv); err != nil {
+				logger.Error("Configuration reload failed", "error", err)
+				m.RecordReload("failure")
+			} else {
+				logger.Info("Configuration reloaded")
+				m.RecordReload("success")
+			}
+			notifier.Ready(sessionStatus(srv))
+		}
+	}()
+
+	// Hand the listeners over to a freshly started binary, then drain
+	go func() {
+		for range upgradeChan {
+			logger.Info("Received upgrade signal")
+			if err := srv.Upgrade(); err != nil {
+				logger.Error("Upgrade failed", "error", err)
+				continue
+			}
+			logger.Info("New process is accepting connections, draining sessions")
+			stopStatus()
+			srv.Stop()
+			cancel()
+			return
+		}
+	}()
+
 	// Wait for shutdown
 	<-ctx.Done()
 	srv.Wait()
@@ -124,6 +188,53 @@ func runProxy(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// sessionStatus describes the server for systemctl status
+func sessionStatus(srv *server.Server) string {
+	return fmt.Sprintf("Serving %d sessions", srv.ActiveSessions())
+}
+
+// reportStatus refreshes the systemd status line until ctx is done
+func reportStatus(ctx context.Context, notifier *systemd.Notifier, srv *server.Server) {
+	if !notifier.Enabled() {
+		return
+	}
+
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			notifier.Status(sessionStatus(srv))
+		}
+	}
+}
+
+// reloadConfig loads and validates the configuration again, then applies it
+// to the running server. Command-line flags keep precedence over the file.
+func reloadConfig(cmd *cobra.Command, srv *server.Server) error {
+	configFile, _ := cmd.Flags().GetString("config")
+	cfg, err := config.LoadConfig(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	if err := overrideConfigWithFlags(cmd, cfg); err != nil {
+		return fmt.Errorf("failed to override config with flags: %w", err)
+	}
+
+	logLevel, _ := cmd.Flags().GetString("log-level")
+	cfg.LogLevel = logLevel
+
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return srv.Reload(cfg)
+}
+
 func overrideConfigWithFlags(cmd *cobra.Command, cfg *config.Config) error {
 	flags := []struct {
 		name     string
@@ -134,10 +245,13 @@ func overrideConfigWithFlags(cmd *cobra.Command, cfg *config.Config) error {
 		{"tls-addr", &cfg.TLSAddress, false},
 		{"dst-addr", &cfg.DstAddress, false},
 		{"custom-handshake", &cfg.HandshakeCode, false},
+		{"legacy-handshake", &cfg.LegacyHandshake, false},
 		{"tls", &cfg.TLSEnabled, false},
 		{"private-key", &cfg.TLSPrivateKey, false},
 		{"public-key", &cfg.TLSPublicKey, false},
 		{"tls-mode", &cfg.TLSMode, false},
+		{"transport-mode", &cfg.TransportMode, false},
+		{"tls-transport-mode", &cfg.TLSTransportMode, false},
 		{"metrics", &cfg.MetricsEnabled, false},
 		{"metrics-port", &cfg.MetricsPort, false},
 	}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package cmd
+
+import "os"
+
+// upgradeSignals is empty, handing over listeners is not supported on Windows
+var upgradeSignals []os.Signal
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gowsoos/internal/accounting"
+	"gowsoos/internal/config"
+)
+
+// newUsageCommand creates the command printing the accounting ledger
+func newUsageCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "usage [identity...]",
+		Short: "Show the traffic accounted per identity",
+		Long: `Show the traffic accounted per user, client certificate or source IP
+for today, this month and in total, read from the accounting ledger. The
+running server saves the ledger every few seconds.`,
+		RunE: runUsage,
+	}
+
+	cmd.Flags().String("ledger", "", "Ledger file (default: accounting_file from the configuration)")
+	cmd.Flags().Bool("json", false, "Print the accounts as JSON")
+	return cmd
+}
+
+func runUsage(cmd *cobra.Command, args []string) error {
+	path, _ := cmd.Flags().GetString("ledger")
+	if path == "" {
+		configFile, _ := cmd.Flags().GetString("config")
+		cfg, err := config.LoadConfig(configFile)
+		if err != nil {
+			return fmt.Errorf("failed to load configuration: %w", err)
+		}
+		path = cfg.AccountingFile
+	}
+
+	accounts, err := accounting.Load(path)
+	if err != nil {
+		return err
+	}
+
+	// Periods that have passed since the last save read as zero
+	now := time.Now()
+	identities := args
+	if len(identities) == 0 {
+		for identity := range accounts {
+			identities = append(identities, identity)
+		}
+		sort.Strings(identities)
+	}
+
+	selected := make(map[string]accounting.Account, len(identities))
+	for _, identity := range identities {
+		if account, ok := accounts[identity]; ok {
+			selected[identity] = account.At(now)
+		}
+	}
+
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent("", "  ")
+		return enc.Encode(selected)
+	}
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IDENTITY\tTODAY (UP/DOWN)\tTHIS MONTH (UP/DOWN)\tTOTAL\tLAST SEEN")
+	for _, identity := range identities {
+		account, ok := selected[identity]
+		if !ok {
+			fmt.Fprintf(w, "%s\t-\t-\t-\tnever\n", identity)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s / %s\t%s / %s\t%s\t%s\n",
+			identity,
+			formatBytes(account.Daily.Upload), formatBytes(account.Daily.Download),
+			formatBytes(account.Monthly.Upload), formatBytes(account.Monthly.Download),
+			formatBytes(account.Total.Total()),
+			account.LastSeen.Local().Format("2006-01-02 15:04"))
+	}
+	return w.Flush()
+}
+
+// formatBytes renders a byte count with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gowsoos/internal/accounting"
+)
+
+func TestUsage(t *testing.T) {
+	now := time.Now()
+	lastSeen := time.Date(2024, 1, 15, 12, 30, 0, 0, time.Local)
+	path := filepath.Join(t.TempDir(), "usage.json")
+	err := accounting.Save(path, map[string]accounting.Account{
+		"alice": {
+			Day: now.Format("2006-01-02"), Daily: accounting.Usage{Upload: 512, Download: 2048},
+			Month: now.Format("2006-01"), Monthly: accounting.Usage{Upload: 512, Download: 3 * 1024 * 1024},
+			Total:    accounting.Usage{Upload: 512, Download: 5 * 1024 * 1024 * 1024},
+			LastSeen: lastSeen,
+		},
+		// Saved in an earlier month, its periods read as zero
+		"203.0.113.7": {
+			Day: "2024-01-15", Daily: accounting.Usage{Download: 100},
+			Month: "2024-01", Monthly: accounting.Usage{Download: 100},
+			Total:    accounting.Usage{Download: 100},
+			LastSeen: lastSeen,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{
+			name: "all identities",
+			args: []string{"--ledger", path},
+			want: []string{
+				"IDENTITY     TODAY (UP/DOWN)  THIS MONTH (UP/DOWN)  TOTAL    LAST SEEN",
+				"203.0.113.7  0 B / 0 B        0 B / 0 B             100 B    2024-01-15 12:30",
+				"alice        512 B / 2.0 KiB  512 B / 3.0 MiB       5.0 GiB  2024-01-15 12:30",
+			},
+		},
+		{
+			name: "selected identities",
+			args: []string{"--ledger", path, "bob", "alice"},
+			want: []string{
+				"IDENTITY  TODAY (UP/DOWN)  THIS MONTH (UP/DOWN)  TOTAL    LAST SEEN",
+				"bob       -                -                     -        never",
+				"alice     512 B / 2.0 KiB  512 B / 3.0 MiB       5.0 GiB  2024-01-15 12:30",
+			},
+		},
+		{
+			name: "missing ledger",
+			args: []string{"--ledger", filepath.Join(t.TempDir(), "missing.json")},
+			want: []string{"IDENTITY  TODAY (UP/DOWN)  THIS MONTH (UP/DOWN)  TOTAL  LAST SEEN"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runUsageCommand(tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimRight(out, "\n"), "\n")
+			if len(lines) != len(tt.want) {
+				t.Fatalf("got output\n%s\nwant\n%s", out, strings.Join(tt.want, "\n"))
+			}
+			for i, line := range lines {
+				if strings.TrimRight(line, " ") != tt.want[i] {
+					t.Errorf("line %d: got %q, want %q", i, line, tt.want[i])
+				}
+			}
+		})
+	}
+
+	t.Run("json", func(t *testing.T) {
+		out, err := runUsageCommand("--ledger", path, "--json", "203.0.113.7", "bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var accounts map[string]accounting.Account
+		if err := json.Unmarshal([]byte(out), &accounts); err != nil {
+			t.Fatalf("invalid JSON %q: %v", out, err)
+		}
+		a, ok := accounts["203.0.113.7"]
+		if len(accounts) != 1 || !ok {
+			t.Fatalf("got %v, want only the known identity", accounts)
+		}
+		if a.Daily.Total() != 0 || a.Monthly.Total() != 0 || a.Total.Download != 100 {
+			t.Errorf("got %+v, want the periods rolled over", a)
+		}
+	})
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{1024 * 1024, "1.0 MiB"},
+		{1<<40 + 1<<39, "1.5 TiB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.n); got != tt.want {
+			t.Errorf("formatBytes(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+// runUsageCommand runs the usage command and returns what it printed
+func runUsageCommand(args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := newUsageCommand()
+	cmd.SetOut(&out)
+	cmd.SetArgs(args)
+	err := cmd.Execute()
+	return out.String(), err
+}
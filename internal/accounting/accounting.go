@@ -0,0 +1,337 @@
+package accounting
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"gowsoos/internal/statefile"
+)
+
+// ReasonQuotaExceeded is reported when a tunnel is refused over quota
+const ReasonQuotaExceeded = "quota_exceeded"
+
+// What happens to an identity over its quota
+const (
+	ActionCutoff   = "cutoff"   // tunnels are closed and new ones refused
+	ActionThrottle = "throttle" // tunnels are slowed down to the throttle rate
+)
+
+const (
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+)
+
+// clock returns the current time, tests move it across periods
+var clock = time.Now
+
+// Usage counts bytes in both directions, seen from the client
+type Usage struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// Total returns the bytes moved in both directions
+func (u Usage) Total() int64 {
+	return u.Upload + u.Download
+}
+
+func (u *Usage) add(upload bool, n int64) {
+	if upload {
+		u.Upload += n
+	} else {
+		u.Download += n
+	}
+}
+
+// Account is the traffic of one identity. Daily and Monthly belong to the
+// period named by Day and Month, in server local time.
+type Account struct {
+	Day      string    `json:"day"`
+	Daily    Usage     `json:"daily"`
+	Month    string    `json:"month"`
+	Monthly  Usage     `json:"monthly"`
+	Total    Usage     `json:"total"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// At returns the account with its daily and monthly counters rolled over to now
+func (a Account) At(now time.Time) Account {
+	a.rollover(now)
+	return a
+}
+
+func (a *Account) rollover(now time.Time) {
+	if day := now.Format(dayLayout); a.Day != day {
+		a.Day, a.Daily = day, Usage{}
+	}
+	if month := now.Format(monthLayout); a.Month != month {
+		a.Month, a.Monthly = month, Usage{}
+	}
+}
+
+// Quota caps the traffic of an identity in bytes. Zero is unlimited.
+type Quota struct {
+	Daily   int64
+	Monthly int64
+}
+
+// exceeded reports whether the current periods of a used up the quota
+func (q Quota) exceeded(a *Account) bool {
+	return (q.Daily > 0 && a.Daily.Total() >= q.Daily) ||
+		(q.Monthly > 0 && a.Monthly.Total() >= q.Monthly)
+}
+
+// Policy sets the quotas of all identities and what happens past them
+type Policy struct {
+	Default      Quota
+	Overrides    map[string]Quota
+	Action       string
+	ThrottleRate int64         // bytes per second with ActionThrottle
+	Retention    time.Duration // how long idle accounts are kept, 0 is forever
+}
+
+func (p *Policy) quota(identity string) Quota {
+	if q, ok := p.Overrides[identity]; ok {
+		return q
+	}
+	return p.Default
+}
+
+// account is the entry of one identity in the ledger. Its own lock keeps
+// tunnels of different identities from contending on every chunk.
+type account struct {
+	mu sync.Mutex
+	Account
+}
+
+// Ledger accounts tunnel traffic per identity: an authenticated user, a
+// client certificate identity or a source IP. It is safe for concurrent use.
+type Ledger struct {
+	// mu guards policy and the accounts map. Traffic is added under the read
+	// lock and the lock of the account, so only new identities, pruning and
+	// policy changes take it exclusively.
+	mu       sync.RWMutex
+	policy   Policy
+	accounts map[string]*account
+	changed  int32 // accounts differ from the last snapshot taken with Changed
+}
+
+// NewLedger creates an empty ledger without quotas
+func NewLedger() *Ledger {
+	return &Ledger{accounts: make(map[string]*account)}
+}
+
+// SetPolicy replaces the quotas, running tunnels are held to the new ones
+func (l *Ledger) SetPolicy(policy Policy) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.policy = policy
+}
+
+// Restore merges accounts loaded from disk into the ledger
+func (l *Ledger) Restore(accounts map[string]Account) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for identity, restored := range accounts {
+		a := &account{Account: restored}
+		if current, ok := l.accounts[identity]; ok {
+			// Traffic accounted before the restore belongs to the current periods
+			a.rollover(clock())
+			a.Daily.Upload += current.Daily.Upload
+			a.Daily.Download += current.Daily.Download
+			a.Monthly.Upload += current.Monthly.Upload
+			a.Monthly.Download += current.Monthly.Download
+			a.Total.Upload += current.Total.Upload
+			a.Total.Download += current.Total.Download
+			a.LastSeen = current.LastSeen
+		}
+		l.accounts[identity] = a
+	}
+}
+
+// Refused reports whether new tunnels of identity are refused because it
+// used up its quota and the policy cuts it off
+func (l *Ledger) Refused(identity string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.policy.Action != ActionCutoff {
+		return false
+	}
+	a, ok := l.accounts[identity]
+	if !ok {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rollover(clock())
+	return l.policy.quota(identity).exceeded(&a.Account)
+}
+
+// Snapshot returns a copy of every account
+func (l *Ledger) Snapshot() map[string]Account {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.snapshot()
+}
+
+func (l *Ledger) snapshot() map[string]Account {
+	accounts := make(map[string]Account, len(l.accounts))
+	for identity, a := range l.accounts {
+		a.mu.Lock()
+		accounts[identity] = a.Account
+		a.mu.Unlock()
+	}
+	return accounts
+}
+
+// Changed returns every account if any changed since the last call
+func (l *Ledger) Changed() (map[string]Account, bool) {
+	if !atomic.CompareAndSwapInt32(&l.changed, 1, 0) {
+		return nil, false
+	}
+	return l.Snapshot(), true
+}
+
+// Prune forgets accounts that saw no traffic within the retention of the
+// policy. An account with traffic in the current month is kept regardless,
+// its monthly quota would start over otherwise. It returns how many accounts
+// were removed.
+func (l *Ledger) Prune(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.policy.Retention <= 0 {
+		return 0
+	}
+	cutoff := now.Add(-l.policy.Retention)
+	month := now.Format(monthLayout)
+
+	pruned := 0
+	for identity, a := range l.accounts {
+		if a.LastSeen.Before(cutoff) && a.LastSeen.Format(monthLayout) != month {
+			delete(l.accounts, identity)
+			pruned++
+		}
+	}
+	if pruned > 0 {
+		atomic.StoreInt32(&l.changed, 1)
+	}
+	return pruned
+}
+
+// Meter returns the meter accounting a tunnel of identity
+func (l *Ledger) Meter(identity string) *Meter {
+	return &Meter{ledger: l, identity: identity}
+}
+
+// lookup returns the account of identity, creating it if needed. It returns
+// with the read lock held.
+func (l *Ledger) lookup(identity string) *account {
+	for {
+		l.mu.RLock()
+		if a, ok := l.accounts[identity]; ok {
+			return a
+		}
+		l.mu.RUnlock()
+
+		// Prune may remove the new account before the read lock is taken
+		// again, lookup then simply creates it once more
+		l.mu.Lock()
+		if _, ok := l.accounts[identity]; !ok {
+			l.accounts[identity] = &account{}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// add accounts n bytes to identity and returns the policy action to apply
+// if the identity is over its quota, or "" if it is not
+func (l *Ledger) add(identity string, upload bool, n int64) (string, int64) {
+	a := l.lookup(identity)
+	defer l.mu.RUnlock()
+
+	a.mu.Lock()
+	now := clock()
+	a.rollover(now)
+	a.Daily.add(upload, n)
+	a.Monthly.add(upload, n)
+	a.Total.add(upload, n)
+	a.LastSeen = now
+	exceeded := l.policy.quota(identity).exceeded(&a.Account)
+	a.mu.Unlock()
+
+	if atomic.LoadInt32(&l.changed) == 0 {
+		atomic.StoreInt32(&l.changed, 1)
+	}
+	if !exceeded {
+		return "", 0
+	}
+	return l.policy.Action, l.policy.ThrottleRate
+}
+
+// throttles reports whether tunnels of identity may get throttled
+func (l *Ledger) throttles(identity string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	q := l.policy.quota(identity)
+	return l.policy.Action == ActionThrottle && (q.Daily > 0 || q.Monthly > 0)
+}
+
+// Meter accounts the traffic of one tunnel
+type Meter struct {
+	ledger   *Ledger
+	identity string
+	over     int32 // set once the tunnel went over quota
+}
+
+// Identity returns the identity the traffic is accounted to
+func (m *Meter) Identity() string {
+	return m.identity
+}
+
+// Add accounts n bytes moved in one direction. It returns whether the tunnel
+// must be cut off, and how long to wait before moving more when throttled.
+func (m *Meter) Add(upload bool, n int) (bool, time.Duration) {
+	action, rate := m.ledger.add(m.identity, upload, int64(n))
+	switch action {
+	case ActionCutoff:
+		atomic.StoreInt32(&m.over, 1)
+		return true, 0
+	case ActionThrottle:
+		atomic.StoreInt32(&m.over, 1)
+		if rate > 0 {
+			return false, time.Duration(float64(n) / float64(rate) * float64(time.Second))
+		}
+	}
+	return false, 0
+}
+
+// Over reports whether the tunnel went over the quota of its identity
+func (m *Meter) Over() bool {
+	return atomic.LoadInt32(&m.over) == 1
+}
+
+// Throttles reports whether the tunnel may get throttled, which needs every
+// byte to pass through Add as it is read
+func (m *Meter) Throttles() bool {
+	return m.ledger.throttles(m.identity)
+}
+
+// Load reads a ledger file written by Save. A missing file is an empty ledger.
+func Load(path string) (map[string]Account, error) {
+	accounts := make(map[string]Account)
+	if err := statefile.Read(path, &accounts); err != nil {
+		return nil, errors.Wrap(err, "failed to load ledger")
+	}
+	return accounts, nil
+}
+
+// Save writes the accounts to path, replacing the file atomically
+func Save(path string, accounts map[string]Account) error {
+	return errors.Wrap(statefile.Write(path, accounts), "failed to save ledger")
+}
@@ -0,0 +1,304 @@
+package accounting
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const mb = 1024 * 1024
+
+// fakeClock makes the ledger read *now as the current time
+func fakeClock(t *testing.T, now *time.Time) {
+	t.Helper()
+	clock = func() time.Time { return *now }
+	t.Cleanup(func() { clock = time.Now })
+}
+
+func TestAdd(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   Policy
+		identity string
+		used     int64 // bytes added before the checked chunk
+		action   string
+		rate     int64
+	}{
+		{name: "unlimited", policy: Policy{Action: ActionCutoff}, identity: "alice", used: 100 * mb},
+		{name: "under daily quota", policy: Policy{Default: Quota{Daily: mb}, Action: ActionCutoff}, identity: "alice", used: mb / 2},
+		{name: "daily quota cutoff", policy: Policy{Default: Quota{Daily: mb}, Action: ActionCutoff}, identity: "alice", used: mb, action: ActionCutoff},
+		{name: "monthly quota cutoff", policy: Policy{Default: Quota{Monthly: mb}, Action: ActionCutoff}, identity: "alice", used: mb, action: ActionCutoff},
+		{
+			name:     "daily quota throttle",
+			policy:   Policy{Default: Quota{Daily: mb}, Action: ActionThrottle, ThrottleRate: 64 * 1024},
+			identity: "alice",
+			used:     mb,
+			action:   ActionThrottle,
+			rate:     64 * 1024,
+		},
+		{
+			name:     "zero monthly with daily quota",
+			policy:   Policy{Default: Quota{Daily: 2 * mb, Monthly: 0}, Action: ActionCutoff},
+			identity: "alice",
+			used:     mb,
+		},
+		{
+			name:     "override lifts the default",
+			policy:   Policy{Default: Quota{Daily: mb}, Overrides: map[string]Quota{"alice": {}}, Action: ActionCutoff},
+			identity: "alice",
+			used:     10 * mb,
+		},
+		{
+			name:     "override tightens the default",
+			policy:   Policy{Default: Quota{Daily: 10 * mb}, Overrides: map[string]Quota{"203.0.113.7": {Monthly: mb}}, Action: ActionCutoff},
+			identity: "203.0.113.7",
+			used:     mb,
+			action:   ActionCutoff,
+		},
+		{
+			name:     "override of another identity",
+			policy:   Policy{Default: Quota{Daily: mb}, Overrides: map[string]Quota{"bob": {}}, Action: ActionCutoff},
+			identity: "alice",
+			used:     mb,
+			action:   ActionCutoff,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLedger()
+			l.SetPolicy(tt.policy)
+			// Half of the traffic each way, quotas count both directions
+			l.add(tt.identity, true, tt.used/2)
+			l.add(tt.identity, false, tt.used-tt.used/2-1)
+
+			action, rate := l.add(tt.identity, false, 1)
+			if action != tt.action || rate != tt.rate {
+				t.Errorf("add = %q, %d, want %q, %d", action, rate, tt.action, tt.rate)
+			}
+			if refused := l.Refused(tt.identity); refused != (tt.action == ActionCutoff) {
+				t.Errorf("Refused = %v with action %q", refused, tt.action)
+			}
+		})
+	}
+}
+
+func TestMeter(t *testing.T) {
+	l := NewLedger()
+	l.SetPolicy(Policy{Default: Quota{Daily: 1000}, Action: ActionThrottle, ThrottleRate: 1000})
+
+	m := l.Meter("alice")
+	if !m.Throttles() {
+		t.Error("meter under a throttle policy does not throttle")
+	}
+	if cut, wait := m.Add(true, 999); cut || wait != 0 || m.Over() {
+		t.Errorf("under quota: Add = %v, %v, Over = %v", cut, wait, m.Over())
+	}
+	if cut, wait := m.Add(false, 500); cut || wait != 500*time.Millisecond || !m.Over() {
+		t.Errorf("over quota: Add = %v, %v, Over = %v, want 500ms wait", cut, wait, m.Over())
+	}
+
+	l.SetPolicy(Policy{Default: Quota{Daily: 1000}, Action: ActionCutoff})
+	m = l.Meter("alice")
+	if m.Throttles() {
+		t.Error("meter under a cutoff policy throttles")
+	}
+	if cut, wait := m.Add(true, 1); !cut || wait != 0 || !m.Over() {
+		t.Errorf("cutoff: Add = %v, %v, Over = %v", cut, wait, m.Over())
+	}
+	if got := l.Snapshot()["alice"].Total; got != (Usage{Upload: 1000, Download: 500}) {
+		t.Errorf("total %+v, want every chunk accounted", got)
+	}
+}
+
+func TestRollover(t *testing.T) {
+	now := time.Date(2024, 1, 31, 23, 59, 0, 0, time.Local)
+	fakeClock(t, &now)
+
+	l := NewLedger()
+	l.SetPolicy(Policy{Default: Quota{Daily: 100, Monthly: 250}, Action: ActionCutoff})
+	l.add("alice", true, 100)
+
+	steps := []struct {
+		name    string
+		at      time.Time
+		add     int64
+		daily   int64
+		monthly int64
+		total   int64
+		refused bool
+	}{
+		{name: "same day", at: now, daily: 100, monthly: 100, total: 100, refused: true},
+		{name: "next day", at: time.Date(2024, 2, 1, 0, 1, 0, 0, time.Local), add: 90, daily: 90, monthly: 90, total: 190},
+		{name: "day after", at: time.Date(2024, 2, 2, 12, 0, 0, 0, time.Local), add: 90, daily: 90, monthly: 180, total: 280},
+		{name: "monthly quota", at: time.Date(2024, 2, 3, 12, 0, 0, 0, time.Local), add: 70, daily: 70, monthly: 250, total: 350, refused: true},
+		{name: "next month", at: time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local), daily: 0, monthly: 0, total: 350},
+	}
+
+	for _, step := range steps {
+		now = step.at
+		if step.add > 0 {
+			l.add("alice", false, step.add)
+		}
+		if refused := l.Refused("alice"); refused != step.refused {
+			t.Errorf("%s: Refused = %v, want %v", step.name, refused, step.refused)
+		}
+		a := l.Snapshot()["alice"]
+		if a.Daily.Total() != step.daily || a.Monthly.Total() != step.monthly || a.Total.Total() != step.total {
+			t.Errorf("%s: daily %d, monthly %d, total %d, want %d, %d, %d", step.name,
+				a.Daily.Total(), a.Monthly.Total(), a.Total.Total(), step.daily, step.monthly, step.total)
+		}
+		if a.Day != now.Format(dayLayout) || a.Month != now.Format(monthLayout) {
+			t.Errorf("%s: periods %s and %s", step.name, a.Day, a.Month)
+		}
+	}
+}
+
+func TestAt(t *testing.T) {
+	a := Account{Day: "2024-01-31", Daily: Usage{Upload: 1}, Month: "2024-01", Monthly: Usage{Upload: 2}, Total: Usage{Upload: 3}}
+
+	got := a.At(time.Date(2024, 1, 31, 8, 0, 0, 0, time.Local))
+	if got.Daily.Upload != 1 || got.Monthly.Upload != 2 {
+		t.Errorf("same day: %+v", got)
+	}
+	got = a.At(time.Date(2024, 2, 1, 8, 0, 0, 0, time.Local))
+	if got.Daily.Upload != 0 || got.Monthly.Upload != 0 || got.Total.Upload != 3 {
+		t.Errorf("next month: %+v", got)
+	}
+	if a.Daily.Upload != 1 {
+		t.Error("At modified the account")
+	}
+}
+
+func TestChanged(t *testing.T) {
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.Local)
+	fakeClock(t, &now)
+
+	l := NewLedger()
+	if _, changed := l.Changed(); changed {
+		t.Error("empty ledger changed")
+	}
+
+	l.add("alice", true, 10)
+	accounts, changed := l.Changed()
+	if !changed || accounts["alice"].Total.Upload != 10 {
+		t.Fatalf("Changed = %v, %v after traffic", accounts, changed)
+	}
+	if _, changed := l.Changed(); changed {
+		t.Error("changed twice for one update")
+	}
+
+	// The snapshot is a copy
+	l.add("alice", true, 10)
+	if accounts["alice"].Total.Upload != 10 {
+		t.Error("snapshot follows the ledger")
+	}
+	if accounts, changed := l.Changed(); !changed || accounts["alice"].Total.Upload != 20 {
+		t.Errorf("Changed = %v, %v after more traffic", accounts, changed)
+	}
+
+	// Neither a policy change nor a refusal check is a change
+	l.SetPolicy(Policy{Default: Quota{Daily: 1}, Action: ActionCutoff})
+	l.Refused("alice")
+	if _, changed := l.Changed(); changed {
+		t.Error("changed without traffic")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Date(2024, 3, 20, 12, 0, 0, 0, time.Local)
+	fakeClock(t, &now)
+
+	l := NewLedger()
+	l.Restore(map[string]Account{
+		"old":         {LastSeen: time.Date(2023, 11, 2, 0, 0, 0, 0, time.Local)},
+		"last month":  {LastSeen: time.Date(2024, 2, 28, 0, 0, 0, 0, time.Local)},
+		"this month":  {LastSeen: time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)},
+		"203.0.113.7": {LastSeen: time.Date(2024, 1, 5, 0, 0, 0, 0, time.Local)},
+	})
+
+	if pruned := l.Prune(now); pruned != 0 {
+		t.Errorf("pruned %d accounts without retention", pruned)
+	}
+
+	// Ten days back is still this month, the monthly quota keeps the account
+	l.SetPolicy(Policy{Retention: 10 * 24 * time.Hour})
+	if pruned := l.Prune(now); pruned != 3 {
+		t.Errorf("pruned %d accounts, want 3", pruned)
+	}
+	accounts, changed := l.Changed()
+	if !changed {
+		t.Error("pruning is not a change")
+	}
+	if _, ok := accounts["this month"]; !ok || len(accounts) != 1 {
+		t.Errorf("kept %v, want the account seen this month", accounts)
+	}
+
+	// Traffic after pruning starts a fresh account
+	l.add("203.0.113.7", false, 5)
+	if got := l.Snapshot()["203.0.113.7"]; got.Total.Download != 5 || !got.LastSeen.Equal(now) {
+		t.Errorf("account after pruning: %+v", got)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.Local)
+	fakeClock(t, &now)
+
+	l := NewLedger()
+	l.add("alice", true, 10)
+	l.Restore(map[string]Account{
+		"alice": {Day: "2024-01-14", Daily: Usage{Upload: 100}, Month: "2024-01", Monthly: Usage{Upload: 500}, Total: Usage{Upload: 900}},
+		"bob":   {Day: "2024-01-15", Daily: Usage{Download: 7}, Month: "2024-01", Monthly: Usage{Download: 7}, Total: Usage{Download: 7}},
+	})
+
+	accounts := l.Snapshot()
+	want := Account{Day: "2024-01-15", Daily: Usage{Upload: 10}, Month: "2024-01", Monthly: Usage{Upload: 510}, Total: Usage{Upload: 910}, LastSeen: now}
+	if !reflect.DeepEqual(accounts["alice"], want) {
+		t.Errorf("merged %+v, want %+v", accounts["alice"], want)
+	}
+	if accounts["bob"].Daily.Download != 7 {
+		t.Errorf("restored %+v", accounts["bob"])
+	}
+}
+
+func TestLoadSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+
+	accounts, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accounts == nil || len(accounts) != 0 {
+		t.Errorf("missing file loaded as %v, want an empty ledger", accounts)
+	}
+
+	want := map[string]Account{
+		"alice": {
+			Day: "2024-01-15", Daily: Usage{Upload: 1, Download: 2},
+			Month: "2024-01", Monthly: Usage{Upload: 3, Download: 4},
+			Total:    Usage{Upload: 5, Download: 6},
+			LastSeen: time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC),
+		},
+		"2001:db8::1": {Total: Usage{Download: 1 << 40}},
+	}
+	if err := Save(path, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded %+v, want %+v", got, want)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"alice": [`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("loaded a corrupt ledger")
+	}
+}
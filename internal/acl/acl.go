@@ -0,0 +1,174 @@
+package acl
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"gowsoos/internal/config"
+)
+
+// DefaultRule names the acl_default verdict in logs and metrics
+const DefaultRule = "default"
+
+// Decision is the verdict for a client address
+type Decision struct {
+	Allowed bool
+	Rule    string // name of the matching rule, or DefaultRule
+	DryRun  bool   // denials are only reported, not enforced
+}
+
+// ACL allows or denies client addresses by ordered CIDR rules. It allows
+// everyone until loaded, and is safe for concurrent use.
+type ACL struct {
+	state atomic.Value // *aclState
+}
+
+type aclState struct {
+	rules        []rule
+	defaultAllow bool
+	dryRun       bool
+}
+
+type rule struct {
+	name     string
+	allow    bool
+	networks []*net.IPNet
+}
+
+// New creates an ACL that allows every address until loaded
+func New() *ACL {
+	a := &ACL{}
+	a.state.Store(&aclState{defaultAllow: true})
+	return a
+}
+
+// Reload builds the rules of the configuration, reading rule files again,
+// and swaps them in atomically. On error the previous rules stay in use.
+func (a *ACL) Reload(cfg *config.Config) error {
+	apply, err := a.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare builds the rules of the configuration and returns a function
+// swapping them in, so they can be applied together with other components
+func (a *ACL) Prepare(cfg *config.Config) (func(), error) {
+	st := &aclState{
+		rules:        make([]rule, 0, len(cfg.ACLRules)),
+		defaultAllow: cfg.ACLDefault != "deny",
+		dryRun:       cfg.ACLDryRun,
+	}
+
+	for _, rc := range cfg.ACLRules {
+		entries := rc.CIDRs
+		if rc.File != "" {
+			lines, err := readEntries(rc.File)
+			if err != nil {
+				return nil, errors.Wrapf(err, "acl rule %q", rc.Name)
+			}
+			entries = append(append([]string{}, entries...), lines...)
+		}
+
+		r := rule{name: rc.Name, allow: rc.Action == "allow"}
+		for _, entry := range entries {
+			network, err := parseNetwork(entry)
+			if err != nil {
+				return nil, errors.Wrapf(err, "acl rule %q", rc.Name)
+			}
+			r.networks = append(r.networks, network)
+		}
+		st.rules = append(st.rules, r)
+	}
+
+	return func() { a.state.Store(st) }, nil
+}
+
+// Rules returns the number of loaded rules
+func (a *ACL) Rules() int {
+	return len(a.state.Load().(*aclState).rules)
+}
+
+// Check returns the verdict of the first rule matching addr, or of the
+// default policy when none does
+func (a *ACL) Check(addr net.Addr) Decision {
+	st := a.state.Load().(*aclState)
+
+	if ip := addressIP(addr); ip != nil {
+		for _, r := range st.rules {
+			if r.contains(ip) {
+				return Decision{Allowed: r.allow, Rule: r.name, DryRun: st.dryRun}
+			}
+		}
+	}
+	return Decision{Allowed: st.defaultAllow, Rule: DefaultRule, DryRun: st.dryRun}
+}
+
+func (r *rule) contains(ip net.IP) bool {
+	for _, network := range r.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addressIP returns the IP of a client address, nil if it has none
+func addressIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// parseNetwork parses a CIDR or a bare IPv4 or IPv6 address
+func parseNetwork(entry string) (*net.IPNet, error) {
+	if ip := net.ParseIP(entry); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(entry)
+	if err != nil {
+		return nil, errors.Errorf("invalid address or CIDR %q", entry)
+	}
+	return network, nil
+}
+
+// readEntries reads one address or CIDR per line. Blank lines and # comments,
+// including trailing ones, are skipped as in common blocklist formats.
+func readEntries(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open rule file")
+	}
+	defer f.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if fields := strings.Fields(line); len(fields) > 0 {
+			entries = append(entries, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	return entries, nil
+}
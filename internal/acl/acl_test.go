@@ -0,0 +1,113 @@
+package acl
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gowsoos/internal/config"
+)
+
+func addr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func TestCheck(t *testing.T) {
+	rules := []config.ACLRuleConfig{
+		{Name: "office", Action: "allow", CIDRs: []string{"192.0.2.0/24", "2001:db8:1::/48"}},
+		{Name: "abuse", Action: "deny", CIDRs: []string{"192.0.0.0/16", "198.51.100.7"}},
+		{Name: "partners", Action: "allow", CIDRs: []string{"198.51.100.0/24"}},
+	}
+
+	tests := []struct {
+		name     string
+		def      string
+		dryRun   bool
+		addr     net.Addr
+		expect   Decision
+		unloaded bool
+	}{
+		{name: "first rule wins", def: "deny", addr: addr("192.0.2.10"), expect: Decision{Allowed: true, Rule: "office"}},
+		{name: "second rule", def: "allow", addr: addr("192.0.3.10"), expect: Decision{Allowed: false, Rule: "abuse"}},
+		{name: "deny before a later allow", def: "allow", addr: addr("198.51.100.7"), expect: Decision{Allowed: false, Rule: "abuse"}},
+		{name: "later allow", def: "deny", addr: addr("198.51.100.8"), expect: Decision{Allowed: true, Rule: "partners"}},
+		{name: "ipv6", def: "deny", addr: addr("2001:db8:1::5"), expect: Decision{Allowed: true, Rule: "office"}},
+		{name: "mapped ipv4", def: "allow", addr: addr("::ffff:192.0.3.10"), expect: Decision{Allowed: false, Rule: "abuse"}},
+		{name: "default allow", def: "allow", addr: addr("203.0.113.1"), expect: Decision{Allowed: true, Rule: DefaultRule}},
+		{name: "default deny", def: "deny", addr: addr("203.0.113.1"), expect: Decision{Allowed: false, Rule: DefaultRule}},
+		{name: "dry run", def: "deny", dryRun: true, addr: addr("192.0.3.10"), expect: Decision{Allowed: false, Rule: "abuse", DryRun: true}},
+		{name: "address without ip", def: "deny", addr: &net.UnixAddr{Name: "/run/gowsoos.sock", Net: "unix"}, expect: Decision{Allowed: false, Rule: DefaultRule}},
+		{name: "not loaded", addr: addr("192.0.3.10"), expect: Decision{Allowed: true, Rule: DefaultRule}, unloaded: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New()
+			if !tt.unloaded {
+				cfg := &config.Config{ACLRules: rules, ACLDefault: tt.def, ACLDryRun: tt.dryRun}
+				if err := a.Reload(cfg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := a.Check(tt.addr); got != tt.expect {
+				t.Errorf("Check(%s) = %+v, want %+v", tt.addr, got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestReloadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	content := "# blocklist\n\n203.0.113.0/24 ; spamhaus\n198.51.100.9 # scanner\n  2001:db8:bad::/48\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := New()
+	cfg := &config.Config{
+		ACLRules:   []config.ACLRuleConfig{{Name: "blocklist", Action: "deny", CIDRs: []string{"192.0.2.1"}, File: path}},
+		ACLDefault: "allow",
+	}
+	if err := a.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ip := range []string{"192.0.2.1", "203.0.113.50", "198.51.100.9", "2001:db8:bad::1"} {
+		if d := a.Check(addr(ip)); d.Allowed || d.Rule != "blocklist" {
+			t.Errorf("Check(%s) = %+v, want denied by blocklist", ip, d)
+		}
+	}
+	if d := a.Check(addr("198.51.100.10")); !d.Allowed {
+		t.Errorf("Check(198.51.100.10) = %+v, want allowed", d)
+	}
+}
+
+func TestReloadKeepsRulesOnError(t *testing.T) {
+	a := New()
+	good := &config.Config{
+		ACLRules:   []config.ACLRuleConfig{{Name: "office", Action: "allow", CIDRs: []string{"192.0.2.0/24"}}},
+		ACLDefault: "deny",
+	}
+	if err := a.Reload(good); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rc := range []config.ACLRuleConfig{
+		{Name: "typo", Action: "deny", CIDRs: []string{"192.0.2.0/33"}},
+		{Name: "hostname", Action: "deny", CIDRs: []string{"example.com"}},
+		{Name: "missing", Action: "deny", File: filepath.Join(t.TempDir(), "missing.txt")},
+	} {
+		bad := &config.Config{ACLRules: []config.ACLRuleConfig{rc}, ACLDefault: "allow"}
+		if err := a.Reload(bad); err == nil {
+			t.Errorf("rule %q loaded", rc.Name)
+		}
+	}
+
+	if a.Rules() != 1 {
+		t.Errorf("%d rules after failed reloads, want 1", a.Rules())
+	}
+	if d := a.Check(addr("203.0.113.1")); d.Allowed {
+		t.Errorf("default changed by a failed reload: %+v", d)
+	}
+}
@@ -0,0 +1,225 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gowsoos/internal/auth"
+	"gowsoos/internal/config"
+	"gowsoos/internal/proxy"
+)
+
+// Prefix is the path the admin API is served under
+const Prefix = "/admin/"
+
+// redactedValue replaces secrets in the configuration returned by the API
+const redactedValue = "REDACTED"
+
+// secrets are the settings whose values are never returned
+var secrets = map[string]bool{
+	"admin_token": true,
+	"auth_tokens": true,
+}
+
+// Version identifies the running build
+type Version struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Date    string `json:"date"`
+}
+
+// Handler serves the admin API: listing and closing sessions, and showing
+// the running configuration and version. Requests need the admin_token of
+// the current configuration as a bearer token, the API is not found while
+// it is empty.
+type Handler struct {
+	proxy   *proxy.Proxy
+	config  func() *config.Config
+	version Version
+	logger  *slog.Logger
+	mux     *http.ServeMux
+}
+
+// NewHandler creates the admin API of p. config returns the configuration
+// in effect, so reloads apply to the API as well.
+func NewHandler(p *proxy.Proxy, config func() *config.Config, version Version, logger *slog.Logger) *Handler {
+	h := &Handler{
+		proxy:   p,
+		config:  config,
+		version: version,
+		logger:  logger,
+		mux:     http.NewServeMux(),
+	}
+	h.mux.HandleFunc(Prefix+"sessions", h.handleSessions)
+	h.mux.HandleFunc(Prefix+"sessions/", h.handleSession)
+	h.mux.HandleFunc(Prefix+"config", h.handleConfig)
+	h.mux.HandleFunc(Prefix+"version", h.handleVersion)
+	return h
+}
+
+// ServeHTTP authenticates the request and dispatches it
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := h.config().AdminToken
+	if token == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	given, ok := auth.Authorization(r.Header, "Bearer")
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		h.logger.Warn("Admin request rejected", "remote", r.RemoteAddr, "path", r.URL.Path)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gowsoos"`)
+		writeError(w, http.StatusUnauthorized, "invalid admin token")
+		return
+	}
+
+	h.mux.ServeHTTP(w, r)
+}
+
+// handleSessions lists the sessions, or closes those of ?ip= on DELETE
+func (h *Handler) handleSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": h.proxy.Sessions()})
+	case http.MethodDelete:
+		ip := net.ParseIP(r.URL.Query().Get("ip"))
+		if ip == nil {
+			writeError(w, http.StatusBadRequest, "a valid ip query parameter is required")
+			return
+		}
+		closed := h.proxy.CloseClient(ip.String())
+		h.logger.Info("Sessions closed by admin", "ip", ip.String(), "sessions", closed)
+		writeJSON(w, http.StatusOK, map[string]int{"closed": closed})
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// handleSession shows or closes the session /sessions/{id}
+func (h *Handler) handleSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, Prefix+"sessions/"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid session id")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		for _, sess := range h.proxy.Sessions() {
+			if sess.ID == id {
+				writeJSON(w, http.StatusOK, sess)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "session not found")
+	case http.MethodDelete:
+		if !h.proxy.CloseSession(id) {
+			writeError(w, http.StatusNotFound, "session not found")
+			return
+		}
+		h.logger.Info("Session closed by admin", "id", id)
+		writeJSON(w, http.StatusOK, map[string]int{"closed": 1})
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// handleConfig returns the configuration in effect with secrets redacted
+func (h *Handler) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, http.StatusOK, configValue(reflect.ValueOf(h.config())))
+}
+
+func (h *Handler) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.version)
+}
+
+// configValue converts the configuration to JSON-friendly values keyed by
+// the names used in the configuration file, redacting secrets
+func configValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return configValue(v.Elem())
+	case reflect.Struct:
+		fields := make(map[string]interface{}, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			name := v.Type().Field(i).Tag.Get("mapstructure")
+			if name == "" || name == "-" {
+				continue
+			}
+			if secrets[name] {
+				fields[name] = redact(v.Field(i))
+			} else {
+				fields[name] = configValue(v.Field(i))
+			}
+		}
+		return fields
+	case reflect.Slice, reflect.Array:
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = configValue(v.Index(i))
+		}
+		return items
+	case reflect.Map:
+		entries := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			entries[iter.Key().String()] = configValue(iter.Value())
+		}
+		return entries
+	default:
+		return v.Interface()
+	}
+}
+
+// redact hides a secret while still telling whether it is set
+func redact(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.String:
+		if v.Len() == 0 {
+			return ""
+		}
+		return redactedValue
+	case reflect.Slice:
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = redactedValue
+		}
+		return items
+	default:
+		return redactedValue
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
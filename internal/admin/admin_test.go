@@ -0,0 +1,295 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"gowsoos/internal/config"
+	"gowsoos/internal/metrics"
+	"gowsoos/internal/proxy"
+)
+
+const testToken = "s3cret"
+
+// testAdmin is an admin API in front of a proxy forwarding to a backend
+// that holds every connection open
+type testAdmin struct {
+	t       *testing.T
+	cfg     *config.Config
+	proxy   *proxy.Proxy
+	handler *Handler
+	clients net.Listener
+}
+
+func newTestAdmin(t *testing.T) *testAdmin {
+	t.Helper()
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	clients, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clients.Close() })
+
+	cfg := config.DefaultConfig()
+	cfg.DstAddress = backend.Addr().String()
+	cfg.AdminToken = testToken
+	cfg.AuthTokens = []string{"alice:hunter2"}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	p := proxy.NewProxy(cfg, logger, metrics.NewMetrics(false, logger))
+	return &testAdmin{
+		t:       t,
+		cfg:     cfg,
+		proxy:   p,
+		handler: NewHandler(p, func() *config.Config { return cfg }, Version{Version: "1.2.3"}, logger),
+		clients: clients,
+	}
+}
+
+// connect opens a direct SSH session through the proxy and returns the
+// client side of it
+func (a *testAdmin) connect() net.Conn {
+	a.t.Helper()
+	client, err := net.Dial("tcp", a.clients.Addr().String())
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	a.t.Cleanup(func() { client.Close() })
+	server, err := a.clients.Accept()
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.t.Cleanup(cancel)
+	go a.proxy.HandleDirect(ctx, server)
+	return client
+}
+
+// waitSessions waits until the proxy handles n sessions and returns them
+func (a *testAdmin) waitSessions(n int) []proxy.SessionInfo {
+	a.t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		sessions := a.proxy.Sessions()
+		if len(sessions) == n {
+			return sessions
+		}
+		if time.Now().After(deadline) {
+			a.t.Fatalf("%d sessions, want %d", len(sessions), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// do sends an authenticated request and decodes the JSON answer into v
+func (a *testAdmin) do(method, path string, v interface{}) *httptest.ResponseRecorder {
+	a.t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rec := httptest.NewRecorder()
+	a.handler.ServeHTTP(rec, req)
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			a.t.Fatalf("%s %s: invalid JSON %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec
+}
+
+func TestAuthentication(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string // admin_token of the configuration
+		authorization string
+		status        int
+	}{
+		{name: "bearer token", token: testToken, authorization: "Bearer " + testToken, status: http.StatusOK},
+		{name: "scheme case", token: testToken, authorization: "bearer " + testToken, status: http.StatusOK},
+		{name: "missing", token: testToken, status: http.StatusUnauthorized},
+		{name: "wrong token", token: testToken, authorization: "Bearer wrong", status: http.StatusUnauthorized},
+		{name: "token prefix", token: testToken, authorization: "Bearer " + testToken[:3], status: http.StatusUnauthorized},
+		{name: "without scheme", token: testToken, authorization: testToken, status: http.StatusUnauthorized},
+		{name: "other scheme", token: testToken, authorization: "Basic " + testToken, status: http.StatusUnauthorized},
+		{name: "scheme only", token: testToken, authorization: "Bearer", status: http.StatusUnauthorized},
+		{name: "disabled", authorization: "Bearer ", status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAdmin(t)
+			a.cfg.AdminToken = tt.token
+
+			req := httptest.NewRequest(http.MethodGet, Prefix+"version", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			a.handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d", rec.Code, tt.status)
+			}
+			if challenge := rec.Header().Get("WWW-Authenticate"); (challenge != "") != (tt.status == http.StatusUnauthorized) {
+				t.Errorf("challenge %q with status %d", challenge, rec.Code)
+			}
+		})
+	}
+}
+
+func TestSessions(t *testing.T) {
+	a := newTestAdmin(t)
+
+	var list struct {
+		Sessions []proxy.SessionInfo `json:"sessions"`
+	}
+	if rec := a.do(http.MethodGet, Prefix+"sessions", &list); rec.Code != http.StatusOK || len(list.Sessions) != 0 {
+		t.Fatalf("status %d, %d sessions without clients", rec.Code, len(list.Sessions))
+	}
+
+	first := a.connect()
+	a.connect()
+	sessions := a.waitSessions(2)
+
+	if rec := a.do(http.MethodGet, Prefix+"sessions", &list); rec.Code != http.StatusOK || len(list.Sessions) != 2 {
+		t.Fatalf("status %d, %d sessions, want 2", rec.Code, len(list.Sessions))
+	}
+	if list.Sessions[0].ID != sessions[0].ID || list.Sessions[1].ID != sessions[1].ID {
+		t.Errorf("listed %+v, want %+v", list.Sessions, sessions)
+	}
+
+	id := strconv.FormatUint(sessions[0].ID, 10)
+	var sess proxy.SessionInfo
+	if rec := a.do(http.MethodGet, Prefix+"sessions/"+id, &sess); rec.Code != http.StatusOK || sess.ID != sessions[0].ID {
+		t.Errorf("status %d, session %+v, want session %s", rec.Code, sess, id)
+	}
+	if sess.ClientAddr != first.LocalAddr().String() {
+		t.Errorf("session of %s, want %s", sess.ClientAddr, first.LocalAddr())
+	}
+
+	for _, path := range []string{"sessions/abc", "sessions/-1", "sessions/", "sessions/1/2"} {
+		if rec := a.do(http.MethodGet, Prefix+path, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: status %d, want 400", path, rec.Code)
+		}
+	}
+	unknown := strconv.FormatUint(sessions[1].ID+100, 10)
+	if rec := a.do(http.MethodGet, Prefix+"sessions/"+unknown, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("GET unknown session: status %d, want 404", rec.Code)
+	}
+	if rec := a.do(http.MethodDelete, Prefix+"sessions/"+unknown, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE unknown session: status %d, want 404", rec.Code)
+	}
+}
+
+func TestCloseSession(t *testing.T) {
+	a := newTestAdmin(t)
+	first := a.connect()
+	a.connect()
+	sessions := a.waitSessions(2)
+
+	var closed map[string]int
+	rec := a.do(http.MethodDelete, Prefix+"sessions/"+strconv.FormatUint(sessions[0].ID, 10), &closed)
+	if rec.Code != http.StatusOK || closed["closed"] != 1 {
+		t.Fatalf("status %d, %v, want one session closed", rec.Code, closed)
+	}
+
+	first.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := first.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("client of the closed session read %v, want EOF", err)
+	}
+	if remaining := a.waitSessions(1); remaining[0].ID != sessions[1].ID {
+		t.Errorf("session %d left, want %d", remaining[0].ID, sessions[1].ID)
+	}
+}
+
+func TestCloseClient(t *testing.T) {
+	a := newTestAdmin(t)
+	a.connect()
+	a.connect()
+	a.waitSessions(2)
+
+	for _, query := range []string{"", "?ip=", "?ip=localhost", "?ip=127.0.0.1/8"} {
+		if rec := a.do(http.MethodDelete, Prefix+"sessions"+query, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("DELETE sessions%s: status %d, want 400", query, rec.Code)
+		}
+	}
+
+	var closed map[string]int
+	if rec := a.do(http.MethodDelete, Prefix+"sessions?ip=192.0.2.1", &closed); rec.Code != http.StatusOK || closed["closed"] != 0 {
+		t.Errorf("status %d, %v, want nothing closed", rec.Code, closed)
+	}
+	if rec := a.do(http.MethodDelete, Prefix+"sessions?ip=127.0.0.1", &closed); rec.Code != http.StatusOK || closed["closed"] != 2 {
+		t.Errorf("status %d, %v, want both sessions closed", rec.Code, closed)
+	}
+	a.waitSessions(0)
+}
+
+func TestMethods(t *testing.T) {
+	a := newTestAdmin(t)
+
+	tests := []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{http.MethodPost, "sessions", "GET, DELETE"},
+		{http.MethodPut, "sessions/1", "GET, DELETE"},
+		{http.MethodPost, "config", "GET"},
+		{http.MethodDelete, "version", "GET"},
+	}
+
+	for _, tt := range tests {
+		rec := a.do(tt.method, Prefix+tt.path, nil)
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != tt.allow {
+			t.Errorf("%s %s: status %d, Allow %q, want 405 and %q", tt.method, tt.path, rec.Code, rec.Header().Get("Allow"), tt.allow)
+		}
+	}
+}
+
+func TestConfigAndVersion(t *testing.T) {
+	a := newTestAdmin(t)
+
+	var cfg map[string]interface{}
+	if rec := a.do(http.MethodGet, Prefix+"config", &cfg); rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if cfg["admin_token"] != redactedValue {
+		t.Errorf("admin_token %v, want it redacted", cfg["admin_token"])
+	}
+	if tokens, ok := cfg["auth_tokens"].([]interface{}); !ok || len(tokens) != 1 || tokens[0] != redactedValue {
+		t.Errorf("auth_tokens %v, want them redacted", cfg["auth_tokens"])
+	}
+	if cfg["dst_address"] != a.cfg.DstAddress {
+		t.Errorf("dst_address %v, want %s", cfg["dst_address"], a.cfg.DstAddress)
+	}
+
+	var version Version
+	if rec := a.do(http.MethodGet, Prefix+"version", &version); rec.Code != http.StatusOK || version.Version != "1.2.3" {
+		t.Errorf("status %d, version %+v", rec.Code, version)
+	}
+}
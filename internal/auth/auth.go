@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"gowsoos/internal/config"
+)
+
+// Ways a client can present credentials in its upgrade request
+const (
+	MethodBearer = "bearer" // Authorization: Bearer <token>
+	MethodQuery  = "query"  // ?<auth_query_param>=<token>
+	MethodBasic  = "basic"  // Authorization: Basic, checked against the htpasswd file
+	MethodHeader = "header" // <auth_header>: <token>
+)
+
+// Failure reasons, a fixed set so they can be used as metric labels
+const (
+	ReasonMissing         = "missing_credentials"
+	ReasonMalformed       = "malformed_credentials"
+	ReasonInvalidToken    = "invalid_token"
+	ReasonUnknownUser     = "unknown_user"
+	ReasonInvalidPassword = "invalid_password"
+)
+
+// realm is announced in WWW-Authenticate challenges
+const realm = "gowsoos"
+
+// Error is a failed authentication
+type Error struct {
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return "authentication failed: " + strings.ReplaceAll(e.Reason, "_", " ")
+}
+
+// Missing reports whether the client presented no credentials at all, which
+// is answered with 401 rather than 403
+func (e *Error) Missing() bool {
+	return e.Reason == ReasonMissing
+}
+
+// Authenticator validates the credentials of upgrade requests against the
+// configured token list, token file and htpasswd file. It is disabled until
+// loaded with at least one method, and safe for concurrent use.
+type Authenticator struct {
+	state atomic.Value // *authState
+}
+
+type authState struct {
+	methods    []string
+	queryParam string
+	header     string
+	tokens     map[[sha256.Size]byte]string // token hash to identity
+	users      map[string]string            // user to password hash
+}
+
+// NewAuthenticator creates an authenticator that accepts every request until loaded
+func NewAuthenticator() *Authenticator {
+	a := &Authenticator{}
+	a.state.Store(&authState{})
+	return a
+}
+
+// Reload reads the configured credential stores and swaps them in atomically.
+// On error the previous credentials stay in use.
+func (a *Authenticator) Reload(cfg *config.Config) error {
+	apply, err := a.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare reads the configured credential stores and returns a function
+// swapping them in, so they can be applied together with other components
+func (a *Authenticator) Prepare(cfg *config.Config) (func(), error) {
+	st := &authState{
+		methods:    cfg.AuthMethods,
+		queryParam: cfg.AuthQueryParam,
+		header:     cfg.AuthHeader,
+		tokens:     make(map[[sha256.Size]byte]string),
+		users:      make(map[string]string),
+	}
+
+	for _, entry := range cfg.AuthTokens {
+		st.addToken(entry)
+	}
+	if cfg.AuthTokensFile != "" {
+		lines, err := readLines(cfg.AuthTokensFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			st.addToken(line)
+		}
+	}
+
+	if cfg.AuthHtpasswdFile != "" {
+		users, err := loadHtpasswd(cfg.AuthHtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		st.users = users
+	}
+
+	return func() { a.state.Store(st) }, nil
+}
+
+// addToken registers a "name:token" entry, or a bare token identified by a
+// short fingerprint so it never shows up in logs
+func (st *authState) addToken(entry string) {
+	name, token := "", entry
+	if i := strings.IndexByte(entry, ':'); i >= 0 {
+		name, token = entry[:i], entry[i+1:]
+	}
+	if token == "" {
+		return
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	if name == "" {
+		name = "token-" + hex.EncodeToString(sum[:4])
+	}
+	st.tokens[sum] = name
+}
+
+// Enabled reports whether requests must authenticate
+func (a *Authenticator) Enabled() bool {
+	return len(a.load().methods) > 0
+}
+
+func (a *Authenticator) load() *authState {
+	return a.state.Load().(*authState)
+}
+
+// Authenticate checks the credentials of an upgrade request and returns the
+// identity they belong to. Methods are tried in the configured order and the
+// first credentials present decide. Failures are *Error values.
+func (a *Authenticator) Authenticate(header http.Header, target string) (string, error) {
+	st := a.load()
+	if len(st.methods) == 0 {
+		return "", nil
+	}
+
+	for _, method := range st.methods {
+		switch method {
+		case MethodBearer:
+			if token, ok := Authorization(header, "Bearer"); ok {
+				return st.checkToken(token)
+			}
+		case MethodQuery:
+			if token := queryValue(target, st.queryParam); token != "" {
+				return st.checkToken(token)
+			}
+		case MethodHeader:
+			if token := header.Get(st.header); token != "" {
+				return st.checkToken(token)
+			}
+		case MethodBasic:
+			if encoded, ok := Authorization(header, "Basic"); ok {
+				return st.checkBasic(encoded)
+			}
+		}
+	}
+	return "", &Error{Reason: ReasonMissing}
+}
+
+func (st *authState) checkToken(token string) (string, error) {
+	if name, ok := st.tokens[sha256.Sum256([]byte(token))]; ok {
+		return name, nil
+	}
+	return "", &Error{Reason: ReasonInvalidToken}
+}
+
+func (st *authState) checkBasic(encoded string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", &Error{Reason: ReasonMalformed}
+	}
+	i := strings.IndexByte(string(decoded), ':')
+	if i < 0 {
+		return "", &Error{Reason: ReasonMalformed}
+	}
+	user, password := string(decoded[:i]), string(decoded[i+1:])
+
+	hash, ok := st.users[user]
+	if !ok {
+		return "", &Error{Reason: ReasonUnknownUser}
+	}
+	if !checkPassword(hash, password) {
+		return "", &Error{Reason: ReasonInvalidPassword}
+	}
+	return user, nil
+}
+
+// Challenges returns the WWW-Authenticate headers sent along with a 401
+func (a *Authenticator) Challenges() []string {
+	var challenges []string
+	for _, method := range a.load().methods {
+		switch method {
+		case MethodBasic:
+			challenges = append(challenges, `WWW-Authenticate: Basic realm="`+realm+`"`)
+		case MethodBearer:
+			challenges = append(challenges, `WWW-Authenticate: Bearer realm="`+realm+`"`)
+		}
+	}
+	return challenges
+}
+
+// Redact hides the query token in a request target so it can be logged
+func (a *Authenticator) Redact(target string) string {
+	st := a.load()
+	if st.queryParam == "" || queryValue(target, st.queryParam) == "" {
+		return target
+	}
+
+	// queryValue found the token, so the query parses
+	i := strings.IndexByte(target, '?')
+	query, _ := url.ParseQuery(target[i+1:])
+	query.Set(st.queryParam, "REDACTED")
+	return target[:i] + "?" + query.Encode()
+}
+
+// Authorization returns the credentials of an Authorization header using
+// scheme. The scheme is matched case-insensitively, and false is returned
+// when the header is missing or uses another scheme.
+func Authorization(header http.Header, scheme string) (string, bool) {
+	value := header.Get("Authorization")
+	if len(value) <= len(scheme) || !strings.EqualFold(value[:len(scheme)], scheme) || value[len(scheme)] != ' ' {
+		return "", false
+	}
+	return strings.TrimSpace(value[len(scheme)+1:]), true
+}
+
+// queryValue returns a query parameter of a request target
+func queryValue(target, name string) string {
+	i := strings.IndexByte(target, '?')
+	if i < 0 || name == "" {
+		return ""
+	}
+	query, err := url.ParseQuery(target[i+1:])
+	if err != nil {
+		return ""
+	}
+	return query.Get(name)
+}
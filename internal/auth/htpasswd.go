@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	apr1Magic    = "$apr1$"
+	shaPrefix    = "{SHA}"
+	bcryptPrefix = "$2"
+
+	// plainPrefix marks a password stored as plain text
+	plainPrefix = "{PLAIN}"
+
+	// itoa64 is the alphabet of crypt(3) style hash encodings
+	itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// readLines returns the non-empty lines of a file that are not # comments
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open credentials file")
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	return lines, nil
+}
+
+// loadHtpasswd reads user:hash lines as written by htpasswd. bcrypt, MD5
+// (apr1), SHA1 and {PLAIN} prefixed plain text entries are supported; other
+// schemes are rejected so a misconfigured file fails loudly instead of
+// locking everyone out or comparing hashes as passwords.
+func loadHtpasswd(path string) (map[string]string, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]string, len(lines))
+	for i, line := range lines {
+		sep := strings.IndexByte(line, ':')
+		if sep <= 0 {
+			return nil, errors.Errorf("%s: entry %d is not user:hash", path, i+1)
+		}
+		user, hash := line[:sep], line[sep+1:]
+		if strings.HasPrefix(hash, bcryptPrefix) {
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				return nil, errors.Wrapf(err, "%s: user %q has an invalid bcrypt hash", path, user)
+			}
+			users[user] = hash
+			continue
+		}
+		if !strings.HasPrefix(hash, apr1Magic) && !strings.HasPrefix(hash, shaPrefix) && !strings.HasPrefix(hash, plainPrefix) {
+			return nil, errors.Errorf("%s: user %q has an unsupported hash scheme (use htpasswd -B, -m or -s, or %s for plain text)", path, user, plainPrefix)
+		}
+		users[user] = hash
+	}
+	return users, nil
+}
+
+// checkPassword compares a password with an htpasswd hash in constant time
+func checkPassword(hash, password string) bool {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, bcryptPrefix):
+		// bcrypt compares in constant time itself
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, apr1Magic):
+		salt := hash[len(apr1Magic):]
+		if i := strings.IndexByte(salt, '$'); i >= 0 {
+			salt = salt[:i]
+		}
+		computed = apr1(password, salt)
+	case strings.HasPrefix(hash, shaPrefix):
+		sum := sha1.Sum([]byte(password))
+		computed = shaPrefix + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, plainPrefix):
+		computed = plainPrefix + password
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// apr1 computes Apache's MD5 based password hash for a salt of up to 8 characters
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw, s := []byte(password), []byte(salt)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write(s)
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(apr1Magic))
+	h.Write(s)
+	for n := len(pw); n > 0; n -= 16 {
+		if n > 16 {
+			h.Write(altSum)
+		} else {
+			h.Write(altSum[:n])
+		}
+	}
+	for n := len(pw); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	// 1000 rounds to slow down brute force attacks
+	for i := 0; i < 1000; i++ {
+		r := md5.New()
+		if i&1 != 0 {
+			r.Write(pw)
+		} else {
+			r.Write(sum)
+		}
+		if i%3 != 0 {
+			r.Write(s)
+		}
+		if i%7 != 0 {
+			r.Write(pw)
+		}
+		if i&1 != 0 {
+			r.Write(sum)
+		} else {
+			r.Write(pw)
+		}
+		sum = r.Sum(nil)
+	}
+
+	var out []byte
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(sum[0], sum[6], sum[12], 4)
+	encode(sum[1], sum[7], sum[13], 4)
+	encode(sum[2], sum[8], sum[14], 4)
+	encode(sum[3], sum[9], sum[15], 4)
+	encode(sum[4], sum[10], sum[5], 4)
+	encode(0, 0, sum[11], 2)
+
+	return apr1Magic + salt + "$" + string(out)
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// apr1Vectors are hashes written by htpasswd -m and openssl passwd -apr1
+var apr1Vectors = []struct {
+	password string
+	hash     string
+}{
+	{"myPassword", "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/"},
+	{"password", "$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1"},
+	{"", "$apr1$12345678$sHuPAw7VA9xjRbJz7zKV7/"},
+	{"a longer password than sixteen bytes", "$apr1$saltsalt$fQOsGdVFkAc33miSw81BR1"},
+	{"secret", "$apr1$x$12YdXEY0/hH4rDNkmZupO0"},
+}
+
+// bcryptHash is a cost 5 hash of "hunter2" in the $2y$ form htpasswd -B writes
+const bcryptHash = "$2y$05$PTGWb/GZY5Ej7RQzWiqjUujqXtViR5Ka5/QzqHH5u1boSoubNZSkK"
+
+func TestApr1(t *testing.T) {
+	for _, v := range apr1Vectors {
+		salt := v.hash[len(apr1Magic) : len(v.hash)-23]
+		if got := apr1(v.password, salt); got != v.hash {
+			t.Errorf("apr1(%q, %q) = %s, want %s", v.password, salt, got, v.hash)
+		}
+	}
+
+	// Salts are cut to 8 characters like htpasswd does
+	if got := apr1("password", "abcdefghijk"); got != "$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1" {
+		t.Errorf("long salt not truncated: %s", got)
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		ok       bool
+	}{
+		{"bcrypt", bcryptHash, "hunter2", true},
+		{"bcrypt wrong password", bcryptHash, "hunter3", false},
+		{"bcrypt 2a", "$2a" + bcryptHash[3:], "hunter2", true},
+		{"apr1", apr1Vectors[0].hash, "myPassword", true},
+		{"apr1 wrong password", apr1Vectors[0].hash, "mypassword", false},
+		{"apr1 empty password", apr1Vectors[2].hash, "", true},
+		{"sha1", "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password", true},
+		{"sha1 wrong password", "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "Password", false},
+		{"plain", "{PLAIN}hunter2", "hunter2", true},
+		{"plain wrong password", "{PLAIN}hunter2", "hunter3", false},
+		{"unmarked plain text", "hunter2", "hunter2", false},
+		{"hash as password", "$6$salt$hash", "$6$salt$hash", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkPassword(tt.hash, tt.password); got != tt.ok {
+				t.Errorf("checkPassword(%q, %q) = %v, want %v", tt.hash, tt.password, got, tt.ok)
+			}
+		})
+	}
+}
+
+func TestLoadHtpasswd(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		users   int
+		fails   bool
+	}{
+		{
+			name:    "supported schemes",
+			content: "# users\nalice:" + apr1Vectors[0].hash + "\n\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\ncarol:{PLAIN}hunter2\n",
+			users:   3,
+		},
+		{name: "bcrypt", content: "alice:$2y$05$c4WoMPo3SXsafkva.HHa6uXQZWr7oboPiC2bT/r7q1BB8I2s0BRqC\n", users: 1},
+		{name: "truncated bcrypt", content: "alice:$2y$05$c4WoMPo3SXsafkva\n", fails: true},
+		{name: "sha512 crypt", content: "alice:$6$salt$IxDD3jeSOb5eB1CX5LBsqZFVkJdido3OUILO5Ifz5iwMuTS4XMS130MTSuDDl3aCI6WouIL9AjRbLCelDCy.g.\n", fails: true},
+		{name: "salted sha1", content: "alice:{SSHA}d2a8ca2KGsKRNk3JnnTK6fMgkQ1N0bHd\n", fails: true},
+		{name: "des crypt", content: "alice:abJnggxhB/yWI\n", fails: true},
+		{name: "unmarked plain text", content: "alice:hunter2\n", fails: true},
+		{name: "missing separator", content: "alice\n", fails: true},
+		{name: "missing user", content: ":{PLAIN}hunter2\n", fails: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "htpasswd")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			users, err := loadHtpasswd(path)
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("loaded %d users, want an error", len(users))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != tt.users {
+				t.Errorf("loaded %d users, want %d", len(users), tt.users)
+			}
+		})
+	}
+}
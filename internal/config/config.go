@@ -3,10 +3,53 @@ package config
 import (
 	"fmt"
 	"log/slog"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
+// LocalBackend names gowsoos itself in tls_passthrough rules: matching
+// connections are terminated locally instead of being passed through
+const LocalBackend = "local"
+
+// BackendConfig describes a destination that tunnels can be routed to
+type BackendConfig struct {
+	Address       string `mapstructure:"address"`
+	ProxyProtocol string `mapstructure:"proxy_protocol"` // PROXY header sent on connect: "", "v1" or "v2"
+}
+
+// RouteConfig maps a property of an incoming connection to a named backend
+type RouteConfig struct {
+	Match   string `mapstructure:"match"`
+	Header  string `mapstructure:"header"`
+	Value   string `mapstructure:"value"`
+	Backend string `mapstructure:"backend"`
+}
+
+// CertificateConfig is a certificate chain and its private key
+type CertificateConfig struct {
+	Cert string `mapstructure:"cert"`
+	Key  string `mapstructure:"key"`
+}
+
+// ACLRuleConfig allows or denies client networks, listed inline or one per
+// line in a file
+type ACLRuleConfig struct {
+	Name   string   `mapstructure:"name"`
+	Action string   `mapstructure:"action"`
+	CIDRs  []string `mapstructure:"cidrs"`
+	File   string   `mapstructure:"file"`
+}
+
+// QuotaConfig overrides the traffic quotas of one identity, in MB
+type QuotaConfig struct {
+	Identity string `mapstructure:"identity"`
+	Daily    int    `mapstructure:"daily"`
+	Monthly  int    `mapstructure:"monthly"`
+}
+
 // Config holds the configuration for the SSH proxy
 type Config struct {
 	Address        string `mapstructure:"address"`
@@ -21,13 +64,117 @@ type Config struct {
 	LogLevel       string `mapstructure:"log_level"`
 	MetricsEnabled bool   `mapstructure:"metrics_enabled"`
 	MetricsPort    string `mapstructure:"metrics_port"`
-	
+
+	// Admin API on the metrics server, disabled while admin_token is empty
+	AdminToken string `mapstructure:"admin_token"`
+
+	// Backend probes behind /readyz: "tcp", "ssh" or "none"; the interval
+	// and timeout are in seconds
+	HealthProbe         string `mapstructure:"health_probe"`
+	HealthProbeInterval int    `mapstructure:"health_probe_interval"`
+	HealthProbeTimeout  int    `mapstructure:"health_probe_timeout"`
+
+	// Additional certificates selected by SNI
+	TLSCertificates []CertificateConfig `mapstructure:"tls_certificates"`
+	TLSCertDir      string              `mapstructure:"tls_cert_dir"`
+
+	// Client certificate authentication on the TLS listener
+	TLSClientAuth     string `mapstructure:"tls_client_auth"`
+	TLSClientCA       string `mapstructure:"tls_client_ca"`
+	TLSClientCRL      string `mapstructure:"tls_client_crl"`
+	TLSClientIdentity string `mapstructure:"tls_client_identity"`
+
+	// WebSocket handshake settings
+	LegacyHandshake    bool     `mapstructure:"legacy_handshake"`
+	WebSocketProtocols []string `mapstructure:"websocket_protocols"`
+	TransportMode      string   `mapstructure:"transport_mode"`
+	TLSTransportMode   string   `mapstructure:"tls_transport_mode"`
+
 	// Security and performance settings
 	MaxConnections int  `mapstructure:"max_connections"`
 	Timeout        int  `mapstructure:"timeout"`
 	BufferSize     int  `mapstructure:"buffer_size"`
 	KeepAlive      bool `mapstructure:"keep_alive"`
 	NoDelay        bool `mapstructure:"no_delay"`
+
+	// Connection limits
+	MaxConnectionsPerIP   int    `mapstructure:"max_connections_per_ip"`
+	MaxConnectionsPerUser int    `mapstructure:"max_connections_per_user"`
+	LimitPolicy           string `mapstructure:"limit_policy"`
+	QueueTimeout          int    `mapstructure:"queue_timeout"`
+
+	// New connection rate limit and bans per source IP, counts apply to a
+	// sliding window of rate_limit_window seconds; ban_duration is in seconds
+	RateLimitConnections int    `mapstructure:"rate_limit_connections"`
+	RateLimitWindow      int    `mapstructure:"rate_limit_window"`
+	BanAfterConnections  int    `mapstructure:"ban_after_connections"`
+	BanAfterFailures     int    `mapstructure:"ban_after_failures"`
+	BanDuration          int    `mapstructure:"ban_duration"`
+	BanFile              string `mapstructure:"ban_file"`
+
+	// Bandwidth caps in KB/s, 0 = unlimited. Upload is client to backend.
+	BandwidthUpload       int `mapstructure:"bandwidth_upload"`
+	BandwidthDownload     int `mapstructure:"bandwidth_download"`
+	BandwidthConnUpload   int `mapstructure:"bandwidth_conn_upload"`
+	BandwidthConnDownload int `mapstructure:"bandwidth_conn_download"`
+	BandwidthIPUpload     int `mapstructure:"bandwidth_ip_upload"`
+	BandwidthIPDownload   int `mapstructure:"bandwidth_ip_download"`
+
+	// Traffic accounting per user, client certificate or source IP. Quotas
+	// are in MB and 0 = unlimited, quota_throttle_rate is in KB/s.
+	AccountingEnabled   bool          `mapstructure:"accounting_enabled"`
+	AccountingFile      string        `mapstructure:"accounting_file"`
+	AccountingRetention int           `mapstructure:"accounting_retention"` // days, 0 = forever
+	QuotaDaily          int           `mapstructure:"quota_daily"`
+	QuotaMonthly        int           `mapstructure:"quota_monthly"`
+	QuotaAction         string        `mapstructure:"quota_action"`
+	QuotaThrottleRate   int           `mapstructure:"quota_throttle_rate"`
+	QuotaOverrides      []QuotaConfig `mapstructure:"quota_overrides"`
+
+	// Routing, dst_address is used when no backends are configured
+	Backends         map[string]BackendConfig `mapstructure:"backends"`
+	Routes           []RouteConfig            `mapstructure:"routes"`
+	DefaultBackend   string                   `mapstructure:"default_backend"`
+	DstProxyProtocol string                   `mapstructure:"dst_proxy_protocol"`
+
+	// TLS passthrough, the TLS listener peeks the ClientHello when rules are
+	// set and forwards matching connections to a backend without terminating
+	TLSPassthrough []RouteConfig `mapstructure:"tls_passthrough"`
+
+	// Timeouts in seconds, handshake and dial fall back to timeout when unset
+	HandshakeTimeout   int `mapstructure:"handshake_timeout"`
+	DialTimeout        int `mapstructure:"dial_timeout"`
+	IdleTimeout        int `mapstructure:"idle_timeout"`
+	MaxSessionDuration int `mapstructure:"max_session_duration"`
+
+	// Shutdown, drain_timeout is in seconds
+	DrainTimeout int  `mapstructure:"drain_timeout"`
+	DrainNotice  bool `mapstructure:"drain_notice"`
+
+	// PROXY protocol from load balancers, per listener
+	ProxyProtocol        bool     `mapstructure:"proxy_protocol"`
+	TLSProxyProtocol     bool     `mapstructure:"tls_proxy_protocol"`
+	MuxProxyProtocol     bool     `mapstructure:"mux_proxy_protocol"`
+	ProxyProtocolTrusted []string `mapstructure:"proxy_protocol_trusted"`
+
+	// Multiplexing listener telling SSH, TLS and HTTP apart, empty address
+	// disables it; sniff_timeout is in seconds
+	MuxAddress   string `mapstructure:"mux_address"`
+	SniffTimeout int    `mapstructure:"sniff_timeout"`
+
+	// Authentication of upgrade requests, disabled when auth_methods is empty
+	AuthMethods      []string `mapstructure:"auth_methods"`
+	AuthTokens       []string `mapstructure:"auth_tokens"`
+	AuthTokensFile   string   `mapstructure:"auth_tokens_file"`
+	AuthHtpasswdFile string   `mapstructure:"auth_htpasswd_file"`
+	AuthQueryParam   string   `mapstructure:"auth_query_param"`
+	AuthHeader       string   `mapstructure:"auth_header"`
+
+	// Client address filtering, the first matching rule decides and
+	// acl_default applies when none does
+	ACLRules   []ACLRuleConfig `mapstructure:"acl_rules"`
+	ACLDefault string          `mapstructure:"acl_default"`
+	ACLDryRun  bool            `mapstructure:"acl_dry_run"`
 }
 
 // DefaultConfig returns a configuration with default values
@@ -45,11 +192,106 @@ func DefaultConfig() *Config {
 		LogLevel:       "info",
 		MetricsEnabled: false,
 		MetricsPort:    ":9090",
+		AdminToken:     "",
 		MaxConnections: 1000,
 		Timeout:        30,
 		BufferSize:     32768,
 		KeepAlive:      true,
 		NoDelay:        true,
+
+		// Health probes
+		HealthProbe:         "tcp",
+		HealthProbeInterval: 10,
+		HealthProbeTimeout:  3,
+
+		// Additional certificates selected by SNI
+		TLSCertificates: []CertificateConfig{},
+		TLSCertDir:      "",
+
+		// Client certificate authentication
+		TLSClientAuth:     "none",
+		TLSClientCA:       "",
+		TLSClientCRL:      "",
+		TLSClientIdentity: "cn",
+
+		// WebSocket handshake settings
+		LegacyHandshake:  false,
+		TransportMode:    "raw",
+		TLSTransportMode: "raw",
+
+		// Connection limits
+		MaxConnectionsPerIP:   0,
+		MaxConnectionsPerUser: 0,
+		LimitPolicy:           "reject",
+		QueueTimeout:          5,
+
+		// Connection rate limit and bans
+		RateLimitConnections: 0,
+		RateLimitWindow:      60,
+		BanAfterConnections:  0,
+		BanAfterFailures:     0,
+		BanDuration:          600,
+		BanFile:              "",
+
+		// Bandwidth caps
+		BandwidthUpload:       0,
+		BandwidthDownload:     0,
+		BandwidthConnUpload:   0,
+		BandwidthConnDownload: 0,
+		BandwidthIPUpload:     0,
+		BandwidthIPDownload:   0,
+
+		// Traffic accounting
+		AccountingEnabled:   false,
+		AccountingFile:      "/var/lib/gowsoos/usage.json",
+		AccountingRetention: 90,
+		QuotaDaily:          0,
+		QuotaMonthly:        0,
+		QuotaAction:         "cutoff",
+		QuotaThrottleRate:   64,
+		QuotaOverrides:      []QuotaConfig{},
+
+		// Routing
+		Backends:         map[string]BackendConfig{},
+		Routes:           []RouteConfig{},
+		DefaultBackend:   "",
+		DstProxyProtocol: "",
+
+		// TLS passthrough
+		TLSPassthrough: []RouteConfig{},
+
+		// Timeouts
+		HandshakeTimeout:   0,
+		DialTimeout:        0,
+		IdleTimeout:        0,
+		MaxSessionDuration: 0,
+
+		// Shutdown
+		DrainTimeout: 30,
+		DrainNotice:  true,
+
+		// PROXY protocol
+		ProxyProtocol:        false,
+		TLSProxyProtocol:     false,
+		MuxProxyProtocol:     false,
+		ProxyProtocolTrusted: []string{},
+
+		// Multiplexing
+		MuxAddress:   "",
+		SniffTimeout: 2,
+
+		// Authentication
+		AuthMethods:      []string{},
+		AuthTokens:       []string{},
+		AuthTokensFile:   "",
+		AuthHtpasswdFile: "",
+		AuthQueryParam:   "token",
+		AuthHeader:       "X-Auth-Token",
+
+		// Client address filtering
+		ACLRules:   []ACLRuleConfig{},
+		ACLDefault: "allow",
+		ACLDryRun:  false,
 	}
 }
 
@@ -99,14 +341,69 @@ func LoadConfig(configPath string) (*Config, error) {
 	viper.SetDefault("tls_private_key", config.TLSPrivateKey)
 	viper.SetDefault("tls_public_key", config.TLSPublicKey)
 	viper.SetDefault("tls_mode", config.TLSMode)
+	viper.SetDefault("tls_cert_dir", config.TLSCertDir)
+	viper.SetDefault("tls_client_auth", config.TLSClientAuth)
+	viper.SetDefault("tls_client_ca", config.TLSClientCA)
+	viper.SetDefault("tls_client_crl", config.TLSClientCRL)
+	viper.SetDefault("tls_client_identity", config.TLSClientIdentity)
 	viper.SetDefault("log_level", config.LogLevel)
 	viper.SetDefault("metrics_enabled", config.MetricsEnabled)
 	viper.SetDefault("metrics_port", config.MetricsPort)
+	viper.SetDefault("admin_token", config.AdminToken)
+	viper.SetDefault("health_probe", config.HealthProbe)
+	viper.SetDefault("health_probe_interval", config.HealthProbeInterval)
+	viper.SetDefault("health_probe_timeout", config.HealthProbeTimeout)
+	viper.SetDefault("legacy_handshake", config.LegacyHandshake)
+	viper.SetDefault("websocket_protocols", config.WebSocketProtocols)
+	viper.SetDefault("transport_mode", config.TransportMode)
+	viper.SetDefault("tls_transport_mode", config.TLSTransportMode)
 	viper.SetDefault("max_connections", config.MaxConnections)
 	viper.SetDefault("timeout", config.Timeout)
 	viper.SetDefault("buffer_size", config.BufferSize)
 	viper.SetDefault("keep_alive", config.KeepAlive)
 	viper.SetDefault("no_delay", config.NoDelay)
+	viper.SetDefault("max_connections_per_ip", config.MaxConnectionsPerIP)
+	viper.SetDefault("max_connections_per_user", config.MaxConnectionsPerUser)
+	viper.SetDefault("limit_policy", config.LimitPolicy)
+	viper.SetDefault("queue_timeout", config.QueueTimeout)
+	viper.SetDefault("rate_limit_connections", config.RateLimitConnections)
+	viper.SetDefault("rate_limit_window", config.RateLimitWindow)
+	viper.SetDefault("ban_after_connections", config.BanAfterConnections)
+	viper.SetDefault("ban_after_failures", config.BanAfterFailures)
+	viper.SetDefault("ban_duration", config.BanDuration)
+	viper.SetDefault("ban_file", config.BanFile)
+	viper.SetDefault("bandwidth_upload", config.BandwidthUpload)
+	viper.SetDefault("bandwidth_download", config.BandwidthDownload)
+	viper.SetDefault("bandwidth_conn_upload", config.BandwidthConnUpload)
+	viper.SetDefault("bandwidth_conn_download", config.BandwidthConnDownload)
+	viper.SetDefault("bandwidth_ip_upload", config.BandwidthIPUpload)
+	viper.SetDefault("bandwidth_ip_download", config.BandwidthIPDownload)
+	viper.SetDefault("accounting_enabled", config.AccountingEnabled)
+	viper.SetDefault("accounting_file", config.AccountingFile)
+	viper.SetDefault("accounting_retention", config.AccountingRetention)
+	viper.SetDefault("quota_daily", config.QuotaDaily)
+	viper.SetDefault("quota_monthly", config.QuotaMonthly)
+	viper.SetDefault("quota_action", config.QuotaAction)
+	viper.SetDefault("quota_throttle_rate", config.QuotaThrottleRate)
+	viper.SetDefault("default_backend", config.DefaultBackend)
+	viper.SetDefault("dst_proxy_protocol", config.DstProxyProtocol)
+	viper.SetDefault("handshake_timeout", config.HandshakeTimeout)
+	viper.SetDefault("dial_timeout", config.DialTimeout)
+	viper.SetDefault("idle_timeout", config.IdleTimeout)
+	viper.SetDefault("max_session_duration", config.MaxSessionDuration)
+	viper.SetDefault("drain_timeout", config.DrainTimeout)
+	viper.SetDefault("drain_notice", config.DrainNotice)
+	viper.SetDefault("proxy_protocol", config.ProxyProtocol)
+	viper.SetDefault("tls_proxy_protocol", config.TLSProxyProtocol)
+	viper.SetDefault("mux_proxy_protocol", config.MuxProxyProtocol)
+	viper.SetDefault("mux_address", config.MuxAddress)
+	viper.SetDefault("sniff_timeout", config.SniffTimeout)
+	viper.SetDefault("auth_tokens_file", config.AuthTokensFile)
+	viper.SetDefault("auth_htpasswd_file", config.AuthHtpasswdFile)
+	viper.SetDefault("auth_query_param", config.AuthQueryParam)
+	viper.SetDefault("auth_header", config.AuthHeader)
+	viper.SetDefault("acl_default", config.ACLDefault)
+	viper.SetDefault("acl_dry_run", config.ACLDryRun)
 
 	// Read config file if it exists
 	if err := viper.ReadInConfig(); err != nil {
@@ -135,7 +432,15 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid tls_mode: %s (must be 'handshake' or 'stunnel')", c.TLSMode)
 	}
 
-	if c.TLSEnabled {
+	if c.TransportMode != "raw" && c.TransportMode != "framed" {
+		return fmt.Errorf("invalid transport_mode: %s (must be 'raw' or 'framed')", c.TransportMode)
+	}
+
+	if c.TLSTransportMode != "raw" && c.TLSTransportMode != "framed" {
+		return fmt.Errorf("invalid tls_transport_mode: %s (must be 'raw' or 'framed')", c.TLSTransportMode)
+	}
+
+	if c.TLSEnabled && len(c.TLSCertificates) == 0 && c.TLSCertDir == "" {
 		if c.TLSPrivateKey == "" {
 			return fmt.Errorf("tls_private_key is required when TLS is enabled")
 		}
@@ -144,21 +449,287 @@ func (c *Config) Validate() error {
 		}
 	}
 
+	for i, cert := range c.TLSCertificates {
+		if cert.Cert == "" || cert.Key == "" {
+			return fmt.Errorf("tls_certificates %d: cert and key are required", i)
+		}
+	}
+
+	switch c.TLSClientAuth {
+	case "none":
+	case "request", "require":
+		if c.TLSClientCA == "" {
+			return fmt.Errorf("tls_client_ca is required when tls_client_auth is '%s'", c.TLSClientAuth)
+		}
+	default:
+		return fmt.Errorf("invalid tls_client_auth: %s (must be 'none', 'request' or 'require')", c.TLSClientAuth)
+	}
+
+	switch c.TLSClientIdentity {
+	case "cn", "subject", "san_dns", "san_email", "san_uri":
+	default:
+		return fmt.Errorf("invalid tls_client_identity: %s (must be 'cn', 'subject', 'san_dns', 'san_email' or 'san_uri')", c.TLSClientIdentity)
+	}
+
 	if c.MaxConnections <= 0 {
 		return fmt.Errorf("max_connections must be positive")
 	}
 
+	if c.MaxConnectionsPerIP < 0 {
+		return fmt.Errorf("max_connections_per_ip must not be negative")
+	}
+
+	if c.MaxConnectionsPerUser < 0 {
+		return fmt.Errorf("max_connections_per_user must not be negative")
+	}
+
+	if c.LimitPolicy != "reject" && c.LimitPolicy != "queue" {
+		return fmt.Errorf("invalid limit_policy: %s (must be 'reject' or 'queue')", c.LimitPolicy)
+	}
+
+	if c.LimitPolicy == "queue" && c.QueueTimeout <= 0 {
+		return fmt.Errorf("queue_timeout must be positive when limit_policy is 'queue'")
+	}
+
 	if c.Timeout <= 0 {
 		return fmt.Errorf("timeout must be positive")
 	}
 
+	if c.RateLimitConnections < 0 || c.BanAfterConnections < 0 || c.BanAfterFailures < 0 {
+		return fmt.Errorf("rate_limit_connections, ban_after_connections and ban_after_failures must not be negative")
+	}
+	if c.RateLimitWindow <= 0 {
+		return fmt.Errorf("rate_limit_window must be positive")
+	}
+	if (c.BanAfterConnections > 0 || c.BanAfterFailures > 0) && c.BanDuration <= 0 {
+		return fmt.Errorf("ban_duration must be positive when bans are enabled")
+	}
+
+	if c.BandwidthUpload < 0 || c.BandwidthDownload < 0 ||
+		c.BandwidthConnUpload < 0 || c.BandwidthConnDownload < 0 ||
+		c.BandwidthIPUpload < 0 || c.BandwidthIPDownload < 0 {
+		return fmt.Errorf("bandwidth limits must not be negative")
+	}
+
+	if err := c.validateAuth(); err != nil {
+		return err
+	}
+
+	if err := c.validateRoutes(); err != nil {
+		return err
+	}
+
+	if err := c.validateACL(); err != nil {
+		return err
+	}
+
+	if err := c.validateQuotas(); err != nil {
+		return err
+	}
+
+	if c.HandshakeTimeout < 0 || c.DialTimeout < 0 || c.IdleTimeout < 0 || c.MaxSessionDuration < 0 {
+		return fmt.Errorf("handshake_timeout, dial_timeout, idle_timeout and max_session_duration must not be negative")
+	}
+
 	if c.BufferSize <= 0 {
 		return fmt.Errorf("buffer_size must be positive")
 	}
 
+	if c.DrainTimeout < 0 {
+		return fmt.Errorf("drain_timeout must not be negative")
+	}
+
+	if c.MuxAddress != "" && c.SniffTimeout <= 0 {
+		return fmt.Errorf("sniff_timeout must be positive")
+	}
+
+	switch c.HealthProbe {
+	case "tcp", "ssh", "none":
+	default:
+		return fmt.Errorf("invalid health_probe: %s (must be 'tcp', 'ssh' or 'none')", c.HealthProbe)
+	}
+	if c.HealthProbeInterval <= 0 || c.HealthProbeTimeout <= 0 {
+		return fmt.Errorf("health_probe_interval and health_probe_timeout must be positive")
+	}
+
+	if c.AdminToken != "" && !c.MetricsEnabled {
+		return fmt.Errorf("admin_token requires metrics_enabled, the admin API is served by the metrics server")
+	}
+
+	for _, entry := range c.ProxyProtocolTrusted {
+		if !validAddressOrCIDR(entry) {
+			return fmt.Errorf("invalid proxy_protocol_trusted entry: %s", entry)
+		}
+	}
+	if (c.ProxyProtocol || c.TLSProxyProtocol || c.MuxProxyProtocol) && len(c.ProxyProtocolTrusted) == 0 {
+		return fmt.Errorf("proxy_protocol_trusted must list the balancers allowed to send PROXY headers")
+	}
+
+	return nil
+}
+
+// validateRoutes checks that every route is well formed and refers to a known backend
+func (c *Config) validateRoutes() error {
+	for name, backend := range c.Backends {
+		if backend.Address == "" {
+			return fmt.Errorf("backend %q has no address", name)
+		}
+		if !validProxyProtocolVersion(backend.ProxyProtocol) {
+			return fmt.Errorf("backend %q: invalid proxy_protocol: %s (must be 'v1' or 'v2')", name, backend.ProxyProtocol)
+		}
+	}
+
+	if !validProxyProtocolVersion(c.DstProxyProtocol) {
+		return fmt.Errorf("invalid dst_proxy_protocol: %s (must be 'v1' or 'v2')", c.DstProxyProtocol)
+	}
+
+	if c.DefaultBackend != "" && !c.HasBackend(c.DefaultBackend) {
+		return fmt.Errorf("default_backend %q is not defined in backends", c.DefaultBackend)
+	}
+
+	for i, route := range c.Routes {
+		switch route.Match {
+		case "host", "path", "sni":
+		case "header":
+			if route.Header == "" {
+				return fmt.Errorf("route %d: header is required when match is 'header'", i)
+			}
+		default:
+			return fmt.Errorf("route %d: invalid match: %s (must be 'host', 'path', 'sni' or 'header')", i, route.Match)
+		}
+		if route.Value == "" {
+			return fmt.Errorf("route %d: value is required", i)
+		}
+		if !c.HasBackend(route.Backend) {
+			return fmt.Errorf("route %d: backend %q is not defined in backends", i, route.Backend)
+		}
+	}
+
+	for i, rule := range c.TLSPassthrough {
+		if rule.Match != "sni" && rule.Match != "alpn" {
+			return fmt.Errorf("tls_passthrough %d: invalid match: %s (must be 'sni' or 'alpn')", i, rule.Match)
+		}
+		if rule.Value == "" {
+			return fmt.Errorf("tls_passthrough %d: value is required", i)
+		}
+		if !strings.EqualFold(rule.Backend, LocalBackend) && !c.HasBackend(rule.Backend) {
+			return fmt.Errorf("tls_passthrough %d: backend %q is not defined in backends", i, rule.Backend)
+		}
+	}
+
+	return nil
+}
+
+// validateAuth checks that every enabled authentication method has a credential store
+func (c *Config) validateAuth() error {
+	for _, method := range c.AuthMethods {
+		switch method {
+		case "bearer", "query", "header":
+			if len(c.AuthTokens) == 0 && c.AuthTokensFile == "" {
+				return fmt.Errorf("auth method %q requires auth_tokens or auth_tokens_file", method)
+			}
+		case "basic":
+			if c.AuthHtpasswdFile == "" {
+				return fmt.Errorf("auth method \"basic\" requires auth_htpasswd_file")
+			}
+		default:
+			return fmt.Errorf("invalid auth method: %s (must be 'bearer', 'query', 'basic' or 'header')", method)
+		}
+	}
+
+	if c.AuthQueryParam == "" {
+		return fmt.Errorf("auth_query_param must not be empty")
+	}
+	if c.AuthHeader == "" {
+		return fmt.Errorf("auth_header must not be empty")
+	}
+	return nil
+}
+
+// validateACL checks that every rule is named, has networks and a known action.
+// Rule files are only read when the ACL is loaded.
+func (c *Config) validateACL() error {
+	if c.ACLDefault != "allow" && c.ACLDefault != "deny" {
+		return fmt.Errorf("invalid acl_default: %s (must be 'allow' or 'deny')", c.ACLDefault)
+	}
+
+	names := make(map[string]bool, len(c.ACLRules))
+	for i, rule := range c.ACLRules {
+		if rule.Name == "" {
+			return fmt.Errorf("acl rule %d: name is required", i)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("acl rule %d: duplicate name %q", i, rule.Name)
+		}
+		names[rule.Name] = true
+
+		if rule.Action != "allow" && rule.Action != "deny" {
+			return fmt.Errorf("acl rule %q: invalid action: %s (must be 'allow' or 'deny')", rule.Name, rule.Action)
+		}
+		if len(rule.CIDRs) == 0 && rule.File == "" {
+			return fmt.Errorf("acl rule %q: cidrs or file is required", rule.Name)
+		}
+		for _, entry := range rule.CIDRs {
+			if !validAddressOrCIDR(entry) {
+				return fmt.Errorf("acl rule %q: invalid address or CIDR: %s", rule.Name, entry)
+			}
+		}
+	}
+	return nil
+}
+
+// validateQuotas checks the quota settings, which need accounting enabled
+func (c *Config) validateQuotas() error {
+	if c.QuotaAction != "cutoff" && c.QuotaAction != "throttle" {
+		return fmt.Errorf("invalid quota_action: %s (must be 'cutoff' or 'throttle')", c.QuotaAction)
+	}
+	if c.QuotaAction == "throttle" && c.QuotaThrottleRate <= 0 {
+		return fmt.Errorf("quota_throttle_rate must be positive when quota_action is 'throttle'")
+	}
+	if c.AccountingRetention < 0 {
+		return fmt.Errorf("accounting_retention must not be negative")
+	}
+	if c.QuotaDaily < 0 || c.QuotaMonthly < 0 {
+		return fmt.Errorf("quota_daily and quota_monthly must not be negative")
+	}
+
+	quotas := c.QuotaDaily > 0 || c.QuotaMonthly > 0 || len(c.QuotaOverrides) > 0
+	if quotas && !c.AccountingEnabled {
+		return fmt.Errorf("quotas require accounting_enabled")
+	}
+
+	for i, quota := range c.QuotaOverrides {
+		if quota.Identity == "" {
+			return fmt.Errorf("quota_overrides %d: identity is required", i)
+		}
+		if quota.Daily < 0 || quota.Monthly < 0 {
+			return fmt.Errorf("quota_overrides %q: daily and monthly must not be negative", quota.Identity)
+		}
+	}
 	return nil
 }
 
+// validAddressOrCIDR accepts a bare IP address or a CIDR network
+func validAddressOrCIDR(entry string) bool {
+	if net.ParseIP(entry) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(entry)
+	return err == nil
+}
+
+// validProxyProtocolVersion accepts an empty (disabled) or known PROXY protocol version
+func validProxyProtocolVersion(version string) bool {
+	return version == "" || version == "v1" || version == "v2"
+}
+
+// HasBackend reports whether a backend with the given name is configured.
+// Names are case-insensitive since configuration keys are lowercased on load.
+func (c *Config) HasBackend(name string) bool {
+	_, ok := c.Backends[strings.ToLower(name)]
+	return ok
+}
+
 // GetLogLevel returns the slog level based on configuration
 func (c *Config) GetLogLevel() slog.Level {
 	switch c.LogLevel {
@@ -173,4 +744,41 @@ func (c *Config) GetLogLevel() slog.Level {
 	default:
 		return slog.LevelInfo
 	}
+}
+
+// GetHandshakeTimeout returns how long a client may take to complete the upgrade handshake
+func (c *Config) GetHandshakeTimeout() time.Duration {
+	if c.HandshakeTimeout > 0 {
+		return time.Duration(c.HandshakeTimeout) * time.Second
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+// GetDialTimeout returns how long connecting to the destination may take
+func (c *Config) GetDialTimeout() time.Duration {
+	if c.DialTimeout > 0 {
+		return time.Duration(c.DialTimeout) * time.Second
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+// GetIdleTimeout returns how long a tunnel may go without traffic, zero means forever
+func (c *Config) GetIdleTimeout() time.Duration {
+	return time.Duration(c.IdleTimeout) * time.Second
+}
+
+// GetDrainTimeout returns how long shutdown waits for active sessions to finish
+func (c *Config) GetDrainTimeout() time.Duration {
+	return time.Duration(c.DrainTimeout) * time.Second
+}
+
+// GetSniffTimeout returns how long the multiplexing listener waits for a
+// client's first bytes before assuming an SSH client waiting for the banner
+func (c *Config) GetSniffTimeout() time.Duration {
+	return time.Duration(c.SniffTimeout) * time.Second
+}
+
+// GetMaxSessionDuration returns the maximum lifetime of a tunnel, zero means unlimited
+func (c *Config) GetMaxSessionDuration() time.Duration {
+	return time.Duration(c.MaxSessionDuration) * time.Second
 }
\ No newline at end of file
@@ -0,0 +1,98 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Endpoint paths served by Handler
+const (
+	PathHealth    = "/healthz"
+	PathLiveness  = "/livez"
+	PathReadiness = "/readyz"
+)
+
+// State is the server the endpoints report on
+type State interface {
+	// Live reports whether the server still accepts connections, or is
+	// draining them on purpose
+	Live() bool
+	// Serving returns why the listeners do not take new tunnels, nil if they do
+	Serving() error
+}
+
+// Handler serves the health, liveness and readiness endpoints
+type Handler struct {
+	state  State
+	prober *Prober
+}
+
+// NewHandler creates the endpoints of state. Readiness includes the last
+// probe results of prober.
+func NewHandler(state State, prober *Prober) *Handler {
+	return &Handler{state: state, prober: prober}
+}
+
+// response is the JSON body of every endpoint
+type response struct {
+	Status    string   `json:"status"`
+	Error     string   `json:"error,omitempty"`
+	Listeners string   `json:"listeners,omitempty"`
+	Backends  []Result `json:"backends,omitempty"`
+}
+
+// ServeHTTP answers by path: /healthz as long as the process runs, /livez
+// while the accept loop turns over and /readyz while tunnels can be served
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case PathHealth:
+		writeStatus(w, http.StatusOK, response{Status: "ok"})
+	case PathLiveness:
+		if !h.state.Live() {
+			writeStatus(w, http.StatusServiceUnavailable, response{Status: "failed", Error: "accept loop stalled"})
+			return
+		}
+		writeStatus(w, http.StatusOK, response{Status: "ok"})
+	case PathReadiness:
+		h.serveReadiness(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveReadiness fails while the listeners do not serve, the default backend
+// is down or every backend is. Other backends being down only shows in the
+// body, the routes to the remaining ones still work.
+func (h *Handler) serveReadiness(w http.ResponseWriter) {
+	resp := response{Status: "ready", Listeners: "ok", Backends: h.prober.Results()}
+	status := http.StatusOK
+
+	if err := h.state.Serving(); err != nil {
+		resp.Status, resp.Listeners = "not ready", err.Error()
+		status = http.StatusServiceUnavailable
+	}
+
+	down := 0
+	for _, r := range resp.Backends {
+		if r.OK {
+			continue
+		}
+		down++
+		if r.Default {
+			resp.Status, resp.Error = "not ready", "default backend unreachable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	if down > 0 && down == len(resp.Backends) {
+		resp.Status, resp.Error = "not ready", "no backend reachable"
+		status = http.StatusServiceUnavailable
+	}
+	writeStatus(w, status, resp)
+}
+
+func writeStatus(w http.ResponseWriter, status int, resp response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
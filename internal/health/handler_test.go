@@ -0,0 +1,128 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeState is a server in a fixed state
+type fakeState struct {
+	live    bool
+	serving error
+}
+
+func (s fakeState) Live() bool     { return s.live }
+func (s fakeState) Serving() error { return s.serving }
+
+// probedProber returns a prober whose last probes had the given results
+func probedProber(results ...Result) *Prober {
+	p := NewProber(Settings{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	p.results = make(map[string]Result)
+	for _, r := range results {
+		p.settings.Targets = append(p.settings.Targets, Target{Name: r.Name, Address: r.Address, Default: r.Default})
+		r.Checked = time.Now()
+		p.results[r.Name] = r
+	}
+	return p
+}
+
+func get(t *testing.T, h *Handler, path string) (int, response) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	var resp response
+	if rec.Code != http.StatusNotFound {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid JSON %q: %v", rec.Body.String(), err)
+		}
+	}
+	return rec.Code, resp
+}
+
+func TestLiveness(t *testing.T) {
+	tests := []struct {
+		name   string
+		state  fakeState
+		health int
+		live   int
+	}{
+		{name: "accepting", state: fakeState{live: true}, health: http.StatusOK, live: http.StatusOK},
+		{name: "stalled accept loop", state: fakeState{live: false}, health: http.StatusOK, live: http.StatusServiceUnavailable},
+		{name: "draining", state: fakeState{live: true, serving: errors.New("draining")}, health: http.StatusOK, live: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(tt.state, probedProber())
+			if status, _ := get(t, h, PathHealth); status != tt.health {
+				t.Errorf("%s: status %d, want %d", PathHealth, status, tt.health)
+			}
+			status, resp := get(t, h, PathLiveness)
+			if status != tt.live {
+				t.Errorf("%s: status %d, want %d", PathLiveness, status, tt.live)
+			}
+			if status != http.StatusOK && resp.Error == "" {
+				t.Errorf("%s: failure without an error", PathLiveness)
+			}
+		})
+	}
+
+	if status, _ := get(t, NewHandler(fakeState{live: true}, probedProber()), "/metrics"); status != http.StatusNotFound {
+		t.Errorf("unknown path: status %d, want 404", status)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	defaultUp := Result{Name: "default", Address: "127.0.0.1:22", Default: true, OK: true}
+	defaultDown := Result{Name: "default", Address: "127.0.0.1:22", Default: true, Error: "connect failed"}
+	webUp := Result{Name: "web", Address: "127.0.0.1:8080", OK: true}
+	webDown := Result{Name: "web", Address: "127.0.0.1:8080", Error: "connect failed"}
+	mailDown := Result{Name: "mail", Address: "127.0.0.1:993", Error: "connect failed"}
+
+	tests := []struct {
+		name    string
+		serving error
+		results []Result
+		status  int
+	}{
+		{name: "all up", results: []Result{defaultUp, webUp}, status: http.StatusOK},
+		{name: "no probes", status: http.StatusOK},
+		{name: "other backend down", results: []Result{defaultUp, webDown}, status: http.StatusOK},
+		{name: "default backend down", results: []Result{defaultDown, webUp}, status: http.StatusServiceUnavailable},
+		{name: "named default down", results: []Result{{Name: "web", Address: "127.0.0.1:8080", Default: true}, mailDown}, status: http.StatusServiceUnavailable},
+		{name: "every other backend down", results: []Result{webDown, mailDown}, status: http.StatusServiceUnavailable},
+		{name: "one of the others up", results: []Result{webUp, mailDown}, status: http.StatusOK},
+		{name: "listeners not bound", serving: errors.New("listeners not bound yet"), results: []Result{defaultUp}, status: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(fakeState{live: true, serving: tt.serving}, probedProber(tt.results...))
+			status, resp := get(t, h, PathReadiness)
+			if status != tt.status {
+				t.Errorf("status %d, want %d: %+v", status, tt.status, resp)
+			}
+			if (resp.Status == "ready") != (tt.status == http.StatusOK) {
+				t.Errorf("status %q with code %d", resp.Status, status)
+			}
+
+			// Every backend is reported, failing or not
+			if len(resp.Backends) != len(tt.results) {
+				t.Fatalf("%d backends reported, want %d", len(resp.Backends), len(tt.results))
+			}
+			for _, r := range resp.Backends {
+				for _, want := range tt.results {
+					if r.Name == want.Name && (r.OK != want.OK || r.Error != want.Error) {
+						t.Errorf("reported %+v, want %+v", r, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package health
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gowsoos/internal/config"
+	"gowsoos/internal/proxyproto"
+)
+
+// Probe modes
+const (
+	ProbeTCP  = "tcp"  // the backend accepts connections
+	ProbeSSH  = "ssh"  // the backend sends an SSH identification string
+	ProbeNone = "none" // backends are not probed
+)
+
+// Target is a backend probed for readiness
+type Target struct {
+	Name          string
+	Address       string
+	ProxyProtocol string // PROXY protocol version sent before probing, "" for none
+	Banner        bool   // wait for the SSH identification string, not just the connect
+	Default       bool   // connections matching no route go here
+}
+
+// Settings are the targets and timing of the probes
+type Settings struct {
+	Targets  []Target
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// Result is the outcome of the last probe of a target
+type Result struct {
+	Name    string    `json:"name"`
+	Address string    `json:"address"`
+	Default bool      `json:"default,omitempty"`
+	OK      bool      `json:"ok"`
+	Error   string    `json:"error,omitempty"`
+	Checked time.Time `json:"checked"`
+}
+
+// Prober periodically probes the backends tunnels are forwarded to
+type Prober struct {
+	mu       sync.Mutex
+	settings Settings
+	results  map[string]Result // by target name
+	wake     chan struct{}
+	logger   *slog.Logger
+}
+
+// NewProber creates a prober of settings, it probes once Run is called
+func NewProber(settings Settings, logger *slog.Logger) *Prober {
+	return &Prober{
+		settings: settings,
+		results:  make(map[string]Result),
+		wake:     make(chan struct{}, 1),
+		logger:   logger,
+	}
+}
+
+// SettingsFor returns the probe settings of a configuration. Backends that
+// only receive TLS passthrough get TCP probes since they do not speak SSH.
+func SettingsFor(cfg *config.Config) Settings {
+	settings := Settings{
+		Interval: time.Duration(cfg.HealthProbeInterval) * time.Second,
+		Timeout:  time.Duration(cfg.HealthProbeTimeout) * time.Second,
+	}
+	if cfg.HealthProbe == ProbeNone {
+		return settings
+	}
+
+	tunneled := make(map[string]bool)
+	if cfg.DefaultBackend == "" {
+		settings.Targets = append(settings.Targets, Target{
+			Name:          "default",
+			Address:       cfg.DstAddress,
+			ProxyProtocol: cfg.DstProxyProtocol,
+			Banner:        cfg.HealthProbe == ProbeSSH,
+			Default:       true,
+		})
+	} else {
+		tunneled[strings.ToLower(cfg.DefaultBackend)] = true
+	}
+	for _, route := range cfg.Routes {
+		tunneled[strings.ToLower(route.Backend)] = true
+	}
+
+	for name, backend := range cfg.Backends {
+		name = strings.ToLower(name)
+		settings.Targets = append(settings.Targets, Target{
+			Name:          name,
+			Address:       backend.Address,
+			ProxyProtocol: backend.ProxyProtocol,
+			Banner:        cfg.HealthProbe == ProbeSSH && tunneled[name],
+			Default:       name == strings.ToLower(cfg.DefaultBackend),
+		})
+	}
+	sort.Slice(settings.Targets, func(i, j int) bool { return settings.Targets[i].Name < settings.Targets[j].Name })
+	return settings
+}
+
+// SetSettings replaces the targets and timing and probes again straight away
+func (p *Prober) SetSettings(settings Settings) {
+	p.mu.Lock()
+	p.settings = settings
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run probes every target each interval until ctx is done
+func (p *Prober) Run(ctx context.Context) {
+	for {
+		p.probeAll(ctx)
+
+		p.mu.Lock()
+		interval := p.settings.Interval
+		p.mu.Unlock()
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-p.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Results returns the last result of every target ordered by name. Targets
+// not probed yet are reported as failing.
+func (p *Prober) Results() []Result {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	results := make([]Result, 0, len(p.settings.Targets))
+	for _, t := range p.settings.Targets {
+		r, ok := p.results[t.Name]
+		if !ok || r.Address != t.Address {
+			r = Result{Name: t.Name, Address: t.Address, Error: "not probed yet"}
+		}
+		r.Default = t.Default
+		results = append(results, r)
+	}
+	return results
+}
+
+// probeAll probes the targets concurrently and records the results
+func (p *Prober) probeAll(ctx context.Context) {
+	p.mu.Lock()
+	settings := p.settings
+	p.mu.Unlock()
+
+	results := make([]Result, len(settings.Targets))
+	var wg sync.WaitGroup
+	for i, t := range settings.Targets {
+		wg.Add(1)
+		go func(i int, t Target) {
+			defer wg.Done()
+			results[i] = Result{Name: t.Name, Address: t.Address, OK: true, Checked: time.Now()}
+			if err := probe(ctx, t, settings.Timeout); err != nil {
+				results[i].OK, results[i].Error = false, err.Error()
+			}
+		}(i, t)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := make(map[string]Result, len(results))
+	for _, r := range results {
+		previous, seen := p.results[r.Name]
+		switch {
+		case !r.OK && (!seen || previous.OK):
+			p.logger.Warn("Backend unreachable", "backend", r.Name, "address", r.Address, "error", r.Error)
+		case r.OK && seen && !previous.OK:
+			p.logger.Info("Backend reachable again", "backend", r.Name, "address", r.Address)
+		}
+		current[r.Name] = r
+	}
+	p.results = current
+}
+
+// probe connects to the target and, for banner probes, waits for the SSH
+// identification string. Backends expecting a PROXY protocol header get a
+// local one, as meant for health checks: LOCAL in v2, UNKNOWN in v1.
+func probe(ctx context.Context, t Target, timeout time.Duration) error {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", t.Address)
+	if err != nil {
+		return errors.Wrap(err, "connect failed")
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return errors.Wrap(err, "failed to set deadline")
+	}
+
+	if t.ProxyProtocol != "" {
+		h := &proxyproto.Header{Version: 1, Local: true}
+		if t.ProxyProtocol == "v2" {
+			h.Version = 2
+		}
+		b, err := h.Format()
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(b); err != nil {
+			return errors.Wrap(err, "failed to write PROXY protocol header")
+		}
+	}
+
+	if !t.Banner {
+		return nil
+	}
+
+	// Servers may send other lines before the identification string (RFC 4253 4.2)
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if strings.HasPrefix(line, "SSH-") {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "no SSH identification received")
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package health
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"gowsoos/internal/proxyproto"
+)
+
+// fakeBackend accepts connections and runs serve on each of them
+func fakeBackend(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// closedAddress returns an address nothing listens on
+func closedAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+// sendLines answers a connection with lines and then waits for the client
+func sendLines(lines ...string) func(net.Conn) {
+	return func(conn net.Conn) {
+		for _, line := range lines {
+			conn.Write([]byte(line))
+		}
+		io.Copy(io.Discard, conn)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	silent := func(conn net.Conn) { io.Copy(io.Discard, conn) }
+
+	tests := []struct {
+		name   string
+		target Target
+		ok     bool
+	}{
+		{name: "tcp", target: Target{Address: fakeBackend(t, silent)}, ok: true},
+		{name: "tcp refused", target: Target{Address: closedAddress(t)}},
+		{name: "ssh banner", target: Target{Address: fakeBackend(t, sendLines("SSH-2.0-OpenSSH_9.6\r\n")), Banner: true}, ok: true},
+		{
+			name:   "ssh banner after other lines",
+			target: Target{Address: fakeBackend(t, sendLines("Welcome\r\n", "Authorized use only\r\n", "SSH-2.0-dropbear\r\n")), Banner: true},
+			ok:     true,
+		},
+		{name: "ssh banner in parts", target: Target{Address: fakeBackend(t, sendLines("SSH-2.", "0-OpenSSH\r\n")), Banner: true}, ok: true},
+		{name: "silent backend", target: Target{Address: fakeBackend(t, silent), Banner: true}},
+		{name: "http backend", target: Target{Address: fakeBackend(t, func(conn net.Conn) { conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n")) }), Banner: true}},
+		{name: "banner refused", target: Target{Address: closedAddress(t), Banner: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := probe(context.Background(), tt.target, 200*time.Millisecond)
+			if (err == nil) != tt.ok {
+				t.Errorf("probe = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestProbeProxyHeader(t *testing.T) {
+	for _, version := range []string{"v1", "v2"} {
+		t.Run(version, func(t *testing.T) {
+			headers := make(chan *proxyproto.Header, 1)
+			addr := fakeBackend(t, func(conn net.Conn) {
+				r := bufio.NewReader(conn)
+				h, err := proxyproto.ReadHeader(r)
+				if err != nil {
+					t.Errorf("invalid PROXY header: %v", err)
+					return
+				}
+				headers <- h
+				conn.Write([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+				io.Copy(io.Discard, r)
+			})
+
+			target := Target{Address: addr, ProxyProtocol: version, Banner: true}
+			if err := probe(context.Background(), target, time.Second); err != nil {
+				t.Fatal(err)
+			}
+			h := <-headers
+			if h.Source != nil || h.Destination != nil {
+				t.Errorf("header relays %s to %s, want no addresses", h.Source, h.Destination)
+			}
+			if version == "v2" && !h.Local {
+				t.Error("v2 header uses the PROXY command, want LOCAL")
+			}
+		})
+	}
+}
+
+func TestProberResults(t *testing.T) {
+	up := fakeBackend(t, sendLines("SSH-2.0-OpenSSH_9.6\r\n"))
+	down := closedAddress(t)
+
+	p := NewProber(Settings{
+		Targets: []Target{
+			{Name: "default", Address: up, Banner: true, Default: true},
+			{Name: "down", Address: down},
+		},
+		Interval: time.Hour,
+		Timeout:  time.Second,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	for _, r := range p.Results() {
+		if r.OK || r.Error != "not probed yet" {
+			t.Errorf("%s before probing: %+v", r.Name, r)
+		}
+	}
+
+	p.probeAll(context.Background())
+	results := p.Results()
+	if len(results) != 2 || !results[0].OK || !results[0].Default || results[1].OK || results[1].Default {
+		t.Fatalf("results %+v, want the default backend up and the other down", results)
+	}
+	if results[1].Error == "" || results[1].Checked.IsZero() {
+		t.Errorf("failed result %+v, want the error and time", results[1])
+	}
+
+	// A target that moved is not probed yet at its new address
+	p.SetSettings(Settings{Targets: []Target{{Name: "default", Address: down, Default: true}}, Interval: time.Hour, Timeout: time.Second})
+	if results := p.Results(); len(results) != 1 || results[0].OK || results[0].Error != "not probed yet" {
+		t.Errorf("results %+v after moving the target", results)
+	}
+}
@@ -0,0 +1,133 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Rejection reasons reported by Admission
+const (
+	ReasonGlobalLimit  = "global_limit"
+	ReasonPerIPLimit   = "per_ip_limit"
+	ReasonQueueTimeout = "queue_timeout"
+)
+
+// LimitError is returned when a connection is not admitted
+type LimitError struct {
+	Reason string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("connection limit reached: %s", e.Reason)
+}
+
+// Admission caps the number of concurrent sessions, both in total and per source IP.
+// Connections over the limit are either rejected straight away or queued until a
+// slot frees up or the queue timeout expires.
+type Admission struct {
+	mu           sync.Mutex
+	maxTotal     int
+	maxPerIP     int
+	queue        bool
+	queueTimeout time.Duration
+
+	total    int
+	perIP    map[string]int
+	released chan struct{}
+}
+
+// NewAdmission creates an admission controller. A maxPerIP of zero disables the per-IP cap.
+func NewAdmission(maxTotal, maxPerIP int, queue bool, queueTimeout time.Duration) *Admission {
+	return &Admission{
+		maxTotal:     maxTotal,
+		maxPerIP:     maxPerIP,
+		queue:        queue,
+		queueTimeout: queueTimeout,
+		perIP:        make(map[string]int),
+		released:     make(chan struct{}),
+	}
+}
+
+// Acquire reserves a session slot for ip. The returned function releases it and
+// is safe to call more than once.
+func (a *Admission) Acquire(ctx context.Context, ip string) (func(), error) {
+	a.mu.Lock()
+	queue, queueTimeout := a.queue, a.queueTimeout
+	a.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if queue {
+		timer := time.NewTimer(queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		a.mu.Lock()
+		err := a.check(ip)
+		if err == nil {
+			a.total++
+			a.perIP[ip]++
+			a.mu.Unlock()
+
+			var once sync.Once
+			return func() { once.Do(func() { a.release(ip) }) }, nil
+		}
+		if !queue {
+			a.mu.Unlock()
+			return nil, err
+		}
+		wait := a.released
+		a.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-timeout:
+			return nil, &LimitError{Reason: ReasonQueueTimeout}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// SetLimits replaces the limits. Sessions already admitted are kept even if
+// they exceed the new limits, queued connections are re-evaluated.
+func (a *Admission) SetLimits(maxTotal, maxPerIP int, queue bool, queueTimeout time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.maxTotal = maxTotal
+	a.maxPerIP = maxPerIP
+	a.queue = queue
+	a.queueTimeout = queueTimeout
+
+	close(a.released)
+	a.released = make(chan struct{})
+}
+
+// check reports whether a new session for ip would exceed a limit. Caller holds mu.
+func (a *Admission) check(ip string) error {
+	if a.total >= a.maxTotal {
+		return &LimitError{Reason: ReasonGlobalLimit}
+	}
+	if a.maxPerIP > 0 && a.perIP[ip] >= a.maxPerIP {
+		return &LimitError{Reason: ReasonPerIPLimit}
+	}
+	return nil
+}
+
+// release frees a slot and wakes up queued connections
+func (a *Admission) release(ip string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.total--
+	if a.perIP[ip]--; a.perIP[ip] <= 0 {
+		delete(a.perIP, ip)
+	}
+
+	close(a.released)
+	a.released = make(chan struct{})
+}
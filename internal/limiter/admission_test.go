@@ -0,0 +1,229 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAdmissionReject(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxTotal int
+		maxPerIP int
+		ips      []string
+		reasons  []string // per acquisition, "" when admitted
+	}{
+		{
+			name:     "global limit",
+			maxTotal: 2,
+			ips:      []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"},
+			reasons:  []string{"", "", ReasonGlobalLimit},
+		},
+		{
+			name:     "per-IP limit",
+			maxTotal: 10,
+			maxPerIP: 2,
+			ips:      []string{"192.0.2.1", "192.0.2.1", "192.0.2.1", "192.0.2.2"},
+			reasons:  []string{"", "", ReasonPerIPLimit, ""},
+		},
+		{
+			name:     "global before per-IP",
+			maxTotal: 1,
+			maxPerIP: 1,
+			ips:      []string{"192.0.2.1", "192.0.2.1"},
+			reasons:  []string{"", ReasonGlobalLimit},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAdmission(tt.maxTotal, tt.maxPerIP, false, time.Minute)
+			for i, ip := range tt.ips {
+				release, err := a.Acquire(context.Background(), ip)
+				if got := reason(t, err); got != tt.reasons[i] {
+					t.Errorf("acquisition %d: refused with %q, want %q", i, got, tt.reasons[i])
+				}
+				if (release != nil) != (err == nil) {
+					t.Errorf("acquisition %d: release func %v with error %v", i, release != nil, err)
+				}
+			}
+		})
+	}
+}
+
+func TestAdmissionRelease(t *testing.T) {
+	a := NewAdmission(2, 1, false, time.Minute)
+
+	first, err := a.Acquire(context.Background(), "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := a.Acquire(context.Background(), "192.0.2.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first()
+	first()
+	if a.total != 1 || len(a.perIP) != 1 {
+		t.Errorf("total %d, %d IPs after releasing twice, want 1 and 1", a.total, len(a.perIP))
+	}
+	if _, ok := a.perIP["192.0.2.1"]; ok {
+		t.Error("released IP still has an entry")
+	}
+
+	// The freed per-IP slot is available again
+	third, err := a.Acquire(context.Background(), "192.0.2.1")
+	if err != nil {
+		t.Fatalf("slot not freed: %v", err)
+	}
+	second()
+	third()
+	if a.total != 0 || len(a.perIP) != 0 {
+		t.Errorf("total %d, %d IPs after releasing everything", a.total, len(a.perIP))
+	}
+}
+
+func TestAdmissionQueue(t *testing.T) {
+	a := NewAdmission(1, 0, true, 50*time.Millisecond)
+	release, err := a.Acquire(context.Background(), "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := a.Acquire(context.Background(), "192.0.2.2"); reason(t, err) != ReasonQueueTimeout {
+		t.Errorf("queued acquisition: %v, want a queue timeout", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("gave up after %v, want the queue timeout", waited)
+	}
+
+	// A queued connection gets the slot once it is released
+	a.SetLimits(1, 0, true, 5*time.Second)
+	admitted := make(chan error, 1)
+	go func() {
+		release, err := a.Acquire(context.Background(), "192.0.2.2")
+		if err == nil {
+			defer release()
+		}
+		admitted <- err
+	}()
+
+	select {
+	case err := <-admitted:
+		t.Fatalf("admitted over the limit: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	select {
+	case err := <-admitted:
+		if err != nil {
+			t.Errorf("queued acquisition: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued connection not admitted after a release")
+	}
+}
+
+func TestAdmissionQueueCancel(t *testing.T) {
+	a := NewAdmission(1, 0, true, 5*time.Second)
+	release, err := a.Acquire(context.Background(), "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := a.Acquire(ctx, "192.0.2.2"); err != context.DeadlineExceeded {
+		t.Errorf("cancelled acquisition: %v, want the context error", err)
+	}
+}
+
+func TestAdmissionSetLimits(t *testing.T) {
+	a := NewAdmission(1, 0, true, 5*time.Second)
+	release, err := a.Acquire(context.Background(), "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	admitted := make(chan error, 1)
+	go func() {
+		release, err := a.Acquire(context.Background(), "192.0.2.2")
+		if err == nil {
+			defer release()
+		}
+		admitted <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// Raising the limit lets queued connections in without a release
+	a.SetLimits(2, 0, true, 5*time.Second)
+	select {
+	case err := <-admitted:
+		if err != nil {
+			t.Errorf("queued acquisition: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued connection not admitted after raising the limit")
+	}
+
+	// Admitted sessions are kept over a lower limit, new ones are refused
+	a.SetLimits(0, 0, false, 0)
+	if _, err := a.Acquire(context.Background(), "192.0.2.3"); reason(t, err) != ReasonGlobalLimit {
+		t.Errorf("acquisition over a lowered limit: %v", err)
+	}
+}
+
+func TestUserLimit(t *testing.T) {
+	u := NewUserLimit(2)
+
+	alice1, err := u.Acquire("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice2, err := u.Acquire("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.Acquire("alice"); reason(t, err) != ReasonPerUserLimit {
+		t.Errorf("third session of alice: %v", err)
+	}
+	bob, err := u.Acquire("bob")
+	if err != nil {
+		t.Errorf("bob refused for the sessions of alice: %v", err)
+	}
+
+	alice1()
+	alice1()
+	if u.active["alice"] != 1 {
+		t.Errorf("alice has %d sessions after releasing one twice, want 1", u.active["alice"])
+	}
+	if _, err := u.Acquire("alice"); err != nil {
+		t.Errorf("freed slot refused: %v", err)
+	}
+
+	bob()
+	if _, ok := u.active["bob"]; ok {
+		t.Error("released user still has an entry")
+	}
+
+	// Zero disables the limit, sessions admitted before are kept
+	u.SetLimit(0)
+	for i := 0; i < 5; i++ {
+		if _, err := u.Acquire("alice"); err != nil {
+			t.Fatalf("refused without a limit: %v", err)
+		}
+	}
+	u.SetLimit(1)
+	if _, err := u.Acquire("alice"); reason(t, err) != ReasonPerUserLimit {
+		t.Errorf("acquisition over a lowered limit: %v", err)
+	}
+	alice2()
+	if u.active["alice"] != 6 {
+		t.Errorf("alice has %d sessions, want 6", u.active["alice"])
+	}
+}
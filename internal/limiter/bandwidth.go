@@ -0,0 +1,254 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// Directions of shaped traffic, seen from the client
+const (
+	Upload   = "upload"
+	Download = "download"
+)
+
+// Scopes a bandwidth cap applies to, reported as the cause of a wait
+const (
+	ScopeGlobal     = "global"
+	ScopeConnection = "connection"
+	ScopeIP         = "ip"
+)
+
+const (
+	// chunkInterval is the traffic a single read may move at the lowest
+	// applicable rate, so waits stay short and shaping smooth
+	chunkInterval = 100 * time.Millisecond
+
+	// minChunk keeps very low rates from degrading into tiny reads
+	minChunk = 1024
+)
+
+// Rates are bandwidth caps in bytes per second. Zero leaves a cap unlimited.
+type Rates struct {
+	GlobalUpload   int64
+	GlobalDownload int64
+	ConnUpload     int64
+	ConnDownload   int64
+	IPUpload       int64
+	IPDownload     int64
+}
+
+// enabled reports whether any cap is set
+func (r Rates) enabled() bool {
+	return r.GlobalUpload > 0 || r.GlobalDownload > 0 ||
+		r.ConnUpload > 0 || r.ConnDownload > 0 ||
+		r.IPUpload > 0 || r.IPDownload > 0
+}
+
+// bucket is a token bucket of bytes holding up to one second of traffic.
+// Reservations may overdraw it, the debt is the time the caller has to wait.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int64) *bucket {
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: clock()}
+}
+
+// refill adds the tokens accumulated since the last call
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+		b.last = now
+	}
+}
+
+func (b *bucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(clock())
+	b.rate = float64(rate)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+func (b *bucket) currentRate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// reserve takes n bytes and returns how long the caller must wait before
+// moving them. An unlimited bucket never makes it wait.
+func (b *bucket) reserve(n int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// bucketPair holds the buckets of both directions
+type bucketPair struct {
+	upload   *bucket
+	download *bucket
+}
+
+func newBucketPair(upload, download int64) bucketPair {
+	return bucketPair{upload: newBucket(upload), download: newBucket(download)}
+}
+
+func (bp bucketPair) get(direction string) *bucket {
+	if direction == Upload {
+		return bp.upload
+	}
+	return bp.download
+}
+
+// ipBuckets are the buckets shared by the connections of one source IP
+type ipBuckets struct {
+	bucketPair
+	refs int
+}
+
+// Shaper caps tunnel bandwidth globally, per connection and per source IP,
+// separately for upload and download.
+type Shaper struct {
+	mu     sync.Mutex
+	rates  Rates
+	global bucketPair
+	perIP  map[string]*ipBuckets
+}
+
+// NewShaper creates a shaper enforcing rates
+func NewShaper(rates Rates) *Shaper {
+	return &Shaper{
+		rates:  rates,
+		global: newBucketPair(rates.GlobalUpload, rates.GlobalDownload),
+		perIP:  make(map[string]*ipBuckets),
+	}
+}
+
+// SetRates replaces the caps. Global and per-IP caps apply to running
+// connections straight away, per-connection caps to new ones.
+func (s *Shaper) SetRates(rates Rates) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rates = rates
+	s.global.upload.setRate(rates.GlobalUpload)
+	s.global.download.setRate(rates.GlobalDownload)
+	for _, ipb := range s.perIP {
+		ipb.upload.setRate(rates.IPUpload)
+		ipb.download.setRate(rates.IPDownload)
+	}
+}
+
+// Open returns the shaping state of a new connection from ip, or nil when
+// no cap is set so the connection can take the unshaped fast path
+func (s *Shaper) Open(ip string) *Flow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.rates.enabled() {
+		return nil
+	}
+
+	ipb, ok := s.perIP[ip]
+	if !ok {
+		ipb = &ipBuckets{bucketPair: newBucketPair(s.rates.IPUpload, s.rates.IPDownload)}
+		s.perIP[ip] = ipb
+	}
+	ipb.refs++
+
+	return &Flow{
+		shaper: s,
+		ip:     ip,
+		conn:   newBucketPair(s.rates.ConnUpload, s.rates.ConnDownload),
+		perIP:  ipb.bucketPair,
+		global: s.global,
+	}
+}
+
+func (s *Shaper) release(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ipb, ok := s.perIP[ip]; ok {
+		if ipb.refs--; ipb.refs <= 0 {
+			delete(s.perIP, ip)
+		}
+	}
+}
+
+// Flow is the shaping state of one connection
+type Flow struct {
+	shaper *Shaper
+	ip     string
+	conn   bucketPair
+	perIP  bucketPair
+	global bucketPair
+	once   sync.Once
+}
+
+// Reserve accounts for n bytes moved in direction and returns how long to
+// wait before moving more, along with the scope of the cap imposing the wait
+func (f *Flow) Reserve(direction string, n int) (time.Duration, string) {
+	now := clock()
+
+	var delay time.Duration
+	var scope string
+	for _, b := range []struct {
+		scope  string
+		bucket *bucket
+	}{
+		{ScopeConnection, f.conn.get(direction)},
+		{ScopeIP, f.perIP.get(direction)},
+		{ScopeGlobal, f.global.get(direction)},
+	} {
+		if wait := b.bucket.reserve(n, now); wait > delay {
+			delay, scope = wait, b.scope
+		}
+	}
+	return delay, scope
+}
+
+// Chunk returns the largest read in direction that keeps waits short, or
+// zero when the direction is not capped
+func (f *Flow) Chunk(direction string) int {
+	var lowest float64
+	for _, b := range []*bucket{f.conn.get(direction), f.perIP.get(direction), f.global.get(direction)} {
+		if rate := b.currentRate(); rate > 0 && (lowest == 0 || rate < lowest) {
+			lowest = rate
+		}
+	}
+	if lowest == 0 {
+		return 0
+	}
+
+	chunk := int(lowest * chunkInterval.Seconds())
+	if chunk < minChunk {
+		chunk = minChunk
+	}
+	return chunk
+}
+
+// Close releases the per-IP buckets of the connection. It is safe to call
+// more than once.
+func (f *Flow) Close() {
+	f.once.Do(func() { f.shaper.release(f.ip) })
+}
@@ -0,0 +1,188 @@
+package limiter
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fakeClock(t, &now)
+
+	b := newBucket(1000)
+	steps := []struct {
+		after time.Duration
+		n     int
+		wait  time.Duration
+	}{
+		{n: 1000},                              // starts with a second of traffic
+		{n: 500, wait: 500 * time.Millisecond}, // overdrawn
+		{after: 250 * time.Millisecond, n: 0, wait: 250 * time.Millisecond},
+		{after: 250 * time.Millisecond, n: 0},
+		{after: time.Hour, n: 1000}, // refills to one second only
+		{n: 1, wait: time.Millisecond},
+	}
+	for i, step := range steps {
+		now = now.Add(step.after)
+		if wait := b.reserve(step.n, now); wait != step.wait {
+			t.Errorf("step %d: wait %v, want %v", i, wait, step.wait)
+		}
+	}
+
+	unlimited := newBucket(0)
+	for i := 0; i < 3; i++ {
+		if wait := unlimited.reserve(1<<30, now); wait != 0 {
+			t.Errorf("unlimited bucket waits %v", wait)
+		}
+	}
+}
+
+func TestShaperOpen(t *testing.T) {
+	s := NewShaper(Rates{})
+	if f := s.Open("192.0.2.1"); f != nil {
+		t.Error("flow opened without caps")
+	}
+
+	s.SetRates(Rates{IPDownload: 1000})
+	a, b := s.Open("192.0.2.1"), s.Open("192.0.2.1")
+	c := s.Open("192.0.2.2")
+	if a.perIP != b.perIP || a.perIP == c.perIP {
+		t.Error("per-IP buckets not shared by the flows of one IP")
+	}
+
+	a.Close()
+	a.Close()
+	if len(s.perIP) != 2 {
+		t.Errorf("%d IPs after closing one of two flows, want 2", len(s.perIP))
+	}
+	b.Close()
+	c.Close()
+	if len(s.perIP) != 0 {
+		t.Errorf("%d IPs after closing every flow, want 0", len(s.perIP))
+	}
+}
+
+func TestFlowChunk(t *testing.T) {
+	tests := []struct {
+		name     string
+		rates    Rates
+		upload   int
+		download int
+	}{
+		{name: "global", rates: Rates{GlobalUpload: 100 * 1024, GlobalDownload: 200 * 1024}, upload: 10240, download: 20480},
+		{name: "connection", rates: Rates{ConnDownload: 50 * 1024}, download: 5120},
+		{name: "ip", rates: Rates{IPUpload: 30 * 1024}, upload: 3072},
+		{
+			name:     "lowest cap wins",
+			rates:    Rates{GlobalDownload: 1024 * 1024, ConnDownload: 100 * 1024, IPDownload: 40 * 1024},
+			download: 4096,
+		},
+		{name: "minimum chunk", rates: Rates{GlobalUpload: 100, ConnDownload: 5000}, upload: minChunk, download: minChunk},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewShaper(tt.rates).Open("192.0.2.1")
+			defer f.Close()
+			if got := f.Chunk(Upload); got != tt.upload {
+				t.Errorf("upload chunk %d, want %d", got, tt.upload)
+			}
+			if got := f.Chunk(Download); got != tt.download {
+				t.Errorf("download chunk %d, want %d", got, tt.download)
+			}
+		})
+	}
+}
+
+func TestFlowReserveScope(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fakeClock(t, &now)
+
+	s := NewShaper(Rates{GlobalUpload: 4000, ConnUpload: 1000, IPUpload: 2000})
+	f := s.Open("192.0.2.1")
+	defer f.Close()
+
+	if wait, scope := f.Reserve(Upload, 3000); wait != 2*time.Second || scope != ScopeConnection {
+		t.Errorf("Reserve = %v, %s, want 2s by the connection cap", wait, scope)
+	}
+	// Another connection of the same IP only meets the IP cap
+	g := s.Open("192.0.2.1")
+	defer g.Close()
+	if wait, scope := g.Reserve(Upload, 500); wait != 750*time.Millisecond || scope != ScopeIP {
+		t.Errorf("Reserve = %v, %s, want 750ms by the IP cap", wait, scope)
+	}
+	// A connection of another IP only meets the global cap
+	h := s.Open("192.0.2.2")
+	defer h.Close()
+	if wait, scope := h.Reserve(Upload, 1000); wait != 125*time.Millisecond || scope != ScopeGlobal {
+		t.Errorf("Reserve = %v, %s, want 125ms by the global cap", wait, scope)
+	}
+	// The other direction is not capped
+	if wait, scope := h.Reserve(Download, 1<<20); wait != 0 || scope != "" {
+		t.Errorf("Reserve = %v, %s, want no wait", wait, scope)
+	}
+}
+
+// transfer moves traffic through f in chunks for d, waiting as told, and
+// returns the resulting rate in bytes per second
+func transfer(f *Flow, direction string, d time.Duration, now *time.Time) float64 {
+	start, end := *now, now.Add(d)
+	moved := 0
+	for now.Before(end) {
+		n := f.Chunk(direction)
+		wait, _ := f.Reserve(direction, n)
+		moved += n
+		*now = now.Add(wait)
+	}
+	return float64(moved) / now.Sub(start).Seconds()
+}
+
+func TestFlowRate(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fakeClock(t, &now)
+
+	const tolerance = 0.05
+	within := func(got, want float64) bool {
+		return math.Abs(got-want) <= want*tolerance
+	}
+
+	s := NewShaper(Rates{ConnDownload: 100 * 1024, GlobalDownload: 1024 * 1024})
+	f := s.Open("192.0.2.1")
+	defer f.Close()
+
+	// The initial burst of one second spread over a minute stays in tolerance
+	if rate := transfer(f, Download, time.Minute, &now); !within(rate, 100*1024) {
+		t.Errorf("rate %.0f B/s, want 100 KiB/s", rate)
+	}
+
+	// Global and per-IP caps apply to running flows
+	s.SetRates(Rates{ConnDownload: 100 * 1024, GlobalDownload: 20 * 1024})
+	if rate := transfer(f, Download, time.Minute, &now); !within(rate, 20*1024) {
+		t.Errorf("rate %.0f B/s after lowering the global cap, want 20 KiB/s", rate)
+	}
+	s.SetRates(Rates{ConnDownload: 100 * 1024, IPDownload: 50 * 1024})
+	if rate := transfer(f, Download, time.Minute, &now); !within(rate, 50*1024) {
+		t.Errorf("rate %.0f B/s after switching to an IP cap, want 50 KiB/s", rate)
+	}
+
+	// Per-connection caps only apply to new flows
+	s.SetRates(Rates{ConnDownload: 10 * 1024})
+	if rate := transfer(f, Download, time.Minute, &now); !within(rate, 100*1024) {
+		t.Errorf("rate %.0f B/s of the running flow, want 100 KiB/s", rate)
+	}
+	g := s.Open("192.0.2.1")
+	defer g.Close()
+	if rate := transfer(g, Download, time.Minute, &now); !within(rate, 10*1024) {
+		t.Errorf("rate %.0f B/s of a new flow, want 10 KiB/s", rate)
+	}
+
+	// A flow keeps its connection caps when the others change
+	s.SetRates(Rates{GlobalUpload: 1})
+	if wait, _ := g.Reserve(Upload, 1<<20); wait == 0 {
+		t.Error("upload cap not applied")
+	}
+	if chunk := g.Chunk(Download); chunk != 1024 {
+		t.Errorf("download chunk %d, want the connection cap of the flow", chunk)
+	}
+}
@@ -0,0 +1,236 @@
+package limiter
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gowsoos/internal/statefile"
+)
+
+// Rejection reasons reported by Guard
+const (
+	ReasonRateLimit = "rate_limit"
+	ReasonBanned    = "banned"
+)
+
+// clock returns the current time, tests replace it to move through windows,
+// ban durations and token refills without sleeping
+var clock = time.Now
+
+// Ban reasons
+const (
+	BanRapidConnects    = "rapid_connects"
+	BanFailedHandshakes = "failed_handshakes"
+)
+
+// GuardConfig sets the per-IP connection rate limit and ban thresholds.
+// Zero counts disable the respective check.
+type GuardConfig struct {
+	Window              time.Duration // sliding window the counts apply to
+	MaxConnections      int           // new connections allowed per window
+	BanAfterConnections int           // new connections per window that get an IP banned
+	BanAfterFailures    int           // failed handshakes per window that get an IP banned
+	BanDuration         time.Duration
+}
+
+// Ban is a source IP refused until a point in time
+type Ban struct {
+	IP     string    `json:"ip"`
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until"`
+}
+
+// Guard rate limits new connections per source IP over a sliding window and
+// temporarily bans IPs that connect too fast or keep failing handshakes
+type Guard struct {
+	mu       sync.Mutex
+	cfg      GuardConfig
+	connects map[string][]time.Time
+	failures map[string][]time.Time
+	bans     map[string]Ban
+	changed  bool // bans differ from the last snapshot taken with Changed
+}
+
+// NewGuard creates a guard with an empty ban table
+func NewGuard(cfg GuardConfig) *Guard {
+	return &Guard{
+		cfg:      cfg,
+		connects: make(map[string][]time.Time),
+		failures: make(map[string][]time.Time),
+		bans:     make(map[string]Ban),
+	}
+}
+
+// SetConfig replaces the limits. Existing bans run their course.
+func (g *Guard) SetConfig(cfg GuardConfig) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cfg = cfg
+}
+
+// Connect records a new connection from ip and decides whether it may
+// proceed. Refusals are *LimitError values; when the connection gets the IP
+// banned the new ban is returned as well.
+func (g *Guard) Connect(ip string) (*Ban, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := clock()
+	if ban, ok := g.bans[ip]; ok {
+		if now.Before(ban.Until) {
+			return nil, &LimitError{Reason: ReasonBanned}
+		}
+		delete(g.bans, ip)
+		g.changed = true
+	}
+
+	limit := g.cfg.MaxConnections
+	if g.cfg.BanAfterConnections > limit {
+		limit = g.cfg.BanAfterConnections
+	}
+	if limit == 0 {
+		return nil, nil
+	}
+
+	// One event more than the limit tells "at" from "over" the rate
+	count := g.record(g.connects, ip, now, limit+1)
+	if g.cfg.BanAfterConnections > 0 && count >= g.cfg.BanAfterConnections {
+		return g.ban(ip, BanRapidConnects, now), &LimitError{Reason: ReasonBanned}
+	}
+	if g.cfg.MaxConnections > 0 && count > g.cfg.MaxConnections {
+		return nil, &LimitError{Reason: ReasonRateLimit}
+	}
+	return nil, nil
+}
+
+// Failure records a failed handshake from ip and returns the ban it caused, if any
+func (g *Guard) Failure(ip string) *Ban {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.cfg.BanAfterFailures == 0 {
+		return nil
+	}
+	now := clock()
+	if ban, ok := g.bans[ip]; ok && now.Before(ban.Until) {
+		return nil
+	}
+
+	if g.record(g.failures, ip, now, g.cfg.BanAfterFailures) >= g.cfg.BanAfterFailures {
+		return g.ban(ip, BanFailedHandshakes, now)
+	}
+	return nil
+}
+
+// record appends an event for ip, drops the ones that left the window and
+// returns how many remain. At most limit events are kept per IP.
+func (g *Guard) record(events map[string][]time.Time, ip string, now time.Time, limit int) int {
+	times := prune(events[ip], now.Add(-g.cfg.Window))
+	times = append(times, now)
+	if len(times) > limit {
+		times = times[len(times)-limit:]
+	}
+	events[ip] = times
+	return len(times)
+}
+
+// prune drops the events before cutoff, events are in chronological order
+func prune(times []time.Time, cutoff time.Time) []time.Time {
+	i := sort.Search(len(times), func(i int) bool { return times[i].After(cutoff) })
+	return times[i:]
+}
+
+func (g *Guard) ban(ip, reason string, now time.Time) *Ban {
+	ban := Ban{IP: ip, Reason: reason, Until: now.Add(g.cfg.BanDuration)}
+	g.bans[ip] = ban
+	delete(g.connects, ip)
+	delete(g.failures, ip)
+	g.changed = true
+	return &ban
+}
+
+// Expire forgets expired bans and events that left the window, and returns
+// the number of active bans
+func (g *Guard) Expire() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := clock()
+	cutoff := now.Add(-g.cfg.Window)
+	for _, events := range []map[string][]time.Time{g.connects, g.failures} {
+		for ip, times := range events {
+			if times = prune(times, cutoff); len(times) == 0 {
+				delete(events, ip)
+			} else {
+				events[ip] = times
+			}
+		}
+	}
+	for ip, ban := range g.bans {
+		if !now.Before(ban.Until) {
+			delete(g.bans, ip)
+			g.changed = true
+		}
+	}
+	return len(g.bans)
+}
+
+// Bans returns the active bans ordered by IP
+func (g *Guard) Bans() []Ban {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.snapshot()
+}
+
+func (g *Guard) snapshot() []Ban {
+	now := clock()
+	bans := make([]Ban, 0, len(g.bans))
+	for _, ban := range g.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+	return bans
+}
+
+// Changed returns the active bans if the table changed since the last call
+func (g *Guard) Changed() ([]Ban, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.changed {
+		return nil, false
+	}
+	g.changed = false
+	return g.snapshot(), true
+}
+
+// Restore adds bans loaded from disk, skipping expired ones
+func (g *Guard) Restore(bans []Ban) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := clock()
+	for _, ban := range bans {
+		if now.Before(ban.Until) {
+			g.bans[ban.IP] = ban
+		}
+	}
+}
+
+// LoadBans reads a ban table written by SaveBans. A missing file is an empty table.
+func LoadBans(path string) ([]Ban, error) {
+	var bans []Ban
+	if err := statefile.Read(path, &bans); err != nil {
+		return nil, errors.Wrap(err, "failed to load bans")
+	}
+	return bans, nil
+}
+
+// SaveBans writes the ban table to path, replacing it atomically
+func SaveBans(path string, bans []Ban) error {
+	return errors.Wrap(statefile.Write(path, bans), "failed to save bans")
+}
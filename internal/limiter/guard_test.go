@@ -0,0 +1,287 @@
+package limiter
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeClock makes the limiter read *now as the current time
+func fakeClock(t *testing.T, now *time.Time) {
+	t.Helper()
+	clock = func() time.Time { return *now }
+	t.Cleanup(func() { clock = time.Now })
+}
+
+// reason returns the reason of a refusal, or "" when err is nil
+func reason(t *testing.T, err error) string {
+	t.Helper()
+	if err == nil {
+		return ""
+	}
+	limitErr, ok := err.(*LimitError)
+	if !ok {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return limitErr.Reason
+}
+
+func TestGuardConnect(t *testing.T) {
+	type attempt struct {
+		after  time.Duration // since the previous attempt
+		reason string        // refusal expected, "" when admitted
+		ban    bool          // the attempt causes a ban
+	}
+
+	tests := []struct {
+		name     string
+		cfg      GuardConfig
+		attempts []attempt
+	}{
+		{
+			name:     "disabled",
+			cfg:      GuardConfig{Window: time.Second},
+			attempts: []attempt{{}, {}, {}, {}, {}, {}},
+		},
+		{
+			name: "rate limit",
+			cfg:  GuardConfig{Window: 10 * time.Second, MaxConnections: 3},
+			attempts: []attempt{
+				{}, {}, {},
+				{reason: ReasonRateLimit},
+				{after: 5 * time.Second, reason: ReasonRateLimit},
+				// The first four left the window, the refusal at 5s is still in it
+				{after: 5*time.Second + time.Millisecond},
+				{},
+				{reason: ReasonRateLimit},
+			},
+		},
+		{
+			name: "sliding window",
+			cfg:  GuardConfig{Window: 10 * time.Second, MaxConnections: 2},
+			attempts: []attempt{
+				{},
+				{after: 6 * time.Second},
+				{after: 3 * time.Second, reason: ReasonRateLimit},
+				// Only the first attempt left the window, refusals count as well
+				{after: 2 * time.Second, reason: ReasonRateLimit},
+				{after: 5 * time.Second, reason: ReasonRateLimit},
+				// Only the refusal at 16s is left in the window
+				{after: 8 * time.Second},
+			},
+		},
+		{
+			name: "ban after connections",
+			cfg:  GuardConfig{Window: 10 * time.Second, MaxConnections: 2, BanAfterConnections: 4, BanDuration: time.Minute},
+			attempts: []attempt{
+				{}, {},
+				{reason: ReasonRateLimit},
+				{reason: ReasonBanned, ban: true},
+				{after: 30 * time.Second, reason: ReasonBanned},
+				// The ban expires, the window starts over
+				{after: 30 * time.Second},
+				{}, {reason: ReasonRateLimit},
+			},
+		},
+		{
+			name: "ban without rate limit",
+			cfg:  GuardConfig{Window: 10 * time.Second, BanAfterConnections: 3, BanDuration: time.Minute},
+			attempts: []attempt{
+				{}, {},
+				{after: 11 * time.Second},
+				{}, {reason: ReasonBanned, ban: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+			fakeClock(t, &now)
+
+			g := NewGuard(tt.cfg)
+			for i, a := range tt.attempts {
+				now = now.Add(a.after)
+				ban, err := g.Connect("192.0.2.1")
+				if got := reason(t, err); got != a.reason {
+					t.Errorf("attempt %d: refused with %q, want %q", i, got, a.reason)
+				}
+				if (ban != nil) != a.ban {
+					t.Errorf("attempt %d: ban %+v, want ban %v", i, ban, a.ban)
+				}
+				if ban != nil {
+					want := Ban{IP: "192.0.2.1", Reason: BanRapidConnects, Until: now.Add(tt.cfg.BanDuration)}
+					if *ban != want {
+						t.Errorf("attempt %d: ban %+v, want %+v", i, *ban, want)
+					}
+				}
+			}
+
+			// Other IPs are counted on their own
+			if _, err := g.Connect("192.0.2.2"); err != nil {
+				t.Errorf("other IP refused: %v", err)
+			}
+		})
+	}
+}
+
+func TestGuardFailure(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fakeClock(t, &now)
+
+	g := NewGuard(GuardConfig{Window: 10 * time.Second, BanAfterFailures: 3, BanDuration: time.Minute})
+
+	// Failures spread wider than the window never add up to a ban
+	for i := 0; i < 5; i++ {
+		if ban := g.Failure("192.0.2.1"); ban != nil {
+			t.Fatalf("failure %d banned: %+v", i, ban)
+		}
+		now = now.Add(6 * time.Second)
+	}
+
+	now = now.Add(10 * time.Second)
+	g.Failure("192.0.2.1")
+	now = now.Add(time.Second)
+	g.Failure("192.0.2.1")
+	ban := g.Failure("192.0.2.1")
+	want := Ban{IP: "192.0.2.1", Reason: BanFailedHandshakes, Until: now.Add(time.Minute)}
+	if ban == nil || *ban != want {
+		t.Fatalf("ban %+v, want %+v", ban, want)
+	}
+	if _, err := g.Connect("192.0.2.1"); reason(t, err) != ReasonBanned {
+		t.Errorf("banned IP connected: %v", err)
+	}
+	// Failures of a banned IP do not renew its ban
+	if ban := g.Failure("192.0.2.1"); ban != nil {
+		t.Errorf("banned again: %+v", ban)
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := g.Connect("192.0.2.1"); err != nil {
+		t.Errorf("refused after the ban expired: %v", err)
+	}
+
+	g.SetConfig(GuardConfig{Window: 10 * time.Second})
+	for i := 0; i < 5; i++ {
+		if ban := g.Failure("192.0.2.3"); ban != nil {
+			t.Fatalf("banned with failure bans disabled: %+v", ban)
+		}
+	}
+}
+
+func TestGuardExpire(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fakeClock(t, &now)
+
+	g := NewGuard(GuardConfig{Window: 10 * time.Second, BanAfterFailures: 1, BanDuration: time.Minute})
+	g.Failure("192.0.2.1")
+	now = now.Add(30 * time.Second)
+	g.Failure("192.0.2.2")
+
+	if active := g.Expire(); active != 2 {
+		t.Errorf("%d active bans, want 2", active)
+	}
+	now = now.Add(30 * time.Second)
+	if active := g.Expire(); active != 1 {
+		t.Errorf("%d active bans, want 1", active)
+	}
+	if bans := g.Bans(); len(bans) != 1 || bans[0].IP != "192.0.2.2" {
+		t.Errorf("bans %+v, want 192.0.2.2", bans)
+	}
+	now = now.Add(30 * time.Second)
+	if active := g.Expire(); active != 0 {
+		t.Errorf("%d active bans, want 0", active)
+	}
+}
+
+func TestGuardChanged(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fakeClock(t, &now)
+
+	g := NewGuard(GuardConfig{Window: 10 * time.Second, MaxConnections: 1, BanAfterFailures: 1, BanDuration: time.Minute})
+	if _, changed := g.Changed(); changed {
+		t.Error("empty table changed")
+	}
+
+	// Rate limiting alone does not touch the ban table
+	g.Connect("192.0.2.1")
+	g.Connect("192.0.2.1")
+	if _, changed := g.Changed(); changed {
+		t.Error("changed without a ban")
+	}
+
+	g.Failure("192.0.2.9")
+	g.Failure("192.0.2.1")
+	bans, changed := g.Changed()
+	if !changed || len(bans) != 2 || bans[0].IP != "192.0.2.1" || bans[1].IP != "192.0.2.9" {
+		t.Errorf("Changed = %+v, %v, want both bans ordered by IP", bans, changed)
+	}
+	if _, changed := g.Changed(); changed {
+		t.Error("changed twice for one update")
+	}
+
+	now = now.Add(time.Minute)
+	g.Expire()
+	if bans, changed := g.Changed(); !changed || len(bans) != 0 {
+		t.Errorf("Changed = %+v, %v after expiry, want an empty table", bans, changed)
+	}
+}
+
+func TestGuardRestore(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fakeClock(t, &now)
+
+	g := NewGuard(GuardConfig{})
+	g.Restore([]Ban{
+		{IP: "192.0.2.1", Reason: BanRapidConnects, Until: now.Add(time.Minute)},
+		{IP: "192.0.2.2", Reason: BanFailedHandshakes, Until: now.Add(-time.Second)},
+		{IP: "2001:db8::1", Reason: BanFailedHandshakes, Until: now.Add(time.Hour)},
+	})
+
+	if bans := g.Bans(); len(bans) != 2 || bans[0].IP != "192.0.2.1" || bans[1].IP != "2001:db8::1" {
+		t.Errorf("restored %+v, want the unexpired bans", bans)
+	}
+	if _, err := g.Connect("2001:db8::1"); reason(t, err) != ReasonBanned {
+		t.Errorf("restored ban not enforced: %v", err)
+	}
+	if _, err := g.Connect("192.0.2.2"); err != nil {
+		t.Errorf("expired ban enforced: %v", err)
+	}
+	// Restoring is loading the saved state, not a change to save
+	if _, changed := g.Changed(); changed {
+		t.Error("restore changed the table")
+	}
+}
+
+func TestLoadSaveBans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+
+	bans, err := LoadBans(path)
+	if err != nil || len(bans) != 0 {
+		t.Errorf("missing file loaded as %v, %v, want an empty table", bans, err)
+	}
+
+	want := []Ban{
+		{IP: "192.0.2.1", Reason: BanRapidConnects, Until: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)},
+		{IP: "2001:db8::1", Reason: BanFailedHandshakes, Until: time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)},
+	}
+	if err := SaveBans(path, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadBans(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded %+v, want %+v", got, want)
+	}
+
+	if err := os.WriteFile(path, []byte(`[{"ip": `), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadBans(path); err == nil {
+		t.Error("loaded a corrupt ban file")
+	}
+}
@@ -0,0 +1,54 @@
+package limiter
+
+import "sync"
+
+// ReasonPerUserLimit is reported when an identity has too many sessions
+const ReasonPerUserLimit = "per_user_limit"
+
+// UserLimit caps the number of concurrent sessions per authenticated
+// identity. Unlike Admission it never queues: the identity is only known
+// once the client has authenticated, too late to hold it waiting.
+type UserLimit struct {
+	mu     sync.Mutex
+	max    int
+	active map[string]int
+}
+
+// NewUserLimit creates a per-identity limit. A max of zero disables it.
+func NewUserLimit(max int) *UserLimit {
+	return &UserLimit{
+		max:    max,
+		active: make(map[string]int),
+	}
+}
+
+// Acquire reserves a session slot for user. The returned function releases
+// it and is safe to call more than once.
+func (u *UserLimit) Acquire(user string) (func(), error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.max > 0 && u.active[user] >= u.max {
+		return nil, &LimitError{Reason: ReasonPerUserLimit}
+	}
+	u.active[user]++
+
+	var once sync.Once
+	return func() { once.Do(func() { u.release(user) }) }, nil
+}
+
+// SetLimit replaces the limit. Sessions already admitted are kept.
+func (u *UserLimit) SetLimit(max int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.max = max
+}
+
+func (u *UserLimit) release(user string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.active[user]--; u.active[user] <= 0 {
+		delete(u.active, user)
+	}
+}
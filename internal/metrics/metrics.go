@@ -1,13 +1,19 @@
 package metrics
 
 import (
+	"context"
 	"log/slog"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// shutdownTimeout bounds how long the metrics server waits for open scrapes
+const shutdownTimeout = 5 * time.Second
+
 var (
 	// Connection metrics
 	connectionsTotal = prometheus.NewCounterVec(
@@ -44,6 +50,91 @@ var (
 		[]string{"type"},
 	)
 
+	// Admission metrics
+	connectionsRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gowsoos_connections_rejected_total",
+			Help: "Total number of connections rejected by connection limits",
+		},
+		[]string{"reason"},
+	)
+
+	// Access control metrics
+	aclDenied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gowsoos_acl_denied_total",
+			Help: "Total number of connections denied by access control rules",
+		},
+		[]string{"rule", "mode"},
+	)
+
+	// Ban metrics
+	bansActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gowsoos_bans_active",
+			Help: "Number of source IPs currently banned",
+		},
+	)
+
+	bansTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gowsoos_bans_total",
+			Help: "Total number of source IPs banned",
+		},
+		[]string{"reason"},
+	)
+
+	// Accounting metrics
+	quotaExceeded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gowsoos_quota_exceeded_total",
+			Help: "Total number of tunnels that went over the traffic quota of their identity",
+		},
+		[]string{"action"},
+	)
+
+	// Bandwidth shaping metrics
+	throttledConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gowsoos_bandwidth_throttled_connections",
+			Help: "Number of connections currently held back by bandwidth limits",
+		},
+		[]string{"direction"},
+	)
+
+	throttleSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gowsoos_bandwidth_throttle_seconds_total",
+			Help: "Total time connections were held back by bandwidth limits",
+		},
+		[]string{"direction", "scope"},
+	)
+
+	// Timeout metrics
+	timeoutsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gowsoos_timeouts_total",
+			Help: "Total number of connections closed by a timeout",
+		},
+		[]string{"reason"},
+	)
+
+	// Reload metrics
+	configReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gowsoos_config_reloads_total",
+			Help: "Total number of configuration reloads",
+		},
+		[]string{"status"},
+	)
+
+	configLastReloadSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gowsoos_config_last_reload_success_timestamp_seconds",
+			Help: "Unix time of the last successful configuration reload",
+		},
+	)
+
 	// Error metrics
 	errorsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -56,15 +147,17 @@ var (
 
 // Metrics holds the metrics collector
 type Metrics struct {
-	enabled bool
-	logger  *slog.Logger
+	enabled  bool
+	logger   *slog.Logger
+	handlers map[string]http.Handler // served next to /metrics
 }
 
 // NewMetrics creates a new metrics collector
 func NewMetrics(enabled bool, logger *slog.Logger) *Metrics {
 	m := &Metrics{
-		enabled: enabled,
-		logger:  logger,
+		enabled:  enabled,
+		logger:   logger,
+		handlers: make(map[string]http.Handler),
 	}
 
 	if enabled {
@@ -74,6 +167,16 @@ func NewMetrics(enabled bool, logger *slog.Logger) *Metrics {
 		prometheus.MustRegister(bytesTransferred)
 		prometheus.MustRegister(connectionDuration)
 		prometheus.MustRegister(errorsTotal)
+		prometheus.MustRegister(connectionsRejected)
+		prometheus.MustRegister(aclDenied)
+		prometheus.MustRegister(throttledConnections)
+		prometheus.MustRegister(bansActive)
+		prometheus.MustRegister(bansTotal)
+		prometheus.MustRegister(quotaExceeded)
+		prometheus.MustRegister(throttleSeconds)
+		prometheus.MustRegister(timeoutsTotal)
+		prometheus.MustRegister(configReloads)
+		prometheus.MustRegister(configLastReloadSuccess)
 
 		logger.Info("Metrics enabled")
 	}
@@ -122,20 +225,120 @@ func (m *Metrics) RecordError(errorType, errorMsg string) {
 	errorsTotal.WithLabelValues(errorType, errorMsg).Inc()
 }
 
-// StartMetricsServer starts the Prometheus metrics server
-func (m *Metrics) StartMetricsServer(address string) error {
+// RecordRejection records a connection turned away by connection limits
+func (m *Metrics) RecordRejection(reason string) {
+	if !m.enabled {
+		return
+	}
+	connectionsRejected.WithLabelValues(reason).Inc()
+}
+
+// RecordACLDenied records a connection denied by an access control rule.
+// In dry-run mode the connection was let through and is counted separately.
+func (m *Metrics) RecordACLDenied(rule string, dryRun bool) {
+	if !m.enabled {
+		return
+	}
+	mode := "enforce"
+	if dryRun {
+		mode = "dry_run"
+	}
+	aclDenied.WithLabelValues(rule, mode).Inc()
+}
+
+// RecordBan records a source IP being banned
+func (m *Metrics) RecordBan(reason string) {
+	if !m.enabled {
+		return
+	}
+	bansTotal.WithLabelValues(reason).Inc()
+}
+
+// SetActiveBans records the number of bans in effect
+func (m *Metrics) SetActiveBans(count int) {
+	if !m.enabled {
+		return
+	}
+	bansActive.Set(float64(count))
+}
+
+// RecordQuotaExceeded records a tunnel going over its traffic quota
+func (m *Metrics) RecordQuotaExceeded(action string) {
+	if !m.enabled {
+		return
+	}
+	quotaExceeded.WithLabelValues(action).Inc()
+}
+
+// RecordThrottleStart records a connection starting to wait for bandwidth
+func (m *Metrics) RecordThrottleStart(direction string) {
+	if !m.enabled {
+		return
+	}
+	throttledConnections.WithLabelValues(direction).Inc()
+}
+
+// RecordThrottleEnd records the end of a bandwidth wait and the cap that caused it
+func (m *Metrics) RecordThrottleEnd(direction, scope string, seconds float64) {
+	if !m.enabled {
+		return
+	}
+	throttledConnections.WithLabelValues(direction).Dec()
+	throttleSeconds.WithLabelValues(direction, scope).Add(seconds)
+}
+
+// RecordTimeout records a connection closed by a timeout
+func (m *Metrics) RecordTimeout(reason string) {
+	if !m.enabled {
+		return
+	}
+	timeoutsTotal.WithLabelValues(reason).Inc()
+}
+
+// RecordReload records the outcome of a configuration reload
+func (m *Metrics) RecordReload(status string) {
+	if !m.enabled {
+		return
+	}
+	configReloads.WithLabelValues(status).Inc()
+	if status == "success" {
+		configLastReloadSuccess.SetToCurrentTime()
+	}
+}
+
+// Handle registers handler for pattern on the metrics server. It must be
+// called before StartMetricsServer.
+func (m *Metrics) Handle(pattern string, handler http.Handler) {
+	m.handlers[pattern] = handler
+}
+
+// StartMetricsServer serves Prometheus metrics, and the handlers registered
+// with Handle, on listener until ctx is done
+func (m *Metrics) StartMetricsServer(ctx context.Context, listener net.Listener) error {
 	if !m.enabled {
 		return nil
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
+	for pattern, handler := range m.handlers {
+		mux.Handle(pattern, handler)
+	}
 
 	server := &http.Server{
-		Addr:    address,
 		Handler: mux,
 	}
 
-	m.logger.Info("Starting metrics server", "address", address)
-	return server.ListenAndServe()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	m.logger.Info("Starting metrics server", "address", listener.Addr().String())
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
\ No newline at end of file
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gowsoos/internal/proxyproto"
+)
+
+const (
+	// spliceChunkSize is the most a single splice moves before byte counts are updated
+	spliceChunkSize = 1024 * 1024 // 1 MB
+
+	// spliceActivityInterval bounds how long a splice can run before the
+	// session's activity timestamp is refreshed
+	spliceActivityInterval = 5 * time.Second
+)
+
+// bufferPool recycles copy buffers of the configured buffer_size between sessions
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{
+		pool: sync.Pool{
+			New: func() interface{} {
+				b := make([]byte, size)
+				return &b
+			},
+		},
+	}
+}
+
+func (bp *bufferPool) get() *[]byte {
+	return bp.pool.Get().(*[]byte)
+}
+
+func (bp *bufferPool) put(b *[]byte) {
+	bp.pool.Put(b)
+}
+
+// writerOnly hides io.ReaderFrom so io.CopyBuffer uses the pooled buffer
+type writerOnly struct {
+	io.Writer
+}
+
+// copyStream copies src to dst until EOF, counting the bytes moved. Plain TCP
+// sockets are joined with splice(2) where available unless the tunnel is
+// shaped, everything else goes through a pooled buffer.
+func (bp *bufferPool) copyStream(dst, src ProxyConnection, counter *byteCounter) (int64, error) {
+	if !counter.shaped() {
+		if dstTCP, srcTCP, ok := splicePair(dst, src); ok {
+			return spliceStream(dstTCP, srcTCP, src, counter)
+		}
+	}
+
+	buf := bp.get()
+	defer bp.put(buf)
+	return io.CopyBuffer(writerOnly{dst}, counter, *buf)
+}
+
+// splicePair returns the TCP sockets behind dst and src when both are plain TCP
+func splicePair(dst, src ProxyConnection) (*net.TCPConn, *net.TCPConn, bool) {
+	if !spliceSupported {
+		return nil, nil, false
+	}
+
+	dstTCP, ok := tcpConn(dst)
+	if !ok {
+		return nil, nil, false
+	}
+	srcTCP, ok := tcpConn(src)
+	if !ok {
+		return nil, nil, false
+	}
+	return dstTCP, srcTCP, true
+}
+
+// tcpConn unwraps the read-ahead buffers of the request parser and the
+// connection peeks, whose pending bytes are flushed by spliceStream before the
+// kernel takes over, and PROXY protocol connections, whose header has been
+// consumed already
+func tcpConn(c ProxyConnection) (*net.TCPConn, bool) {
+	for c != nil {
+		if tc, ok := c.(*net.TCPConn); ok {
+			return tc, true
+		}
+		c, _ = unwrapConn(c)
+	}
+	return nil, false
+}
+
+// unwrapConn returns the connection c wraps, and the buffer of bytes c has
+// already read from it if any
+func unwrapConn(c ProxyConnection) (ProxyConnection, *bufio.Reader) {
+	switch rc := c.(type) {
+	case *bufferedConn:
+		return rc.ProxyConnection, rc.reader
+	case *PeekedConn:
+		return rc.Conn, rc.reader
+	case *proxyproto.Conn:
+		return rc.Conn, nil
+	}
+	return nil, nil
+}
+
+// spliceStream moves data between two TCP sockets inside the kernel. The copy
+// runs in chunks under a short read deadline so byte counts and session
+// activity stay current.
+func spliceStream(dst, src *net.TCPConn, orig ProxyConnection, counter *byteCounter) (int64, error) {
+	var total int64
+
+	// Flush read-ahead buffers from the outermost wrapper inwards, in stream order
+	for c, reader := unwrapConn(orig); c != nil; c, reader = unwrapConn(c) {
+		if reader == nil || reader.Buffered() == 0 {
+			continue
+		}
+		pending, _ := reader.Peek(reader.Buffered())
+		n, err := dst.Write(pending)
+		reader.Discard(n)
+		counter.record(n)
+		total += int64(n)
+		if err != nil {
+			return total, errors.Wrap(err, "failed to flush buffered payload")
+		}
+	}
+
+	chunk := int64(spliceChunkSize)
+	limited := &io.LimitedReader{R: src}
+	defer src.SetReadDeadline(time.Time{})
+
+	for {
+		if err := src.SetReadDeadline(time.Now().Add(spliceActivityInterval)); err != nil {
+			return total, err
+		}
+
+		limited.N = chunk
+		n, err := dst.ReadFrom(limited)
+		counter.record(int(n))
+		total += n
+
+		if err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			return total, err
+		}
+		if n < chunk {
+			// Source reached EOF
+			return total, nil
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+
+	"gowsoos/internal/config"
+	"gowsoos/internal/metrics"
+)
+
+const benchPayloadSize = 256 * 1024
+
+// memConn is an in-memory ProxyConnection serving a fixed payload
+type memConn struct {
+	net.Conn
+	remaining int
+}
+
+func (c *memConn) Read(p []byte) (int, error) {
+	if c.remaining == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > c.remaining {
+		p = p[:c.remaining]
+	}
+	c.remaining -= len(p)
+	return len(p), nil
+}
+
+func (c *memConn) Write(p []byte) (int, error) { return len(p), nil }
+func (c *memConn) Close() error                { return nil }
+
+func newBenchProxy() *Proxy {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return NewProxy(config.DefaultConfig(), logger, metrics.NewMetrics(false, logger))
+}
+
+// BenchmarkCopy compares the per-session cost of io.Copy with the pooled copy path
+func BenchmarkCopy(b *testing.B) {
+	p := newBenchProxy()
+
+	b.Run("io.Copy", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(benchPayloadSize)
+		for i := 0; i < b.N; i++ {
+			src := &memConn{remaining: benchPayloadSize}
+			counter := &byteCounter{conn: src, metrics: p.metrics, direction: "bench", activity: newActivity()}
+			if _, err := io.Copy(writerOnly{&memConn{}}, counter); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(benchPayloadSize)
+		for i := 0; i < b.N; i++ {
+			src := &memConn{remaining: benchPayloadSize}
+			counter := &byteCounter{conn: src, metrics: p.metrics, direction: "bench", activity: newActivity()}
+			if _, err := p.loadState().buffers.copyStream(&memConn{}, src, counter); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkTCPStream measures throughput between two loopback TCP sockets,
+// through the pooled buffer and through the splice fast path
+func BenchmarkTCPStream(b *testing.B) {
+	p := newBenchProxy()
+
+	b.Run("buffered", func(b *testing.B) {
+		benchmarkTCPStream(b, p, func(c *net.TCPConn) ProxyConnection { return struct{ ProxyConnection }{c} })
+	})
+
+	b.Run("splice", func(b *testing.B) {
+		if !spliceSupported {
+			b.Skip("splice is not supported on this platform")
+		}
+		benchmarkTCPStream(b, p, func(c *net.TCPConn) ProxyConnection { return c })
+	})
+}
+
+func benchmarkTCPStream(b *testing.B, p *Proxy, wrap func(*net.TCPConn) ProxyConnection) {
+	clientIn, proxyIn := tcpPipe(b)
+	proxyOut, backend := tcpPipe(b)
+	defer clientIn.Close()
+	defer backend.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		counter := &byteCounter{conn: proxyIn, metrics: p.metrics, direction: "bench", activity: newActivity()}
+		_, err := p.loadState().buffers.copyStream(wrap(proxyOut), wrap(proxyIn), counter)
+		proxyOut.CloseWrite()
+		done <- err
+	}()
+
+	go func() {
+		buf := make([]byte, benchPayloadSize)
+		for i := 0; i < b.N; i++ {
+			if _, err := clientIn.Write(buf); err != nil {
+				break
+			}
+		}
+		clientIn.CloseWrite()
+	}()
+
+	b.ReportAllocs()
+	b.SetBytes(benchPayloadSize)
+	b.ResetTimer()
+
+	n, err := io.Copy(io.Discard, backend)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+	if n != int64(b.N)*benchPayloadSize {
+		b.Fatalf("copied %d bytes, want %d", n, int64(b.N)*benchPayloadSize)
+	}
+}
+
+// tcpPipe returns both ends of a loopback TCP connection
+func tcpPipe(b testing.TB) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	accepted, err := ln.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
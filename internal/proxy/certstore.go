@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"gowsoos/internal/config"
+)
+
+// CertStore holds the certificates served on the TLS listener and picks one
+// per connection from the ClientHello server name, along with the client
+// certificate policy. It can be reloaded while connections are being accepted.
+type CertStore struct {
+	certs atomic.Value // *certSet
+}
+
+// certSet is an immutable snapshot of loaded certificates
+type certSet struct {
+	byName   map[string][]*tls.Certificate
+	fallback *tls.Certificate
+	count    int
+	config   *tls.Config // listener configuration including client authentication
+}
+
+// NewCertStore loads every certificate referenced by the configuration
+func NewCertStore(cfg *config.Config) (*CertStore, error) {
+	s := &CertStore{}
+	if err := s.Reload(cfg); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload loads the configured certificates and swaps them in atomically.
+// On error the previously loaded certificates stay in use.
+func (s *CertStore) Reload(cfg *config.Config) error {
+	apply, err := s.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare loads the configured certificates and returns a function swapping
+// them in, so they can be applied together with other components
+func (s *CertStore) Prepare(cfg *config.Config) (func(), error) {
+	pairs, err := certificatePairs(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, errors.New("no TLS certificates configured")
+	}
+
+	clientAuth, err := loadClientAuth(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &certSet{
+		byName: make(map[string][]*tls.Certificate),
+		config: clientAuth.tlsConfig(s.GetCertificate),
+	}
+	for _, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair.Cert, pair.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load TLS certificate %s", pair.Cert)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return nil, errors.Wrapf(err, "failed to parse TLS certificate %s", pair.Cert)
+			}
+		}
+		set.add(&cert)
+	}
+
+	return func() { s.certs.Store(set) }, nil
+}
+
+// Count returns the number of loaded certificates
+func (s *CertStore) Count() int {
+	return s.certs.Load().(*certSet).count
+}
+
+// GetConfigForClient implements tls.Config.GetConfigForClient, applying the
+// client certificate policy loaded last
+func (s *CertStore) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return s.certs.Load().(*certSet).config, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. Exact names are
+// preferred over wildcards, unknown or missing server names get the default.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set := s.certs.Load().(*certSet)
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		if cert := set.lookup(hello, name); cert != nil {
+			return cert, nil
+		}
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if cert := set.lookup(hello, "*"+name[i:]); cert != nil {
+				return cert, nil
+			}
+		}
+	}
+
+	return set.fallback, nil
+}
+
+// add indexes a certificate under every DNS name it covers
+func (set *certSet) add(cert *tls.Certificate) {
+	names := cert.Leaf.DNSNames
+	if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+		names = []string{cert.Leaf.Subject.CommonName}
+	}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		set.byName[name] = append(set.byName[name], cert)
+	}
+
+	if set.fallback == nil {
+		set.fallback = cert
+	}
+	set.count++
+}
+
+// lookup returns the first certificate for name the client can use,
+// e.g. preferring ECDSA over RSA when both are loaded
+func (set *certSet) lookup(hello *tls.ClientHelloInfo, name string) *tls.Certificate {
+	certs := set.byName[name]
+	for _, cert := range certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert
+		}
+	}
+	if len(certs) > 0 {
+		return certs[0]
+	}
+	return nil
+}
+
+// certificatePairs lists the certificate and key files to load, starting
+// with the default tls_private_key/tls_public_key pair
+func certificatePairs(cfg *config.Config) ([]config.CertificateConfig, error) {
+	var pairs []config.CertificateConfig
+
+	extra := len(cfg.TLSCertificates) > 0 || cfg.TLSCertDir != ""
+	if cfg.TLSPrivateKey != "" && cfg.TLSPublicKey != "" {
+		// The default pair is optional once other certificates are configured
+		if !extra || (fileExists(cfg.TLSPrivateKey) && fileExists(cfg.TLSPublicKey)) {
+			// tls_private_key holds the certificate chain, tls_public_key the key
+			pairs = append(pairs, config.CertificateConfig{Cert: cfg.TLSPrivateKey, Key: cfg.TLSPublicKey})
+		}
+	}
+
+	pairs = append(pairs, cfg.TLSCertificates...)
+
+	if cfg.TLSCertDir != "" {
+		dirPairs, err := scanCertDir(cfg.TLSCertDir)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, dirPairs...)
+	}
+
+	return pairs, nil
+}
+
+// scanCertDir finds certificate pairs in dir: "name.crt" or "name.pem" next to
+// "name.key", and subdirectories holding certbot style fullchain.pem/privkey.pem
+func scanCertDir(dir string) ([]config.CertificateConfig, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read tls_cert_dir")
+	}
+
+	var pairs []config.CertificateConfig
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+
+		if entry.IsDir() {
+			cert, key := filepath.Join(path, "fullchain.pem"), filepath.Join(path, "privkey.pem")
+			if fileExists(cert) && fileExists(key) {
+				pairs = append(pairs, config.CertificateConfig{Cert: cert, Key: key})
+			}
+			continue
+		}
+
+		ext := filepath.Ext(entry.Name())
+		if ext != ".crt" && ext != ".pem" {
+			continue
+		}
+		key := strings.TrimSuffix(path, ext) + ".key"
+		if fileExists(key) {
+			pairs = append(pairs, config.CertificateConfig{Cert: path, Key: key})
+		}
+	}
+
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Cert < pairs[j].Cert })
+	return pairs, nil
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gowsoos/internal/config"
+)
+
+// testCert is a generated certificate along with its key
+type testCert struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+var lastSerial int64
+
+// newCert generates a certificate from template, signed by issuer or
+// self-signed when issuer is nil
+func newCert(t *testing.T, template *x509.Certificate, issuer *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastSerial++
+	template.SerialNumber = big.NewInt(lastSerial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parent, signer := template, crypto.Signer(key)
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+// serverCert generates a self-signed certificate for the DNS names
+func serverCert(t *testing.T, commonName string, dnsNames ...string) *testCert {
+	t.Helper()
+	return newCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: commonName}, DNSNames: dnsNames}, nil)
+}
+
+// write stores the certificate and key as PEM files
+func (c *testCert) write(t *testing.T, certPath, keyPath string) config.CertificateConfig {
+	t.Helper()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{certPath, keyPath} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return config.CertificateConfig{Cert: certPath, Key: keyPath}
+}
+
+// certConfig returns a TLS configuration with the default certificate in
+// tls_private_key/tls_public_key and the others in tls_certificates
+func certConfig(t *testing.T, def *testCert, others ...*testCert) *config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := config.DefaultConfig()
+	cfg.TLSEnabled = true
+
+	// tls_private_key holds the certificate, tls_public_key the key
+	pair := def.write(t, filepath.Join(dir, "default.crt"), filepath.Join(dir, "default.key"))
+	cfg.TLSPrivateKey, cfg.TLSPublicKey = pair.Cert, pair.Key
+
+	for i, c := range others {
+		name := filepath.Join(dir, string(rune('a'+i)))
+		cfg.TLSCertificates = append(cfg.TLSCertificates, c.write(t, name+".crt", name+".key"))
+	}
+	return cfg
+}
+
+func TestGetCertificate(t *testing.T) {
+	def := serverCert(t, "default.example.org", "default.example.org")
+	exact := serverCert(t, "www.example.com", "www.example.com")
+	wildcard := serverCert(t, "*.example.com", "*.example.com", "example.com")
+	commonName := serverCert(t, "legacy.example.net")
+
+	store, err := NewCertStore(certConfig(t, def, exact, wildcard, commonName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := store.Count(); n != 4 {
+		t.Errorf("loaded %d certificates, want 4", n)
+	}
+
+	tests := []struct {
+		serverName string
+		want       *testCert
+	}{
+		{"www.example.com", exact},
+		{"WWW.Example.COM", exact},
+		{"www.example.com.", exact},
+		{"api.example.com", wildcard},
+		{"example.com", wildcard},
+		{"a.b.example.com", def},
+		{"legacy.example.net", commonName},
+		{"default.example.org", def},
+		{"unknown.example.org", def},
+		{"", def},
+	}
+
+	for _, tt := range tests {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cert.Leaf.Equal(tt.want.cert) {
+			t.Errorf("%q got %s, want %s", tt.serverName, cert.Leaf.Subject.CommonName, tt.want.cert.Subject.CommonName)
+		}
+	}
+}
+
+func TestCertStoreHandshake(t *testing.T) {
+	def := serverCert(t, "default.example.org", "default.example.org")
+	exact := serverCert(t, "www.example.com", "www.example.com")
+	store, err := NewCertStore(certConfig(t, def, exact))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for serverName, want := range map[string]*testCert{"www.example.com": exact, "other.example.com": def} {
+		server, client := net.Pipe()
+		go tls.Server(server, TLSConfig(store)).Handshake()
+
+		conn := tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err := conn.Handshake(); err != nil {
+			t.Fatalf("%s: %v", serverName, err)
+		}
+		if got := conn.ConnectionState().PeerCertificates[0]; !got.Equal(want.cert) {
+			t.Errorf("%s was served %s, want %s", serverName, got.Subject.CommonName, want.cert.Subject.CommonName)
+		}
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestScanCertDir(t *testing.T) {
+	dir := t.TempDir()
+	c := serverCert(t, "example.com", "example.com")
+
+	c.write(t, filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key"))
+	c.write(t, filepath.Join(dir, "b.pem"), filepath.Join(dir, "b.key"))
+	c.write(t, filepath.Join(dir, "example.org", "fullchain.pem"), filepath.Join(dir, "example.org", "privkey.pem"))
+
+	// Neither of these is a usable pair
+	c.write(t, filepath.Join(dir, "orphan.crt"), filepath.Join(dir, "orphan", "orphan.key"))
+	c.write(t, filepath.Join(dir, "partial", "cert.pem"), filepath.Join(dir, "partial", "privkey.pem"))
+	if err := os.WriteFile(filepath.Join(dir, "README.txt"), []byte("certificates"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	pairs, err := scanCertDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []config.CertificateConfig{
+		{Cert: filepath.Join(dir, "a.crt"), Key: filepath.Join(dir, "a.key")},
+		{Cert: filepath.Join(dir, "b.pem"), Key: filepath.Join(dir, "b.key")},
+		{Cert: filepath.Join(dir, "example.org", "fullchain.pem"), Key: filepath.Join(dir, "example.org", "privkey.pem")},
+	}
+	if len(pairs) != len(want) {
+		t.Fatalf("found %v, want %v", pairs, want)
+	}
+	for i := range want {
+		if pairs[i] != want[i] {
+			t.Errorf("pair %d is %v, want %v", i, pairs[i], want[i])
+		}
+	}
+
+	if _, err := scanCertDir(filepath.Join(dir, "missing")); err == nil {
+		t.Error("scanning a missing directory succeeded")
+	}
+}
+
+func TestCertDir(t *testing.T) {
+	dir := t.TempDir()
+	flat := serverCert(t, "flat.example.com", "flat.example.com")
+	certbot := serverCert(t, "certbot.example.com", "certbot.example.com")
+	flat.write(t, filepath.Join(dir, "flat.crt"), filepath.Join(dir, "flat.key"))
+	certbot.write(t, filepath.Join(dir, "certbot.example.com", "fullchain.pem"), filepath.Join(dir, "certbot.example.com", "privkey.pem"))
+
+	// The default pair is optional with a certificate directory
+	cfg := config.DefaultConfig()
+	cfg.TLSEnabled = true
+	cfg.TLSPrivateKey = filepath.Join(dir, "missing.pem")
+	cfg.TLSPublicKey = filepath.Join(dir, "missing.key")
+	cfg.TLSCertDir = dir
+
+	store, err := NewCertStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := store.Count(); n != 2 {
+		t.Errorf("loaded %d certificates, want 2", n)
+	}
+	for name, want := range map[string]*testCert{"flat.example.com": flat, "certbot.example.com": certbot} {
+		cert, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if !cert.Leaf.Equal(want.cert) {
+			t.Errorf("%s got %s", name, cert.Leaf.Subject.CommonName)
+		}
+	}
+}
+
+func TestCertStoreErrors(t *testing.T) {
+	c := serverCert(t, "example.com", "example.com")
+	other := serverCert(t, "other.example.com", "other.example.com")
+
+	tests := []struct {
+		name   string
+		config func(t *testing.T) *config.Config
+	}{
+		{name: "no certificates", config: func(t *testing.T) *config.Config {
+			cfg := config.DefaultConfig()
+			cfg.TLSPrivateKey, cfg.TLSPublicKey = "", ""
+			return cfg
+		}},
+		{name: "missing default pair", config: func(t *testing.T) *config.Config {
+			cfg := config.DefaultConfig()
+			cfg.TLSPrivateKey = filepath.Join(t.TempDir(), "missing.pem")
+			return cfg
+		}},
+		{name: "mismatched key", config: func(t *testing.T) *config.Config {
+			cfg := certConfig(t, c)
+			cfg.TLSPublicKey = certConfig(t, other).TLSPublicKey
+			return cfg
+		}},
+		{name: "missing certificate directory", config: func(t *testing.T) *config.Config {
+			cfg := certConfig(t, c)
+			cfg.TLSCertDir = filepath.Join(t.TempDir(), "missing")
+			return cfg
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewCertStore(tt.config(t)); err == nil {
+				t.Error("loading succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	first := serverCert(t, "first.example.com", "first.example.com")
+	second := serverCert(t, "second.example.com", "second.example.com")
+	cfg := certConfig(t, first)
+	store, err := NewCertStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := func() *x509.Certificate {
+		cert, _ := store.GetCertificate(&tls.ClientHelloInfo{})
+		return cert.Leaf
+	}
+
+	// Prepare loads without applying anything
+	apply, err := store.Prepare(certConfig(t, second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !current().Equal(first.cert) {
+		t.Error("prepared certificates served before being applied")
+	}
+	apply()
+	if !current().Equal(second.cert) {
+		t.Error("applied certificates not served")
+	}
+
+	broken := certConfig(t, first)
+	broken.TLSPublicKey = filepath.Join(t.TempDir(), "missing.key")
+	if err := store.Reload(broken); err == nil {
+		t.Fatal("reload with a missing key succeeded")
+	}
+	if !current().Equal(second.cert) || store.Count() != 1 {
+		t.Error("failed reload replaced the certificates")
+	}
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/pkg/errors"
+	"gowsoos/internal/config"
+)
+
+// clientAuth is the client certificate policy of the TLS listener
+type clientAuth struct {
+	mode    tls.ClientAuthType
+	pool    *x509.CertPool
+	revoked map[string]bool // keyed by revocationKey
+}
+
+// loadClientAuth reads the client CA bundle and CRL of the configuration.
+// Any client certificate presented is verified, "request" only makes it
+// optional.
+func loadClientAuth(cfg *config.Config) (*clientAuth, error) {
+	ca := &clientAuth{mode: tls.NoClientCert}
+	switch cfg.TLSClientAuth {
+	case "request":
+		ca.mode = tls.VerifyClientCertIfGiven
+	case "require":
+		ca.mode = tls.RequireAndVerifyClientCert
+	default:
+		return ca, nil
+	}
+
+	data, err := os.ReadFile(cfg.TLSClientCA)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read tls_client_ca")
+	}
+	issuers, err := parseCertificates(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse tls_client_ca")
+	}
+	if len(issuers) == 0 {
+		return nil, errors.New("tls_client_ca contains no certificates")
+	}
+
+	ca.pool = x509.NewCertPool()
+	for _, issuer := range issuers {
+		ca.pool.AddCert(issuer)
+	}
+
+	if cfg.TLSClientCRL != "" {
+		if ca.revoked, err = loadCRL(cfg.TLSClientCRL, issuers); err != nil {
+			return nil, err
+		}
+	}
+	return ca, nil
+}
+
+// parseCertificates returns every certificate of a PEM bundle
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// loadCRL reads PEM or DER revocation lists. Each list must be signed by one
+// of the client CAs, so a stale or foreign file is noticed on load.
+func loadCRL(path string, issuers []*x509.Certificate) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read tls_client_crl")
+	}
+
+	var lists [][]byte
+	for rest := data; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			lists = append(lists, block.Bytes)
+		}
+	}
+	if len(lists) == 0 {
+		lists = [][]byte{data}
+	}
+
+	revoked := make(map[string]bool)
+	for _, der := range lists {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse tls_client_crl")
+		}
+		if !signedByAny(crl, issuers) {
+			return nil, errors.New("tls_client_crl is not signed by a tls_client_ca certificate")
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			revoked[revocationKey(crl.RawIssuer, entry.SerialNumber)] = true
+		}
+	}
+	return revoked, nil
+}
+
+func signedByAny(crl *x509.RevocationList, issuers []*x509.Certificate) bool {
+	for _, issuer := range issuers {
+		if bytes.Equal(issuer.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(issuer) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// revocationKey identifies a certificate by issuer and serial number
+func revocationKey(rawIssuer []byte, serial *big.Int) string {
+	return string(rawIssuer) + "/" + serial.String()
+}
+
+// tlsConfig returns the listener configuration enforcing the policy
+func (ca *clientAuth) tlsConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	cfg := &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     tls.VersionTLS12, // Enforce modern TLS
+		ClientAuth:     ca.mode,
+		ClientCAs:      ca.pool,
+	}
+	if len(ca.revoked) > 0 {
+		cfg.VerifyPeerCertificate = ca.verifyNotRevoked
+	}
+	return cfg
+}
+
+// verifyNotRevoked implements tls.Config.VerifyPeerCertificate, rejecting
+// client certificates whose chain contains a revoked certificate
+func (ca *clientAuth) verifyNotRevoked(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if ca.revoked[revocationKey(cert.RawIssuer, cert.SerialNumber)] {
+				// Surfaced through the TLS handshake error, keep it free of a stack trace
+				return fmt.Errorf("client certificate %q (serial %s) is revoked", cert.Subject.String(), cert.SerialNumber)
+			}
+		}
+	}
+	return nil
+}
+
+// ClientIdentity maps a verified client certificate to the identity used in
+// logs and per-user limits. field is one of cn, subject, san_dns, san_email
+// or san_uri; certificates lacking that field are identified by subject.
+func ClientIdentity(cert *x509.Certificate, field string) string {
+	var identity string
+	switch field {
+	case "cn":
+		identity = cert.Subject.CommonName
+	case "san_dns":
+		if len(cert.DNSNames) > 0 {
+			identity = cert.DNSNames[0]
+		}
+	case "san_email":
+		if len(cert.EmailAddresses) > 0 {
+			identity = cert.EmailAddresses[0]
+		}
+	case "san_uri":
+		if len(cert.URIs) > 0 {
+			identity = cert.URIs[0].String()
+		}
+	}
+	if identity == "" {
+		identity = cert.Subject.String()
+	}
+	return identity
+}
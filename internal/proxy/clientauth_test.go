@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gowsoos/internal/config"
+)
+
+// newCA generates a self-signed certificate authority
+func newCA(t *testing.T, name string) *testCert {
+	t.Helper()
+	return newCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil)
+}
+
+// clientCert generates a client certificate for name signed by ca
+func clientCert(t *testing.T, ca *testCert, name string) *testCert {
+	t.Helper()
+	return newCert(t, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: name, Organization: []string{"Example"}},
+		DNSNames:       []string{name + ".example.com"},
+		EmailAddresses: []string{name + "@example.com"},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/" + name}},
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+}
+
+// writeCRL writes a revocation list signed by ca, as PEM or DER
+func writeCRL(t *testing.T, path string, ca *testCert, asPEM bool, revoked ...*testCert) {
+	t.Helper()
+	var entries []x509.RevocationListEntry
+	for _, c := range revoked {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: c.cert.SerialNumber, RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now().Add(-time.Hour),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: entries,
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if asPEM {
+		der = pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+	}
+	if err := os.WriteFile(path, der, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeBundle writes certificates as one PEM file
+func writeBundle(t *testing.T, path string, certs ...*testCert) {
+	t.Helper()
+	var data []byte
+	for _, c := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})...)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// clientHandshake connects a client presenting cert, or no certificate when
+// nil, to a TLS listener using store and returns the server side error. The
+// connection goes over TCP so a rejection alert cannot block on the client's
+// last handshake flight.
+func clientHandshake(t *testing.T, store *CertStore, cert *testCert) error {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The certificate is sent even if the server asks for another CA
+	clientConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return &tls.Certificate{Certificate: [][]byte{cert.cert.Raw}, PrivateKey: cert.key}, nil
+		},
+	}
+	go func() {
+		conn, err := tls.Dial("tcp", l.Addr().String(), clientConfig)
+		if err != nil {
+			return
+		}
+		// TLS 1.3 clients learn about a rejected certificate on their first read
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}()
+
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn := tls.Server(server, TLSConfig(store))
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn.Handshake()
+}
+
+func TestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, "Client CA")
+	alice := clientCert(t, ca, "alice")
+	mallory := clientCert(t, ca, "mallory")
+	stranger := clientCert(t, newCA(t, "Other CA"), "stranger")
+
+	caFile, crlFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "crl.pem")
+	writeBundle(t, caFile, ca)
+	writeCRL(t, crlFile, ca, true, mallory)
+
+	tests := []struct {
+		name   string
+		mode   string
+		crl    string
+		client *testCert
+		ok     bool
+	}{
+		{name: "off without certificate", mode: "", ok: true},
+		{name: "off ignores certificates", mode: "", client: stranger, ok: true},
+		{name: "request without certificate", mode: "request", ok: true},
+		{name: "request with certificate", mode: "request", client: alice, ok: true},
+		{name: "request verifies given certificates", mode: "request", client: stranger},
+		{name: "require without certificate", mode: "require"},
+		{name: "require with certificate", mode: "require", client: alice, ok: true},
+		{name: "require with foreign certificate", mode: "require", client: stranger},
+		{name: "revoked", mode: "require", crl: crlFile, client: mallory},
+		{name: "revoked on request", mode: "request", crl: crlFile, client: mallory},
+		{name: "not revoked", mode: "require", crl: crlFile, client: alice, ok: true},
+		{name: "revocation ignored without crl", mode: "require", client: mallory, ok: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := certConfig(t, serverCert(t, "example.com", "example.com"))
+			cfg.TLSClientAuth = tt.mode
+			cfg.TLSClientCA = caFile
+			cfg.TLSClientCRL = tt.crl
+			store, err := NewCertStore(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = clientHandshake(t, store, tt.client)
+			if (err == nil) != tt.ok {
+				t.Errorf("handshake error %v, want ok %v", err, tt.ok)
+			}
+			if err != nil && tt.client == mallory && !strings.Contains(err.Error(), "is revoked") {
+				t.Errorf("handshake error %v, want the revocation", err)
+			}
+		})
+	}
+}
+
+func TestLoadClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, "Client CA")
+	other := newCA(t, "Other CA")
+	revoked := clientCert(t, ca, "mallory")
+
+	caFile, bundleFile, emptyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "bundle.pem"), filepath.Join(dir, "empty.pem")
+	writeBundle(t, caFile, ca)
+	writeBundle(t, bundleFile, other, ca)
+	if err := os.WriteFile(emptyFile, []byte("no certificates here\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pemCRL, derCRL, foreignCRL := filepath.Join(dir, "crl.pem"), filepath.Join(dir, "crl.der"), filepath.Join(dir, "foreign.pem")
+	writeCRL(t, pemCRL, ca, true, revoked)
+	writeCRL(t, derCRL, ca, false, revoked)
+	writeCRL(t, foreignCRL, other, true, revoked)
+
+	tests := []struct {
+		name    string
+		ca      string
+		crl     string
+		revoked bool
+		fails   bool
+	}{
+		{name: "ca only", ca: caFile},
+		{name: "pem crl", ca: caFile, crl: pemCRL, revoked: true},
+		{name: "der crl", ca: caFile, crl: derCRL, revoked: true},
+		{name: "crl of a bundled ca", ca: bundleFile, crl: pemCRL, revoked: true},
+		{name: "crl of another ca", ca: caFile, crl: foreignCRL, fails: true},
+		{name: "missing crl", ca: caFile, crl: filepath.Join(dir, "missing.pem"), fails: true},
+		{name: "invalid crl", ca: caFile, crl: caFile, fails: true},
+		{name: "missing ca", ca: filepath.Join(dir, "missing.pem"), fails: true},
+		{name: "ca without certificates", ca: emptyFile, fails: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.DefaultConfig()
+			cfg.TLSClientAuth = "require"
+			cfg.TLSClientCA = tt.ca
+			cfg.TLSClientCRL = tt.crl
+
+			auth, err := loadClientAuth(cfg)
+			if tt.fails {
+				if err == nil {
+					t.Fatal("loaded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if auth.mode != tls.RequireAndVerifyClientCert {
+				t.Errorf("mode %v, want RequireAndVerifyClientCert", auth.mode)
+			}
+			if got := auth.revoked[revocationKey(revoked.cert.RawIssuer, revoked.cert.SerialNumber)]; got != tt.revoked {
+				t.Errorf("revoked %v, want %v", got, tt.revoked)
+			}
+		})
+	}
+}
+
+func TestClientIdentity(t *testing.T) {
+	ca := newCA(t, "Client CA")
+	alice := clientCert(t, ca, "alice").cert
+	bare := newCert(t, &x509.Certificate{Subject: pkix.Name{Organization: []string{"Example"}, CommonName: "bare"}}, ca).cert
+
+	tests := []struct {
+		field string
+		cert  *x509.Certificate
+		want  string
+	}{
+		{"cn", alice, "alice"},
+		{"subject", alice, "CN=alice,O=Example"},
+		{"san_dns", alice, "alice.example.com"},
+		{"san_email", alice, "alice@example.com"},
+		{"san_uri", alice, "spiffe://example.com/alice"},
+		{"san_dns", bare, "CN=bare,O=Example"},
+		{"san_email", bare, "CN=bare,O=Example"},
+		{"san_uri", bare, "CN=bare,O=Example"},
+	}
+
+	for _, tt := range tests {
+		if got := ClientIdentity(tt.cert, tt.field); got != tt.want {
+			t.Errorf("ClientIdentity(%s, %s) = %q, want %q", tt.cert.Subject.CommonName, tt.field, got, tt.want)
+		}
+	}
+}
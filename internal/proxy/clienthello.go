@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	tlsRecordHeaderLen     = 5
+	tlsMaxRecordLen        = 16384 + 2048 // largest TLSCiphertext fragment
+	tlsRecordTypeHandshake = 0x16
+)
+
+// errHelloPeeked aborts the handshake run only to parse a ClientHello
+var errHelloPeeked = errors.New("client hello peeked")
+
+// ClientHello is what a TLS client announced before the handshake
+type ClientHello struct {
+	ServerName string
+	Protocols  []string
+}
+
+// PeekedConn replays the bytes read ahead while peeking at a connection
+// before reading from the connection itself
+type PeekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// NewPeekedConn wraps conn so its first bytes can be inspected before use.
+// The buffer holds a full TLS record.
+func NewPeekedConn(conn net.Conn) *PeekedConn {
+	return &PeekedConn{Conn: conn, reader: bufio.NewReaderSize(conn, tlsRecordHeaderLen+tlsMaxRecordLen)}
+}
+
+// Peek returns the next n bytes without consuming them
+func (c *PeekedConn) Peek(n int) ([]byte, error) {
+	return c.reader.Peek(n)
+}
+
+func (c *PeekedConn) Read(p []byte) (int, error) {
+	if c.reader.Buffered() == 0 {
+		return c.Conn.Read(p)
+	}
+	return c.reader.Read(p)
+}
+
+// CloseWrite half-closes the underlying connection
+func (c *PeekedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// PeekClientHello reads the first TLS record of conn and parses the
+// ClientHello in it without consuming it: the returned connection replays
+// the record, so the handshake can still be completed or passed on. Records
+// that do not hold a complete ClientHello yield an empty one, the TLS
+// handshake reports the problem when it is terminated locally.
+func PeekClientHello(conn net.Conn, timeout time.Duration) (*ClientHello, *PeekedConn, error) {
+	pc, ok := conn.(*PeekedConn)
+	if !ok {
+		pc = NewPeekedConn(conn)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, pc, errors.Wrap(err, "failed to set peek deadline")
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	header, err := pc.reader.Peek(tlsRecordHeaderLen)
+	if err != nil {
+		return nil, pc, errors.Wrap(err, "failed to read TLS record header")
+	}
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if header[0] != tlsRecordTypeHandshake || length > tlsMaxRecordLen {
+		return &ClientHello{}, pc, nil
+	}
+
+	record, err := pc.reader.Peek(tlsRecordHeaderLen + length)
+	if err != nil {
+		return nil, pc, errors.Wrap(err, "failed to read ClientHello")
+	}
+	return parseClientHello(record), pc, nil
+}
+
+// parseClientHello lets crypto/tls parse the ClientHello in record and stops
+// the handshake as soon as it is known
+func parseClientHello(record []byte) *ClientHello {
+	hello := &ClientHello{}
+	cfg := &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello.ServerName = info.ServerName
+			hello.Protocols = append([]string(nil), info.SupportedProtos...)
+			return nil, errHelloPeeked
+		},
+	}
+	tls.Server(readOnlyConn{bytes.NewReader(record)}, cfg).Handshake()
+	return hello
+}
+
+// readOnlyConn feeds recorded bytes to a TLS handshake and drops its replies
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"gowsoos/internal/config"
+)
+
+// captureClientHello returns the first TLS record a crypto/tls client sends
+func captureClientHello(t *testing.T, cfg *tls.Config) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, cfg).Handshake()
+		client.Close()
+	}()
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, tlsRecordHeaderLen)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, tlsRecordHeaderLen+int(binary.BigEndian.Uint16(header[3:5])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[tlsRecordHeaderLen:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// tlsRecord frames payload as a TLS handshake record
+func tlsRecord(payload []byte) []byte {
+	record := []byte{tlsRecordTypeHandshake, 0x03, 0x01, 0, 0}
+	binary.BigEndian.PutUint16(record[3:5], uint16(len(payload)))
+	return append(record, payload...)
+}
+
+func TestParseClientHello(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *tls.Config
+		want ClientHello
+	}{
+		{name: "sni", cfg: &tls.Config{ServerName: "vpn.example.com"}, want: ClientHello{ServerName: "vpn.example.com"}},
+		{
+			name: "sni and alpn",
+			cfg:  &tls.Config{ServerName: "vpn.example.com", NextProtos: []string{"h2", "http/1.1"}},
+			want: ClientHello{ServerName: "vpn.example.com", Protocols: []string{"h2", "http/1.1"}},
+		},
+		{
+			name: "ip address",
+			cfg:  &tls.Config{ServerName: "192.0.2.1", NextProtos: []string{"ssh"}},
+			want: ClientHello{Protocols: []string{"ssh"}},
+		},
+		{
+			name: "tls 1.2 only",
+			cfg:  &tls.Config{ServerName: "vpn.example.com", MaxVersion: tls.VersionTLS12},
+			want: ClientHello{ServerName: "vpn.example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.InsecureSkipVerify = true
+			got := parseClientHello(captureClientHello(t, tt.cfg))
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeekClientHello(t *testing.T) {
+	hello := captureClientHello(t, &tls.Config{ServerName: "vpn.example.com", NextProtos: []string{"h2"}})
+	httpRequest := []byte("GET / HTTP/1.1\r\nHost: vpn.example.com\r\n\r\n")
+
+	// A ClientHello split over two records is valid TLS, but only the first
+	// record is peeked
+	body := hello[tlsRecordHeaderLen:]
+	split := append(tlsRecord(body[:40]), tlsRecord(body[40:])...)
+
+	oversized := []byte{tlsRecordTypeHandshake, 0x03, 0x01, 0, 0}
+	binary.BigEndian.PutUint16(oversized[3:5], tlsMaxRecordLen+1)
+
+	tests := []struct {
+		name   string
+		writes [][]byte // written one by one with a pause in between
+		close  bool     // the client closes after writing
+		want   *ClientHello
+		fails  bool
+	}{
+		{name: "client hello", writes: [][]byte{hello}, want: &ClientHello{ServerName: "vpn.example.com", Protocols: []string{"h2"}}},
+		{
+			name:   "fragmented reads",
+			writes: [][]byte{hello[:3], hello[3:20], hello[20:100], hello[100:]},
+			want:   &ClientHello{ServerName: "vpn.example.com", Protocols: []string{"h2"}},
+		},
+		{name: "split over records", writes: [][]byte{split}, want: &ClientHello{}},
+		{name: "plain http", writes: [][]byte{httpRequest}, want: &ClientHello{}},
+		{name: "ssh banner", writes: [][]byte{[]byte("SSH-2.0-OpenSSH_9.6\r\n")}, want: &ClientHello{}},
+		{name: "oversized record", writes: [][]byte{oversized}, want: &ClientHello{}},
+		{name: "garbage handshake", writes: [][]byte{tlsRecord([]byte("not a client hello"))}, want: &ClientHello{}},
+		{name: "truncated header", writes: [][]byte{hello[:3]}, close: true, fails: true},
+		{name: "truncated record", writes: [][]byte{hello[:len(hello)-10]}, close: true, fails: true},
+		{name: "stalled record", writes: [][]byte{hello[:len(hello)-10]}, fails: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func(writes [][]byte, close bool) {
+				for _, b := range writes {
+					client.Write(b)
+					time.Sleep(5 * time.Millisecond)
+				}
+				if close {
+					client.Close()
+				}
+			}(tt.writes, tt.close)
+			defer client.Close()
+
+			got, pc, err := PeekClientHello(server, 200*time.Millisecond)
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ServerName != tt.want.ServerName || !reflect.DeepEqual(got.Protocols, tt.want.Protocols) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+
+			// Nothing is consumed, the connection replays what was peeked
+			want := bytes.Join(tt.writes, nil)
+			replayed := make([]byte, len(want))
+			pc.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := io.ReadFull(pc, replayed); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(replayed, want) {
+				t.Error("replayed bytes differ from the ones sent")
+			}
+		})
+	}
+}
+
+func TestRouterPassthrough(t *testing.T) {
+	cfg := &config.Config{
+		DstAddress: "127.0.0.1:22",
+		Backends: map[string]config.BackendConfig{
+			"mail": {Address: "127.0.0.1:993"},
+			"Web":  {Address: "127.0.0.1:8443"},
+			"grpc": {Address: "127.0.0.1:50051"},
+		},
+		TLSPassthrough: []config.RouteConfig{
+			{Match: "sni", Value: "vpn.example.com", Backend: config.LocalBackend},
+			{Match: "sni", Value: "mail.example.com", Backend: "mail"},
+			{Match: "sni", Value: "*.example.com", Backend: "web"},
+			{Match: "alpn", Value: "h2", Backend: "grpc"},
+		},
+	}
+	r := NewRouter(cfg)
+
+	tests := []struct {
+		name    string
+		hello   ClientHello
+		backend string // "" when terminated locally
+	}{
+		{name: "local rule", hello: ClientHello{ServerName: "vpn.example.com", Protocols: []string{"h2"}}},
+		{name: "exact sni", hello: ClientHello{ServerName: "mail.example.com"}, backend: "mail"},
+		{name: "sni case", hello: ClientHello{ServerName: "MAIL.Example.com"}, backend: "mail"},
+		{name: "wildcard sni", hello: ClientHello{ServerName: "www.example.com"}, backend: "web"},
+		{name: "nested wildcard sni", hello: ClientHello{ServerName: "a.b.example.com"}, backend: "web"},
+		{name: "wildcard needs a subdomain", hello: ClientHello{ServerName: "example.com"}},
+		{name: "alpn", hello: ClientHello{ServerName: "example.org", Protocols: []string{"http/1.1", "h2"}}, backend: "grpc"},
+		{name: "alpn without sni", hello: ClientHello{Protocols: []string{"h2"}}, backend: "grpc"},
+		{name: "no match", hello: ClientHello{ServerName: "example.org", Protocols: []string{"http/1.1"}}},
+		{name: "empty hello", hello: ClientHello{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := r.Passthrough(&tt.hello)
+			var got string
+			if backend != nil {
+				got = backend.Name
+			}
+			if got != tt.backend {
+				t.Errorf("Passthrough(%+v) = %q, want %q", tt.hello, got, tt.backend)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// connTypePassthrough labels TLS connections relayed without termination
+const connTypePassthrough = "tls-passthrough"
+
+// Passthrough returns the backend a TLS connection with the given ClientHello
+// is passed through to, or nil if gowsoos terminates it itself
+func (p *Proxy) Passthrough(hello *ClientHello) *Backend {
+	return p.loadState().router.Passthrough(hello)
+}
+
+// HandlePassthrough relays a TLS connection to backend without terminating
+// it. clientConn still holds the peeked ClientHello, which the backend
+// receives first.
+func (p *Proxy) HandlePassthrough(ctx context.Context, clientConn *PeekedConn, backend *Backend, hello *ClientHello) {
+	defer func() {
+		clientConn.Close()
+		p.metrics.RecordConnectionClosed()
+	}()
+
+	sess := p.sessions.add(clientConn)
+	defer p.sessions.remove(sess)
+	sess.setRoute("", hello.ServerName, backend.Name)
+	logger := p.logger.With("client", sess.ClientAddr)
+
+	st := p.loadState()
+	startTime := time.Now()
+
+	if ctx.Err() != nil {
+		p.metrics.RecordConnection(connTypePassthrough, "failed")
+		return
+	}
+
+	if p.overQuota(st.config, sess, logger) {
+		p.metrics.RecordConnection(connTypePassthrough, "failed")
+		return
+	}
+
+	dialer := &net.Dialer{Timeout: st.config.GetDialTimeout()}
+	destConn, err := dialer.DialContext(ctx, "tcp", backend.Address)
+	if err != nil {
+		p.metrics.RecordConnection(connTypePassthrough, "failed")
+		if isTimeout(err) {
+			logger.Warn("Connection closed", "reason", reasonDialTimeout, "backend", backend.Name, "destination", backend.Address)
+			p.metrics.RecordTimeout(reasonDialTimeout)
+		} else {
+			logger.Error("Failed to connect to destination", "backend", backend.Name, "sni", hello.ServerName, "error", err)
+			p.metrics.RecordError("destination", dialErrorReason(err))
+		}
+		return
+	}
+	defer destConn.Close()
+
+	if backend.ProxyProtocol != "" {
+		if err := writeProxyHeader(destConn, backend.ProxyProtocol, clientConn, helloTLVs(hello)); err != nil {
+			logger.Error("Failed to send PROXY protocol header", "backend", backend.Name, "error", err)
+			p.metrics.RecordConnection(connTypePassthrough, "failed")
+			p.metrics.RecordError("destination", "proxy_protocol")
+			return
+		}
+	}
+
+	p.metrics.RecordConnection(connTypePassthrough, "success")
+	logger.Debug("TLS passthrough established",
+		"backend", backend.Name,
+		"destination", backend.Address,
+		"sni", hello.ServerName,
+		"alpn", hello.Protocols)
+
+	sess.attach(clientConn, destConn)
+	p.streamConnections(st, sess, destConn, clientConn)
+	p.metrics.RecordConnectionDuration(connTypePassthrough, time.Since(startTime).Seconds())
+}
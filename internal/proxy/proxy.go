@@ -1,26 +1,31 @@
 package proxy
 
 import (
+	"bufio"
 	"context"
-	"crypto/sha1"
 	"crypto/tls"
-	"encoding/base64"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
+	"gowsoos/internal/accounting"
+	"gowsoos/internal/auth"
 	"gowsoos/internal/config"
+	"gowsoos/internal/limiter"
 	"gowsoos/internal/metrics"
 )
 
 const (
-	defaultTimeout         = 30 * time.Second
-	defaultReadBufferSize  = 32 * 1024 // 32 KB
-	webSocketMagicString   = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
-	defaultHandshakeStatus = "101 Switching Protocols"
+	defaultRequestBufferSize = 4 * 1024 // 4 KB
+	webSocketMagicString     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	defaultHandshakeStatus   = "101 Switching Protocols"
 )
 
 // ProxyConnection interface for network connections
@@ -28,170 +33,707 @@ type ProxyConnection interface {
 	Read([]byte) (int, error)
 	Write([]byte) (int, error)
 	Close() error
+	SetDeadline(time.Time) error
 }
 
 // Proxy handles the SSH proxying logic
 type Proxy struct {
+	logger   *slog.Logger
+	metrics  *metrics.Metrics
+	state    atomic.Value // *proxyState
+	sessions *sessionRegistry
+	auth     *auth.Authenticator
+	users    *limiter.UserLimit
+	shaper   *limiter.Shaper
+	ledger   *accounting.Ledger
+
+	// onFailure is told the IP of clients failing the handshake
+	onFailure func(ip string)
+}
+
+// proxyState is the configuration derived state used by new connections.
+// Each connection keeps the snapshot it started with across reloads.
+type proxyState struct {
 	config  *config.Config
-	logger  *slog.Logger
-	metrics *metrics.Metrics
+	router  *Router
+	buffers *bufferPool
 }
 
 // NewProxy creates a new proxy instance
 func NewProxy(cfg *config.Config, logger *slog.Logger, m *metrics.Metrics) *Proxy {
-	return &Proxy{
+	p := &Proxy{
+		logger:   logger,
+		metrics:  m,
+		sessions: newSessionRegistry(),
+		auth:     auth.NewAuthenticator(),
+		users:    limiter.NewUserLimit(cfg.MaxConnectionsPerUser),
+		shaper:   limiter.NewShaper(bandwidthRates(cfg)),
+		ledger:   accounting.NewLedger(),
+	}
+	p.Reload(cfg)
+	return p
+}
+
+// Reload swaps in a new configuration for connections accepted from now on
+func (p *Proxy) Reload(cfg *config.Config) {
+	p.state.Store(&proxyState{
 		config:  cfg,
-		logger:  logger,
-		metrics: m,
+		router:  NewRouter(cfg),
+		buffers: newBufferPool(cfg.BufferSize),
+	})
+	p.users.SetLimit(cfg.MaxConnectionsPerUser)
+	p.shaper.SetRates(bandwidthRates(cfg))
+	p.ledger.SetPolicy(quotaPolicy(cfg))
+}
+
+// quotaPolicy converts the configured quotas from MB and KB/s, and the
+// retention from days
+func quotaPolicy(cfg *config.Config) accounting.Policy {
+	const kb, mb = 1024, 1024 * 1024
+	policy := accounting.Policy{
+		Default:      accounting.Quota{Daily: int64(cfg.QuotaDaily) * mb, Monthly: int64(cfg.QuotaMonthly) * mb},
+		Overrides:    make(map[string]accounting.Quota, len(cfg.QuotaOverrides)),
+		Action:       cfg.QuotaAction,
+		ThrottleRate: int64(cfg.QuotaThrottleRate) * kb,
+		Retention:    time.Duration(cfg.AccountingRetention) * 24 * time.Hour,
+	}
+	for _, q := range cfg.QuotaOverrides {
+		policy.Overrides[q.Identity] = accounting.Quota{Daily: int64(q.Daily) * mb, Monthly: int64(q.Monthly) * mb}
+	}
+	return policy
+}
+
+// bandwidthRates converts the configured bandwidth caps from KB/s
+func bandwidthRates(cfg *config.Config) limiter.Rates {
+	const kb = 1024
+	return limiter.Rates{
+		GlobalUpload:   int64(cfg.BandwidthUpload) * kb,
+		GlobalDownload: int64(cfg.BandwidthDownload) * kb,
+		ConnUpload:     int64(cfg.BandwidthConnUpload) * kb,
+		ConnDownload:   int64(cfg.BandwidthConnDownload) * kb,
+		IPUpload:       int64(cfg.BandwidthIPUpload) * kb,
+		IPDownload:     int64(cfg.BandwidthIPDownload) * kb,
+	}
+}
+
+// Ledger returns the traffic accounting of tunnels. It is loaded from and
+// saved to accounting_file by the caller.
+func (p *Proxy) Ledger() *accounting.Ledger {
+	return p.ledger
+}
+
+// Authenticator returns the credential check of upgrade requests. It is
+// loaded and reloaded by the caller since reading its files can fail.
+func (p *Proxy) Authenticator() *auth.Authenticator {
+	return p.auth
+}
+
+// OnHandshakeFailure registers fn to be called with the client IP of every
+// connection failing the TLS handshake, the upgrade request or authentication.
+// It must be set before connections are handled.
+func (p *Proxy) OnHandshakeFailure(fn func(ip string)) {
+	p.onFailure = fn
+}
+
+func (p *Proxy) reportFailure(sess *Session) {
+	if p.onFailure != nil {
+		p.onFailure(sess.ClientIP())
 	}
 }
 
+func (p *Proxy) loadState() *proxyState {
+	return p.state.Load().(*proxyState)
+}
+
+// ActiveSessions returns the number of connections being handled
+func (p *Proxy) ActiveSessions() int {
+	return p.sessions.count()
+}
+
+// Drain waits until every session has finished or ctx is done
+func (p *Proxy) Drain(ctx context.Context) error {
+	return p.sessions.wait(ctx)
+}
+
+// CloseSessions force-closes every session and returns how many were cut.
+// With notice set, framed clients get a going-away close frame first.
+func (p *Proxy) CloseSessions(notice bool) int {
+	return p.sessions.closeAll(notice)
+}
+
+// Sessions returns the sessions being handled, ordered by ID
+func (p *Proxy) Sessions() []SessionInfo {
+	sessions := p.sessions.list(func(*Session) bool { return true })
+	infos := make([]SessionInfo, len(sessions))
+	for i, sess := range sessions {
+		infos[i] = sess.Info()
+	}
+	return infos
+}
+
+// CloseSession force-closes the session with the given ID and reports
+// whether it was found
+func (p *Proxy) CloseSession(id uint64) bool {
+	return p.sessions.closeMatching(false, func(sess *Session) bool { return sess.ID == id }) > 0
+}
+
+// CloseClient force-closes every session from ip and returns how many were cut
+func (p *Proxy) CloseClient(ip string) int {
+	return p.sessions.closeMatching(false, func(sess *Session) bool { return sess.ClientIP() == ip })
+}
+
 // HandleConnection manages individual proxy connections
 func (p *Proxy) HandleConnection(ctx context.Context, clientConn ProxyConnection, isTLSClient bool) {
+	p.handle(ctx, clientConn, isTLSClient, false)
+}
+
+// HandleDirect forwards a client speaking SSH straight away, without any
+// HTTP request or handshake response, to the default backend
+func (p *Proxy) HandleDirect(ctx context.Context, clientConn ProxyConnection) {
+	p.handle(ctx, clientConn, false, true)
+}
+
+func (p *Proxy) handle(ctx context.Context, clientConn ProxyConnection, isTLSClient, direct bool) {
 	defer func() {
 		clientConn.Close()
 		p.metrics.RecordConnectionClosed()
 	}()
 
+	sess := p.sessions.add(clientConn)
+	defer p.sessions.remove(sess)
+	logger := p.logger.With("client", sess.ClientAddr)
+
+	st := p.loadState()
+	cfg := st.config
+
 	startTime := time.Now()
 	connType := "http"
 	if isTLSClient {
 		connType = "tls"
+	} else if direct {
+		connType = "ssh"
 	}
 
-	// Perform WebSocket handshake or custom handshake
-	if err := p.performHandshake(clientConn); err != nil {
-		p.logger.Error("Handshake failed", "error", err)
-		p.metrics.RecordError("handshake", err.Error())
+	// Stunnel and direct clients speak SSH straight away; everyone else sends an HTTP request first
+	stunnel := isTLSClient && cfg.TLSMode == "stunnel"
+	skipHTTP := stunnel || direct
+
+	// Stunnel clients always get the legacy response, everyone else is negotiated
+	hs := &handshake{legacy: true, customCode: cfg.HandshakeCode}
+
+	// Bound the whole handshake, including the TLS handshake run by the first read
+	if err := clientConn.SetDeadline(time.Now().Add(cfg.GetHandshakeTimeout())); err != nil {
+		logger.Debug("Failed to set handshake deadline", "error", err)
+	}
+
+	// Complete the TLS handshake up front so the server name is known for routing
+	// The accepted connection is kept for its addresses, clientConn gets wrapped below
+	acceptedConn := clientConn
+
+	// The identity from the client certificate or upgrade request credentials
+	var user string
+
+	var sni string
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := clientConn.(*tls.Conn); ok {
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			p.metrics.RecordConnection(connType, "failed")
+			p.reportFailure(sess)
+			if isTimeout(err) {
+				logger.Warn("Connection closed", "reason", reasonHandshakeTimeout, "error", err)
+				p.metrics.RecordTimeout(reasonHandshakeTimeout)
+				return
+			}
+			logger.Debug("TLS handshake failed", "sni", tlsConn.ConnectionState().ServerName, "error", err)
+			p.metrics.RecordError("tls", "handshake")
+			return
+		}
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+		sni = state.ServerName
+
+		// Only verified certificates get here, see tls_client_auth
+		if len(state.PeerCertificates) > 0 {
+			user = ClientIdentity(state.PeerCertificates[0], cfg.TLSClientIdentity)
+			logger = logger.With("cert", user)
+		}
+	}
+
+	var req *Request
+	if !skipHTTP {
+		reader := bufio.NewReaderSize(clientConn, defaultRequestBufferSize)
+		var err error
+		req, err = readUpgradeRequest(reader)
+		if err != nil {
+			p.metrics.RecordConnection(connType, "failed")
+			p.reportFailure(sess)
+			if isTimeout(err) {
+				logger.Warn("Connection closed", "reason", reasonHandshakeTimeout, "error", err)
+				p.metrics.RecordTimeout(reasonHandshakeTimeout)
+				return
+			}
+			logger.Error("Failed to read upgrade request", "error", err)
+			p.metrics.RecordError("request", requestErrorReason(err))
+			p.writeHTTPError(clientConn, http.StatusBadRequest)
+			return
+		}
+		logger.Debug("Upgrade request received",
+			"method", req.Method,
+			"path", p.auth.Redact(req.Path),
+			"host", req.Host,
+			"sni", sni,
+			"upgrade", req.Header.Get("Upgrade"))
+
+		// Keep any bytes read past the request head (e.g. the SSH banner)
+		clientConn = &bufferedConn{ProxyConnection: clientConn, reader: reader}
+
+		// Authenticate before negotiating so rejected clients learn nothing more
+		authUser, err := p.auth.Authenticate(req.Header, req.Path)
+		if err != nil {
+			logger.Warn("Authentication failed", "error", err)
+			p.recordAuthFailure(err)
+			p.metrics.RecordConnection(connType, "failed")
+			p.reportFailure(sess)
+			p.writeAuthError(clientConn, err)
+			return
+		}
+		if authUser != "" {
+			user = authUser
+			logger = logger.With("user", user)
+		}
+
+		hs, err = p.prepareHandshake(cfg, req)
+		if err != nil {
+			logger.Warn("Rejected upgrade request", "error", err)
+			p.metrics.RecordError("handshake", handshakeErrorCode(err))
+			p.metrics.RecordConnection(connType, "failed")
+			p.reportFailure(sess)
+			p.writeHandshakeError(clientConn, err)
+			return
+		}
+	}
+
+	// Stunnel and direct clients have no request to carry credentials,
+	// only a client certificate can identify them
+	if skipHTTP && p.auth.Enabled() && user == "" {
+		err := &auth.Error{Reason: auth.ReasonMissing}
+		logger.Warn("Authentication failed", "error", err)
+		p.recordAuthFailure(err)
+		p.metrics.RecordConnection(connType, "failed")
+		p.reportFailure(sess)
+		return
+	}
+
+	// Don't open new tunnels once the server is shutting down
+	if ctx.Err() != nil {
 		p.metrics.RecordConnection(connType, "failed")
+		if !skipHTTP {
+			p.writeHTTPError(clientConn, http.StatusServiceUnavailable)
+		}
 		return
 	}
 
+	if user != "" {
+		sess.setUser(user)
+
+		release, err := p.users.Acquire(user)
+		if err != nil {
+			logger.Warn("Connection rejected", "reason", limiter.ReasonPerUserLimit)
+			p.metrics.RecordRejection(limiter.ReasonPerUserLimit)
+			p.metrics.RecordConnection(connType, "failed")
+			if !skipHTTP {
+				p.writeHTTPError(clientConn, http.StatusServiceUnavailable)
+			}
+			return
+		}
+		defer release()
+	}
+
+	if p.overQuota(cfg, sess, logger) {
+		p.metrics.RecordConnection(connType, "failed")
+		if !skipHTTP {
+			p.writeHTTPError(clientConn, http.StatusTooManyRequests)
+		}
+		return
+	}
+
+	backend := st.router.Route(req, sni)
+	var host string
+	if req != nil {
+		host = req.Host
+	}
+	sess.setRoute(host, sni, backend.Name)
+
 	// Establish connection to destination
-	destConn, err := net.DialTimeout("tcp", p.config.DstAddress, defaultTimeout)
+	dialer := &net.Dialer{Timeout: cfg.GetDialTimeout()}
+	destConn, err := dialer.DialContext(ctx, "tcp", backend.Address)
 	if err != nil {
-		p.logger.Error("Failed to connect to destination", "error", err)
-		p.metrics.RecordError("destination", err.Error())
 		p.metrics.RecordConnection(connType, "failed")
+		if isTimeout(err) {
+			logger.Warn("Connection closed", "reason", reasonDialTimeout, "backend", backend.Name, "destination", backend.Address)
+			p.metrics.RecordTimeout(reasonDialTimeout)
+		} else {
+			logger.Error("Failed to connect to destination", "backend", backend.Name, "sni", sni, "error", err)
+			p.metrics.RecordError("destination", dialErrorReason(err))
+		}
+		if !skipHTTP {
+			p.writeHTTPError(clientConn, http.StatusBadGateway)
+		}
 		return
 	}
 	defer destConn.Close()
 
-	p.metrics.RecordConnection(connType, "success")
+	if backend.ProxyProtocol != "" {
+		if err := writeProxyHeader(destConn, backend.ProxyProtocol, acceptedConn, tlsTLVs(tlsState)); err != nil {
+			logger.Error("Failed to send PROXY protocol header", "backend", backend.Name, "error", err)
+			p.metrics.RecordConnection(connType, "failed")
+			p.metrics.RecordError("destination", "proxy_protocol")
+			if !skipHTTP {
+				p.writeHTTPError(clientConn, http.StatusBadGateway)
+			}
+			return
+		}
+	}
 
-	// Handle connection based on TLS mode
-	if isTLSClient && p.config.TLSMode == "stunnel" {
-		// Direct stream copying for stunnel mode
-		p.streamConnections(destConn, clientConn)
-		p.metrics.RecordConnectionDuration(connType+"-stunnel", time.Since(startTime).Seconds())
-		return
+	// Perform WebSocket handshake or custom handshake, direct clients get no response
+	if !direct {
+		if err := p.performHandshake(clientConn, hs); err != nil {
+			p.metrics.RecordConnection(connType, "failed")
+			if isTimeout(err) {
+				logger.Warn("Connection closed", "reason", reasonHandshakeTimeout, "error", err)
+				p.metrics.RecordTimeout(reasonHandshakeTimeout)
+				return
+			}
+			logger.Error("Handshake failed", "error", err)
+			p.metrics.RecordError("handshake", "write_failed")
+			return
+		}
 	}
 
-	// Discard initial payload for standard mode
-	if err := p.discardPayload(clientConn); err != nil {
-		p.logger.Error("Failed to discard payload", "error", err)
-		p.metrics.RecordError("payload", err.Error())
-		return
+	// The tunnel is bounded by the idle and session timeouts from here on
+	if err := clientConn.SetDeadline(time.Time{}); err != nil {
+		logger.Debug("Failed to clear handshake deadline", "error", err)
 	}
 
+	p.metrics.RecordConnection(connType, "success")
+	logger.Debug("Tunnel established", "backend", backend.Name, "destination", backend.Address, "sni", sni)
+
+	// Only clients that completed the RFC 6455 handshake can speak frames
+	transportMode := cfg.TransportMode
+	if isTLSClient {
+		transportMode = cfg.TLSTransportMode
+	}
+	if !hs.legacy && transportMode == "framed" {
+		clientConn = newWebSocketConn(clientConn)
+		connType += "-framed"
+	}
+	sess.attach(clientConn, destConn)
+
 	// Stream connections
-	p.streamConnections(destConn, clientConn)
+	p.streamConnections(st, sess, destConn, clientConn)
+	if stunnel {
+		connType += "-stunnel"
+	}
 	p.metrics.RecordConnectionDuration(connType, time.Since(startTime).Seconds())
 }
 
+// overQuota reports whether the session is refused because its identity used
+// up its traffic quota
+func (p *Proxy) overQuota(cfg *config.Config, sess *Session, logger *slog.Logger) bool {
+	if !cfg.AccountingEnabled || !p.ledger.Refused(sess.identity()) {
+		return false
+	}
+	logger.Warn("Connection rejected", "reason", accounting.ReasonQuotaExceeded, "identity", sess.identity())
+	p.metrics.RecordRejection(accounting.ReasonQuotaExceeded)
+	return true
+}
+
+// prepareHandshake decides how the client's upgrade request will be answered
+func (p *Proxy) prepareHandshake(cfg *config.Config, req *Request) (*handshake, error) {
+	if cfg.HandshakeCode != "" {
+		return &handshake{legacy: true, customCode: cfg.HandshakeCode}, nil
+	}
+
+	hs, err := negotiateWebSocket(req, cfg.WebSocketProtocols)
+	if err != nil && cfg.LegacyHandshake {
+		// Injector payloads rarely carry a valid key, answer them the old way
+		p.logger.Debug("Using legacy handshake", "reason", err)
+		return &handshake{legacy: true}, nil
+	}
+	return hs, err
+}
+
 // performHandshake handles WebSocket or custom handshake
-func (p *Proxy) performHandshake(conn ProxyConnection) error {
-	if p.config.HandshakeCode != "" {
+func (p *Proxy) performHandshake(conn ProxyConnection, hs *handshake) error {
+	if hs.legacy && hs.customCode != "" {
 		// Custom handshake response
-		_, err := conn.Write([]byte(fmt.Sprintf("HTTP/1.1 %s Ok\r\n\r\n", p.config.HandshakeCode)))
+		_, err := conn.Write([]byte(fmt.Sprintf("HTTP/1.1 %s Ok\r\n\r\n", hs.customCode)))
 		return errors.Wrap(err, "failed to write custom handshake response")
 	}
 
-	// Default WebSocket handshake
-	secWebSocketKey := "Y2FmcnQ2NTRlY2Z2Z3ludTg="
-	h := sha1.New()
-	h.Write([]byte(secWebSocketKey + webSocketMagicString))
-	secWebSocketAccept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	accept := hs.accept
+	if hs.legacy {
+		// Fixed accept value expected by legacy injector clients
+		accept = computeAcceptKey(legacyWebSocketKey)
+	}
 
 	resp := fmt.Sprintf("HTTP/1.1 %s\r\n"+
 		"Upgrade: websocket\r\n"+
 		"Connection: Upgrade\r\n"+
-		"Sec-WebSocket-Accept: %s\r\n\r\n",
-		defaultHandshakeStatus, secWebSocketAccept)
+		"Sec-WebSocket-Accept: %s\r\n",
+		defaultHandshakeStatus, accept)
+	if hs.protocol != "" {
+		resp += fmt.Sprintf("Sec-WebSocket-Protocol: %s\r\n", hs.protocol)
+	}
+	resp += "\r\n"
 
 	_, err := conn.Write([]byte(resp))
 	return errors.Wrap(err, "failed to write websocket handshake response")
 }
 
-// discardPayload reads and discards initial payload
-func (p *Proxy) discardPayload(conn ProxyConnection) error {
-	buffer := make([]byte, defaultReadBufferSize)
-	_, err := io.ReadAtLeast(conn, buffer, 5)
-	return errors.Wrap(err, "failed to discard initial payload")
+// handshakeErrorCode returns the metrics label of a rejected upgrade request
+func handshakeErrorCode(err error) string {
+	var hsErr *handshakeError
+	if errors.As(err, &hsErr) {
+		return hsErr.code
+	}
+	return "rejected"
+}
+
+// dialErrorReason returns the metrics label of a failed backend dial other
+// than a timeout, which is counted on its own
+func dialErrorReason(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	}
+	return "dial_failed"
 }
 
-// streamConnections handles bidirectional data streaming
-func (p *Proxy) streamConnections(src, dst ProxyConnection) {
-	errChan := make(chan error, 2)
+// writeHandshakeError answers a rejected upgrade request with the matching HTTP status
+func (p *Proxy) writeHandshakeError(conn ProxyConnection, err error) {
+	var hsErr *handshakeError
+	if !errors.As(err, &hsErr) {
+		p.writeHTTPError(conn, http.StatusBadRequest)
+		return
+	}
+	p.writeHTTPError(conn, hsErr.status, hsErr.headers...)
+}
+
+// recordAuthFailure counts a failed authentication by its bounded reason
+func (p *Proxy) recordAuthFailure(err error) {
+	reason := auth.ReasonMalformed
+	var authErr *auth.Error
+	if errors.As(err, &authErr) {
+		reason = authErr.Reason
+	}
+	p.metrics.RecordError("auth", reason)
+}
+
+// writeAuthError answers missing credentials with 401 and a challenge, and
+// wrong ones with 403
+func (p *Proxy) writeAuthError(conn ProxyConnection, err error) {
+	var authErr *auth.Error
+	if errors.As(err, &authErr) && authErr.Missing() {
+		p.writeHTTPError(conn, http.StatusUnauthorized, p.auth.Challenges()...)
+		return
+	}
+	p.writeHTTPError(conn, http.StatusForbidden)
+}
+
+// writeHTTPError sends a minimal HTTP error response before the connection is closed
+func (p *Proxy) writeHTTPError(conn ProxyConnection, status int, headers ...string) {
+	resp := fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	for _, h := range headers {
+		resp += h + "\r\n"
+	}
+	resp += "Content-Length: 0\r\nConnection: close\r\n\r\n"
+
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		p.logger.Debug("Failed to write error response", "status", status, "error", err)
+	}
+}
+
+// streamConnections handles bidirectional data streaming between the backend
+// src and the client dst. When one direction reaches EOF the write half of its
+// destination is closed and the other direction keeps flowing until it ends
+// too or the session times out.
+func (p *Proxy) streamConnections(st *proxyState, sess *Session, src, dst ProxyConnection) {
+	act := newActivity()
+
+	// Shaped tunnels are copied in user space, nil leaves splice available
+	flow := p.shaper.Open(sess.ClientIP())
+	if flow != nil {
+		defer flow.Close()
+	}
+
+	var meter *accounting.Meter
+	if st.config.AccountingEnabled {
+		meter = p.ledger.Meter(sess.identity())
+		defer func() {
+			if meter.Over() {
+				p.logger.Info("Tunnel went over quota",
+					"client", sess.ClientAddr,
+					"identity", meter.Identity(),
+					"action", st.config.QuotaAction)
+				p.metrics.RecordQuotaExceeded(st.config.QuotaAction)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go p.watchSession(st.config.GetIdleTimeout(), st.config.GetMaxSessionDuration(), src, dst, act, done)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
 
 	// Copy from src to dst
 	go func() {
-		bytesCopied, err := io.Copy(dst, &byteCounter{conn: src, metrics: p.metrics, direction: "src_to_dst"})
-		if err != nil && err != io.EOF {
-			errChan <- errors.Wrap(err, "failed to copy from src to dst")
-		} else {
-			p.logger.Debug("Data transfer completed", "direction", "src_to_dst", "bytes", bytesCopied)
-			errChan <- nil
-		}
+		defer wg.Done()
+		p.pipe(st.buffers, dst, src, &byteCounter{conn: src, metrics: p.metrics, direction: "src_to_dst", activity: act, flow: flow, shaping: limiter.Download, meter: meter, session: sess})
 	}()
 
 	// Copy from dst to src
 	go func() {
-		bytesCopied, err := io.Copy(src, &byteCounter{conn: dst, metrics: p.metrics, direction: "dst_to_src"})
-		if err != nil && err != io.EOF {
-			errChan <- errors.Wrap(err, "failed to copy from dst to src")
-		} else {
-			p.logger.Debug("Data transfer completed", "direction", "dst_to_src", "bytes", bytesCopied)
-			errChan <- nil
+		defer wg.Done()
+
+		// Injector clients may still send parts of their payload, never pass them to the backend
+		if bc, ok := dst.(*bufferedConn); ok {
+			dropped, err := bc.discardLateRequests()
+			if err != nil {
+				p.logger.Debug("Data transfer failed", "direction", "dst_to_src", "error", err)
+				src.Close()
+				dst.Close()
+				return
+			}
+			if dropped > 0 {
+				p.logger.Debug("Discarded late injector requests", "client", sess.ClientAddr, "requests", dropped)
+			}
 		}
+
+		p.pipe(st.buffers, src, dst, &byteCounter{conn: dst, metrics: p.metrics, direction: "dst_to_src", activity: act, flow: flow, shaping: limiter.Upload, meter: meter, session: sess})
 	}()
 
-	// Wait for first error or completion
-	<-errChan
+	// Wait for both directions to finish
+	wg.Wait()
 }
 
-// byteCounter wraps a connection to count bytes transferred
+// pipe copies one direction of a tunnel and propagates EOF to the destination
+func (p *Proxy) pipe(buffers *bufferPool, dst, src ProxyConnection, counter *byteCounter) {
+	direction := counter.direction
+	bytesCopied, err := buffers.copyStream(dst, src, counter)
+	if err != nil && err != io.EOF {
+		// A broken direction takes the whole tunnel down
+		p.logger.Debug("Data transfer failed", "direction", direction, "bytes", bytesCopied, "error", err)
+		src.Close()
+		dst.Close()
+		return
+	}
+
+	p.logger.Debug("Data transfer completed", "direction", direction, "bytes", bytesCopied)
+	if err := closeWrite(dst); err != nil {
+		// Without a half-close the peer would never see EOF, end the tunnel instead
+		p.logger.Debug("Failed to half-close connection", "direction", direction, "error", err)
+		src.Close()
+		dst.Close()
+	}
+}
+
+// closeWrite shuts down the write half of conn if it supports it
+func closeWrite(conn ProxyConnection) error {
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errors.New("connection does not support half-close")
+	}
+	return cw.CloseWrite()
+}
+
+// byteCounter wraps a connection to count bytes transferred, and holds reads
+// back when the tunnel is shaped
 type byteCounter struct {
 	conn      ProxyConnection
 	metrics   *metrics.Metrics
 	direction string
+	activity  *activity
+	session   *Session // nil when the bytes are not reported per session
+
+	flow    *limiter.Flow // nil when bandwidth is not capped
+	shaping string        // limiter.Upload or limiter.Download, also for accounting
+
+	meter *accounting.Meter // nil when accounting is disabled
+}
+
+// shaped reports whether reads may be held back, which rules out splice
+func (bc *byteCounter) shaped() bool {
+	return bc.flow != nil || (bc.meter != nil && bc.meter.Throttles())
 }
 
 func (bc *byteCounter) Read(p []byte) (int, error) {
-	n, err := bc.conn.Read(p)
-	if n > 0 {
-		bc.metrics.RecordBytesTransferred(bc.direction, int64(n))
+	if bc.flow != nil {
+		if chunk := bc.flow.Chunk(bc.shaping); chunk > 0 && len(p) > chunk {
+			p = p[:chunk]
+		}
 	}
+	n, err := bc.conn.Read(p)
+	bc.record(n)
+	bc.throttle(n)
 	return n, err
 }
 
+// throttle waits until the bandwidth caps allow n more bytes
+func (bc *byteCounter) throttle(n int) {
+	if bc.flow == nil || n <= 0 {
+		return
+	}
+	delay, scope := bc.flow.Reserve(bc.shaping, n)
+	if delay <= 0 {
+		return
+	}
+	bc.metrics.RecordThrottleStart(bc.shaping)
+	time.Sleep(delay)
+	bc.metrics.RecordThrottleEnd(bc.shaping, scope, delay.Seconds())
+}
+
 func (bc *byteCounter) Write(p []byte) (int, error) {
 	n, err := bc.conn.Write(p)
-	if n > 0 {
-		bc.metrics.RecordBytesTransferred(bc.direction, int64(n))
-	}
+	bc.record(n)
 	return n, err
 }
 
-// TLSConfig creates a TLS configuration for the proxy
-func TLSConfig(privateKey, publicKey string) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(privateKey, publicKey)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to load TLS certificate")
+// record accounts for n bytes moved outside of Read and Write
+func (bc *byteCounter) record(n int) {
+	if n <= 0 {
+		return
+	}
+	bc.metrics.RecordBytesTransferred(bc.direction, int64(n))
+	bc.activity.touch()
+	if bc.session != nil {
+		bc.session.count(bc.shaping == limiter.Upload, n)
+	}
+
+	if bc.meter != nil {
+		cut, delay := bc.meter.Add(bc.shaping == limiter.Upload, n)
+		if cut {
+			// The failing read ends both directions of the tunnel
+			bc.conn.Close()
+		} else if delay > 0 {
+			time.Sleep(delay)
+		}
 	}
+}
 
+// TLSConfig creates a TLS configuration for the proxy that selects
+// certificates from the store by SNI
+func TLSConfig(certs *CertStore) *tls.Config {
 	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS12, // Enforce modern TLS
-	}, nil
-}
\ No newline at end of file
+		GetCertificate:     certs.GetCertificate,
+		GetConfigForClient: certs.GetConfigForClient,
+		MinVersion:         tls.VersionTLS12, // Enforce modern TLS
+	}
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tunnel runs streamConnections between a client and a backend over
+// loopback TCP and returns the peers of both
+func tunnel(t *testing.T, p *Proxy) (client, backend *net.TCPConn, finished chan struct{}) {
+	t.Helper()
+	client, proxyClient := tcpPipe(t)
+	proxyBackend, backend := tcpPipe(t)
+	t.Cleanup(func() {
+		for _, c := range []net.Conn{client, proxyClient, proxyBackend, backend} {
+			c.Close()
+		}
+	})
+
+	finished = make(chan struct{})
+	go func() {
+		sess := p.sessions.add(proxyClient)
+		defer p.sessions.remove(sess)
+		p.streamConnections(p.loadState(), sess, proxyBackend, proxyClient)
+		close(finished)
+	}()
+	return client, backend, finished
+}
+
+// expectRead reads from conn until want has arrived
+func expectRead(t *testing.T, conn net.Conn, want string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read %q, want %q: %v", buf, want, err)
+	}
+	if string(buf) != want {
+		t.Fatalf("read %q, want %q", buf, want)
+	}
+}
+
+// expectEOF checks that the peer half-closed conn
+func expectEOF(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read %d bytes, %v, want EOF", n, err)
+	}
+}
+
+func TestStreamHalfClose(t *testing.T) {
+	tests := []struct {
+		name        string
+		clientFirst bool
+	}{
+		{name: "client finishes first", clientFirst: true},
+		{name: "backend finishes first", clientFirst: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, backend, finished := tunnel(t, newBenchProxy())
+
+			// One side sends its last bytes and half-closes
+			closer, peer := backend, client
+			if tt.clientFirst {
+				closer, peer = client, backend
+			}
+			if _, err := closer.Write([]byte("request")); err != nil {
+				t.Fatal(err)
+			}
+			if err := closer.CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			expectRead(t, peer, "request")
+			expectEOF(t, peer)
+
+			// The other direction keeps flowing
+			for _, chunk := range []string{"response ", "still ", "flowing"} {
+				if _, err := peer.Write([]byte(chunk)); err != nil {
+					t.Fatalf("write after the half-close: %v", err)
+				}
+				expectRead(t, closer, chunk)
+			}
+			select {
+			case <-finished:
+				t.Fatal("tunnel ended with one direction still open")
+			default:
+			}
+
+			peer.CloseWrite()
+			expectEOF(t, closer)
+			select {
+			case <-finished:
+			case <-time.After(2 * time.Second):
+				t.Fatal("tunnel still running after both directions finished")
+			}
+		})
+	}
+}
+
+func TestStreamWithoutHalfClose(t *testing.T) {
+	p := newBenchProxy()
+	client, proxyClient := tcpPipe(t)
+	defer client.Close()
+
+	// A backend that cannot half-close ends the whole tunnel on EOF
+	proxyBackend, backend := net.Pipe()
+	defer backend.Close()
+
+	finished := make(chan struct{})
+	go func() {
+		sess := p.sessions.add(proxyClient)
+		defer p.sessions.remove(sess)
+		p.streamConnections(p.loadState(), sess, proxyBackend, proxyClient)
+		close(finished)
+	}()
+
+	go func() {
+		io.Copy(io.Discard, backend)
+	}()
+	client.CloseWrite()
+
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("tunnel kept running without a way to pass on EOF")
+	}
+	expectEOF(t, client)
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/pkg/errors"
+	"gowsoos/internal/proxyproto"
+)
+
+// tlsVersionNames maps TLS versions to the names used in the PROXY SSL TLV
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// writeProxyHeader announces the client to a backend that expects the PROXY
+// protocol. client is the connection as accepted, so its addresses are the
+// ones relayed by a trusted load balancer if there is one. The TLVs are only
+// sent in version 2 headers.
+func writeProxyHeader(dst net.Conn, version string, client ProxyConnection, tlvs []proxyproto.TLV) error {
+	h := &proxyproto.Header{Version: 1, TLVs: tlvs}
+	if version == "v2" {
+		h.Version = 2
+	}
+
+	if c, ok := client.(interface {
+		RemoteAddr() net.Addr
+		LocalAddr() net.Addr
+	}); ok {
+		src, srcOK := c.RemoteAddr().(*net.TCPAddr)
+		local, localOK := c.LocalAddr().(*net.TCPAddr)
+		if srcOK && localOK {
+			h.Source, h.Destination = src, local
+		}
+	}
+
+	b, err := h.Format()
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(b); err != nil {
+		return errors.Wrap(err, "failed to write PROXY protocol header")
+	}
+	return nil
+}
+
+// tlsTLVs describes a TLS connection terminated by gowsoos: the server name,
+// the negotiated ALPN protocol, the TLS parameters and whether the client
+// presented a certificate that was verified
+func tlsTLVs(state *tls.ConnectionState) []proxyproto.TLV {
+	if state == nil {
+		return nil
+	}
+
+	var tlvs []proxyproto.TLV
+	if state.ServerName != "" {
+		tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.TLVTypeAuthority, Value: []byte(state.ServerName)})
+	}
+	if state.NegotiatedProtocol != "" {
+		tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.TLVTypeALPN, Value: []byte(state.NegotiatedProtocol)})
+	}
+
+	var client byte
+	if len(state.PeerCertificates) > 0 {
+		client = proxyproto.SSLClientCertSess
+		if !state.DidResume {
+			client |= proxyproto.SSLClientCertConn
+		}
+	}
+	verified := len(state.VerifiedChains) > 0
+	return append(tlvs, proxyproto.SSLTLV(client, verified, tlsVersionNames[state.Version], tls.CipherSuiteName(state.CipherSuite)))
+}
+
+// helloTLVs describes a TLS connection passed through untouched, only the
+// requested server name is known
+func helloTLVs(hello *ClientHello) []proxyproto.TLV {
+	if hello == nil || hello.ServerName == "" {
+		return nil
+	}
+	return []proxyproto.TLV{{Type: proxyproto.TLVTypeAuthority, Value: []byte(hello.ServerName)}}
+}
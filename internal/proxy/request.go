@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	maxRequestHeaderSize = 64 * 1024 // 64 KB for the whole request head
+	maxChainedRequests   = 4         // requests accepted in one injector payload
+)
+
+var (
+	errMalformedRequest = errors.New("malformed HTTP request")
+	errRequestTooLarge  = errors.New("HTTP request header too large")
+)
+
+// requestMethods lists the methods recognised at the start of a chained request
+var requestMethods = []string{
+	"GET", "POST", "PUT", "HEAD", "DELETE", "OPTIONS", "PATCH", "CONNECT", "TRACE",
+}
+
+// Request holds the parts of the client's upgrade request used by the proxy
+type Request struct {
+	Method string
+	Path   string
+	Proto  string
+	Host   string
+	Header http.Header
+}
+
+// ReadRequest reads a single HTTP/1.x request head from r.
+// Parsing is deliberately lenient so that hand-written injector payloads
+// (bare LF line endings, leading blank lines, junk header lines) are accepted.
+// Any bytes following the header terminator are left unread in r.
+func ReadRequest(r *bufio.Reader) (*Request, error) {
+	budget := maxRequestHeaderSize
+
+	// Skip empty lines preceding the request line
+	var line string
+	for {
+		l, err := readLine(r, &budget)
+		if err != nil {
+			return nil, err
+		}
+		if l != "" {
+			line = l
+			break
+		}
+	}
+
+	req, ok := parseRequestLine(line)
+	if !ok {
+		return nil, errors.Wrapf(errMalformedRequest, "invalid request line %q", truncate(line, 64))
+	}
+
+	var lastKey string
+	for {
+		l, err := readLine(r, &budget)
+		if err != nil {
+			return nil, err
+		}
+		if l == "" {
+			break
+		}
+
+		// Obsolete line folding continues the previous header
+		if (l[0] == ' ' || l[0] == '\t') && lastKey != "" {
+			values := req.Header[lastKey]
+			values[len(values)-1] += " " + strings.TrimSpace(l)
+			continue
+		}
+
+		colon := strings.IndexByte(l, ':')
+		if colon <= 0 {
+			continue
+		}
+		lastKey = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(l[:colon]))
+		req.Header[lastKey] = append(req.Header[lastKey], strings.TrimSpace(l[colon+1:]))
+	}
+
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	return req, nil
+}
+
+// readUpgradeRequest reads the client's request head, following injector
+// payloads that send several requests back to back ("[split]" payloads or
+// the X-Split header). The request carrying an Upgrade header is returned,
+// falling back to the last one read.
+func readUpgradeRequest(r *bufio.Reader) (*Request, error) {
+	req, err := ReadRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	chosen := req
+	for i := 1; i < maxChainedRequests; i++ {
+		if req.Header.Get("X-Split") == "" && !hasPendingRequest(r) {
+			break
+		}
+
+		req, err = ReadRequest(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read chained request")
+		}
+		if chosen.Header.Get("Upgrade") == "" || req.Header.Get("Upgrade") != "" {
+			chosen = req
+		}
+	}
+
+	return chosen, nil
+}
+
+// hasPendingRequest reports whether the bytes already buffered in r start
+// another HTTP request rather than tunnel payload
+func hasPendingRequest(r *bufio.Reader) bool {
+	buffered, _ := r.Peek(r.Buffered())
+	request, _ := startsRequest(buffered)
+	return request
+}
+
+// awaitRequest reads ahead until it can tell whether r starts another HTTP
+// request rather than tunnel payload, blocking until enough bytes arrive
+func awaitRequest(r *bufio.Reader) bool {
+	for n := 1; ; n++ {
+		if buffered := r.Buffered(); buffered > n {
+			n = buffered
+		}
+		b, err := r.Peek(n)
+		if request, decided := startsRequest(b); decided {
+			return request
+		}
+		if err != nil || n >= r.Size() {
+			return false
+		}
+	}
+}
+
+// startsRequest reports whether b starts an HTTP request line, and whether
+// b holds enough bytes to tell
+func startsRequest(b []byte) (request, decided bool) {
+	b = bytes.TrimLeft(b, "\r\n")
+	if len(b) == 0 {
+		return false, false
+	}
+
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		_, ok := parseRequestLine(strings.TrimRight(string(b[:i]), "\r"))
+		return ok, true
+	}
+
+	for _, method := range requestMethods {
+		prefix := []byte(method + " ")
+		if bytes.HasPrefix(b, prefix) {
+			return true, true
+		}
+		if len(b) < len(prefix) && bytes.HasPrefix(prefix, b) {
+			return false, false
+		}
+	}
+	return false, true
+}
+
+// requestErrorReason returns the metrics label of a request read failure
+func requestErrorReason(err error) string {
+	switch errors.Cause(err) {
+	case errMalformedRequest:
+		return "malformed"
+	case errRequestTooLarge:
+		return "too_large"
+	}
+	return "read_error"
+}
+
+// parseRequestLine parses "METHOD target HTTP/x.y"
+func parseRequestLine(line string) (*Request, bool) {
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/") {
+		return nil, false
+	}
+	for _, c := range parts[0] {
+		if c < 'A' || c > 'Z' {
+			return nil, false
+		}
+	}
+
+	req := &Request{
+		Method: parts[0],
+		Path:   parts[1],
+		Proto:  parts[2],
+		Header: make(http.Header),
+	}
+
+	switch {
+	case req.Method == "CONNECT":
+		// Authority form: CONNECT host:port HTTP/1.1
+		req.Host = req.Path
+	case strings.Contains(req.Path, "://"):
+		// Absolute form: GET ws://host/path HTTP/1.1
+		if u, err := url.Parse(req.Path); err == nil {
+			req.Host = u.Host
+			req.Path = u.RequestURI()
+		}
+	}
+
+	return req, true
+}
+
+// readLine reads one line terminated by LF or CRLF, charging it against budget
+func readLine(r *bufio.Reader, budget *int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		*budget -= len(chunk)
+		if *budget < 0 {
+			return "", errRequestTooLarge
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", errors.Wrap(err, "failed to read request")
+		}
+		break
+	}
+
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	return string(line), nil
+}
+
+// truncate shortens s for logging
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// bufferedConn replays bytes read ahead by the request parser before
+// reading from the underlying connection again
+type bufferedConn struct {
+	ProxyConnection
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if c.reader.Buffered() == 0 {
+		return c.ProxyConnection.Read(p)
+	}
+	return c.reader.Read(p)
+}
+
+// discardLateRequests drops request heads the client sends after the
+// handshake response and before its first tunnel bytes, such as the second
+// part of a [split] payload arriving in a later TCP segment. It blocks until
+// the client sends something and returns the number of requests dropped.
+func (c *bufferedConn) discardLateRequests() (int, error) {
+	for dropped := 0; dropped < maxChainedRequests; dropped++ {
+		if !awaitRequest(c.reader) {
+			return dropped, nil
+		}
+		if _, err := ReadRequest(c.reader); err != nil {
+			return dropped, errors.Wrap(err, "failed to read late request")
+		}
+	}
+	return maxChainedRequests, nil
+}
+
+// CloseWrite half-closes the underlying connection
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.ProxyConnection)
+}
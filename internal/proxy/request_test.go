@@ -0,0 +1,310 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/pkg/errors"
+)
+
+func TestReadRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		method string
+		path   string
+		host   string
+		header map[string]string
+		rest   string
+		err    error
+	}{
+		{
+			name:   "websocket upgrade",
+			input:  "GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\nSSH-2.0",
+			method: "GET",
+			path:   "/ws",
+			host:   "example.com",
+			header: map[string]string{"Upgrade": "websocket", "Connection": "Upgrade"},
+			rest:   "SSH-2.0",
+		},
+		{
+			name:   "bare line feeds and leading blank lines",
+			input:  "\r\n\nGET / HTTP/1.1\nHost: bug.host\n\n",
+			method: "GET",
+			path:   "/",
+			host:   "bug.host",
+		},
+		{
+			name:   "junk header lines are skipped",
+			input:  "GET / HTTP/1.1\r\n[crlf]\r\nX-Online-Host: bug.host\r\n: empty\r\n\r\n",
+			method: "GET",
+			path:   "/",
+			header: map[string]string{"X-Online-Host": "bug.host"},
+		},
+		{
+			name:   "folded header",
+			input:  "GET / HTTP/1.1\r\nX-Long: first\r\n\tsecond\r\n\r\n",
+			method: "GET",
+			path:   "/",
+			header: map[string]string{"X-Long": "first second"},
+		},
+		{
+			name:   "header keys are canonicalized",
+			input:  "GET / HTTP/1.1\r\nsec-websocket-key :  abc  \r\n\r\n",
+			method: "GET",
+			path:   "/",
+			header: map[string]string{"Sec-Websocket-Key": "abc"},
+		},
+		{
+			name:   "connect authority form",
+			input:  "CONNECT 127.0.0.1:22 HTTP/1.1\r\n\r\n",
+			method: "CONNECT",
+			path:   "127.0.0.1:22",
+			host:   "127.0.0.1:22",
+		},
+		{
+			name:   "absolute form",
+			input:  "GET ws://bug.host/path?a=b HTTP/1.1\r\n\r\n",
+			method: "GET",
+			path:   "/path?a=b",
+			host:   "bug.host",
+		},
+		{
+			name:   "host header overrides the target",
+			input:  "GET http://proxy.host/ HTTP/1.1\r\nHost: real.host\r\n\r\n",
+			method: "GET",
+			path:   "/",
+			host:   "real.host",
+		},
+		{
+			name:  "lower case method",
+			input: "get / HTTP/1.1\r\n\r\n",
+			err:   errMalformedRequest,
+		},
+		{
+			name:  "missing protocol",
+			input: "GET /\r\n\r\n",
+			err:   errMalformedRequest,
+		},
+		{
+			name:  "tunnel payload",
+			input: "SSH-2.0-OpenSSH_9.6\r\n",
+			err:   errMalformedRequest,
+		},
+		{
+			name:  "truncated head",
+			input: "GET / HTTP/1.1\r\nHost: a",
+			err:   io.EOF,
+		},
+		{
+			name:  "oversized head",
+			input: "GET / HTTP/1.1\r\nX-Pad: " + strings.Repeat("a", maxRequestHeaderSize) + "\r\n\r\n",
+			err:   errRequestTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+			req, err := ReadRequest(r)
+			if tt.err != nil {
+				if errors.Cause(err) != tt.err {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if req.Method != tt.method || req.Path != tt.path || req.Host != tt.host {
+				t.Errorf("got %s %s host %q, want %s %s host %q", req.Method, req.Path, req.Host, tt.method, tt.path, tt.host)
+			}
+			for key, value := range tt.header {
+				if got := req.Header.Get(key); got != value {
+					t.Errorf("header %s = %q, want %q", key, got, value)
+				}
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != tt.rest {
+				t.Errorf("left %q unread, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestReadUpgradeRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		path  string
+		rest  string
+		err   bool
+	}{
+		{
+			name:  "single request",
+			input: "GET /ws HTTP/1.1\r\nUpgrade: websocket\r\n\r\nSSH-2.0",
+			path:  "/ws",
+			rest:  "SSH-2.0",
+		},
+		{
+			name:  "split payload picks the upgrade",
+			input: "CONNECT bug.host:443 HTTP/1.1\r\n\r\nGET /ws HTTP/1.1\r\nUpgrade: websocket\r\n\r\nSSH-2.0",
+			path:  "/ws",
+			rest:  "SSH-2.0",
+		},
+		{
+			name:  "upgrade before a plain request is kept",
+			input: "GET /ws HTTP/1.1\r\nUpgrade: websocket\r\n\r\nGET /other HTTP/1.1\r\n\r\n",
+			path:  "/ws",
+		},
+		{
+			name:  "last request without any upgrade",
+			input: "GET /a HTTP/1.1\r\n\r\nGET /b HTTP/1.1\r\n\r\n",
+			path:  "/b",
+		},
+		{
+			name:  "x-split follows a request not yet buffered",
+			input: "GET /a HTTP/1.1\r\nX-Split: 1\r\n\r\n\r\nGET /ws HTTP/1.1\r\nUpgrade: websocket\r\n\r\n",
+			path:  "/ws",
+		},
+		{
+			name:  "chain is bounded",
+			input: strings.Repeat("GET /a HTTP/1.1\r\n\r\n", maxChainedRequests) + "GET /b HTTP/1.1\r\n\r\n",
+			path:  "/a",
+			rest:  "GET /b HTTP/1.1\r\n\r\n",
+		},
+		{
+			name:  "broken chained request",
+			input: "GET /a HTTP/1.1\r\nX-Split: 1\r\n\r\nnot a request\r\n\r\n",
+			err:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+			req, err := readUpgradeRequest(r)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if req.Path != tt.path {
+				t.Errorf("got request for %s, want %s", req.Path, tt.path)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != tt.rest {
+				t.Errorf("left %q unread, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestStartsRequest(t *testing.T) {
+	tests := []struct {
+		input   string
+		request bool
+		decided bool
+	}{
+		{"", false, false},
+		{"\r\n", false, false},
+		{"G", false, false},
+		{"GET", false, false},
+		{"GET ", true, true},
+		{"CONNECT host:443", true, true},
+		{"\r\nPOST / HTTP/1.1\r\n", true, true},
+		{"GET / HTTP/1.1\r\n", true, true},
+		{"GET nonsense\r\n", false, true},
+		{"SSH-2.0-OpenSSH\r\n", false, true},
+		{"SSH", false, true},
+		{"\x16\x03\x01", false, true},
+	}
+
+	for _, tt := range tests {
+		request, decided := startsRequest([]byte(tt.input))
+		if request != tt.request || decided != tt.decided {
+			t.Errorf("startsRequest(%q) = %v, %v, want %v, %v", tt.input, request, decided, tt.request, tt.decided)
+		}
+	}
+}
+
+func TestAwaitRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		request bool
+	}{
+		{"request", "GET / HTTP/1.1\r\n\r\n", true},
+		{"split method", "GE" + "T / HTTP/1.1\r\n\r\n", true},
+		{"tunnel payload", "SSH-2.0-OpenSSH\r\n", false},
+		{"short payload", "GE", false},
+		{"empty", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// One byte per read, as if every byte arrived in its own segment
+			r := bufio.NewReader(iotest.OneByteReader(strings.NewReader(tt.input)))
+			if got := awaitRequest(r); got != tt.request {
+				t.Errorf("got %v, want %v", got, tt.request)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != tt.input {
+				t.Errorf("consumed input, left %q", rest)
+			}
+		})
+	}
+}
+
+func TestDiscardLateRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		dropped int
+		rest    string
+	}{
+		{"no late request", "SSH-2.0-cli\r\n", 0, "SSH-2.0-cli\r\n"},
+		{"late connect", "CONNECT bug.host:443 HTTP/1.1\r\n\r\nSSH-2.0-cli\r\n", 1, "SSH-2.0-cli\r\n"},
+		{"two late requests", "GET / HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\n\r\nSSH", 2, "SSH"},
+		{"bounded", strings.Repeat("GET / HTTP/1.1\r\n\r\n", maxChainedRequests+1), maxChainedRequests, "GET / HTTP/1.1\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &bufferedConn{reader: bufio.NewReader(iotest.OneByteReader(strings.NewReader(tt.input)))}
+			dropped, err := conn.discardLateRequests()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dropped != tt.dropped {
+				t.Errorf("dropped %d requests, want %d", dropped, tt.dropped)
+			}
+			if rest, _ := io.ReadAll(conn.reader); string(rest) != tt.rest {
+				t.Errorf("left %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestRequestErrorReason(t *testing.T) {
+	tests := []struct {
+		err    error
+		reason string
+	}{
+		{errors.Wrap(errMalformedRequest, "invalid request line"), "malformed"},
+		{errRequestTooLarge, "too_large"},
+		{errors.Wrap(io.EOF, "failed to read request"), "read_error"},
+	}
+
+	for _, tt := range tests {
+		if got := requestErrorReason(tt.err); got != tt.reason {
+			t.Errorf("requestErrorReason(%v) = %q, want %q", tt.err, got, tt.reason)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+
+	"gowsoos/internal/config"
+)
+
+// defaultBackendName names the implicit backend built from dst_address
+const defaultBackendName = "default"
+
+// Backend is a named destination tunnels are forwarded to
+type Backend struct {
+	Name    string
+	Address string
+
+	// ProxyProtocol is the PROXY protocol version ("v1" or "v2") announced
+	// to the backend on connect, empty to send none
+	ProxyProtocol string
+}
+
+// route is a compiled routing rule
+type route struct {
+	match   string
+	header  string
+	value   string
+	backend *Backend
+}
+
+// Router picks the backend for a connection from its Host header, request
+// path, TLS server name or a custom header. Routes are evaluated in order and
+// the first match wins, connections matching no route use the default backend.
+type Router struct {
+	routes         []route
+	defaultBackend *Backend
+
+	// passthrough rules see only the ClientHello, a nil backend terminates locally
+	passthrough []route
+}
+
+// NewRouter compiles the routing table of a validated configuration
+func NewRouter(cfg *config.Config) *Router {
+	backends := make(map[string]*Backend, len(cfg.Backends))
+	for name, b := range cfg.Backends {
+		name = strings.ToLower(name)
+		backends[name] = &Backend{Name: name, Address: b.Address, ProxyProtocol: b.ProxyProtocol}
+	}
+
+	r := &Router{
+		defaultBackend: &Backend{
+			Name:          defaultBackendName,
+			Address:       cfg.DstAddress,
+			ProxyProtocol: cfg.DstProxyProtocol,
+		},
+	}
+	if cfg.DefaultBackend != "" {
+		r.defaultBackend = backends[strings.ToLower(cfg.DefaultBackend)]
+	}
+
+	for _, rc := range cfg.Routes {
+		r.routes = append(r.routes, route{
+			match:   rc.Match,
+			header:  rc.Header,
+			value:   rc.Value,
+			backend: backends[strings.ToLower(rc.Backend)],
+		})
+	}
+
+	for _, rc := range cfg.TLSPassthrough {
+		rt := route{match: rc.Match, value: rc.Value}
+		if !strings.EqualFold(rc.Backend, config.LocalBackend) {
+			rt.backend = backends[strings.ToLower(rc.Backend)]
+		}
+		r.passthrough = append(r.passthrough, rt)
+	}
+
+	return r
+}
+
+// Route returns the backend for a connection. req is nil for clients that
+// skip the HTTP upgrade (stunnel mode), sni is empty for plain connections.
+func (r *Router) Route(req *Request, sni string) *Backend {
+	for _, rt := range r.routes {
+		if rt.matches(req, sni) {
+			return rt.backend
+		}
+	}
+	return r.defaultBackend
+}
+
+// Passthrough returns the backend a TLS connection is passed through to
+// untouched, or nil if gowsoos terminates it. Connections matching no rule
+// are terminated locally.
+func (r *Router) Passthrough(hello *ClientHello) *Backend {
+	for _, rt := range r.passthrough {
+		if rt.matchesHello(hello) {
+			return rt.backend
+		}
+	}
+	return nil
+}
+
+// matchesHello reports whether a ClientHello satisfies a passthrough rule
+func (rt *route) matchesHello(hello *ClientHello) bool {
+	switch rt.match {
+	case "sni":
+		return matchHost(rt.value, hello.ServerName)
+	case "alpn":
+		for _, proto := range hello.Protocols {
+			if proto == rt.value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matches reports whether the connection satisfies the route
+func (rt *route) matches(req *Request, sni string) bool {
+	switch rt.match {
+	case "sni":
+		return sni != "" && matchHost(rt.value, sni)
+	case "host":
+		return req != nil && matchHost(rt.value, stripPort(req.Host))
+	case "path":
+		if req == nil {
+			return false
+		}
+		path := req.Path
+		if i := strings.IndexByte(path, '?'); i >= 0 {
+			path = path[:i]
+		}
+		return strings.HasPrefix(path, rt.value)
+	case "header":
+		return req != nil && matchHost(rt.value, stripPort(req.Header.Get(rt.header)))
+	}
+	return false
+}
+
+// matchHost compares a host name against a pattern, case-insensitively.
+// A leading "*." matches any single or nested subdomain, "*" matches anything.
+func matchHost(pattern, host string) bool {
+	if host == "" {
+		return false
+	}
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[1:]
+		return len(host) > len(suffix) && strings.EqualFold(host[len(host)-len(suffix):], suffix)
+	}
+	return strings.EqualFold(pattern, host)
+}
+
+// stripPort removes an optional port from a host[:port] value
+func stripPort(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return strings.Trim(hostport, "[]")
+	}
+	return host
+}
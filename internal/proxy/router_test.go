@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"gowsoos/internal/config"
+)
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"vpn.example.com", "vpn.example.com", true},
+		{"vpn.example.com", "VPN.Example.COM", true},
+		{"vpn.example.com", "www.example.com", false},
+		{"vpn.example.com", "", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "WWW.EXAMPLE.COM", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", ".example.com", false},
+		{"*.example.com", "badexample.com", false},
+		{"*", "anything.example", true},
+		{"*", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchHost(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("matchHost(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestStripPort(t *testing.T) {
+	tests := []struct {
+		hostport string
+		want     string
+	}{
+		{"vpn.example.com", "vpn.example.com"},
+		{"vpn.example.com:8443", "vpn.example.com"},
+		{"192.0.2.1:80", "192.0.2.1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := stripPort(tt.hostport); got != tt.want {
+			t.Errorf("stripPort(%q) = %q, want %q", tt.hostport, got, tt.want)
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	backends := map[string]config.BackendConfig{
+		"ssh":     {Address: "127.0.0.1:22"},
+		"OpenVPN": {Address: "127.0.0.1:1194"},
+		"api":     {Address: "127.0.0.1:8080"},
+		"tenant":  {Address: "127.0.0.1:9000"},
+		"mail":    {Address: "127.0.0.1:993"},
+	}
+	routes := []config.RouteConfig{
+		{Match: "host", Value: "ssh.example.com", Backend: "ssh"},
+		{Match: "host", Value: "*.vpn.example.com", Backend: "openvpn"},
+		{Match: "path", Value: "/api/", Backend: "api"},
+		{Match: "header", Header: "X-Tenant", Value: "*.tenants.example", Backend: "tenant"},
+		{Match: "sni", Value: "mail.example.com", Backend: "mail"},
+	}
+
+	request := func(host, path string, header ...string) *Request {
+		req := &Request{Method: "GET", Path: path, Host: host, Header: make(http.Header)}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		return req
+	}
+
+	tests := []struct {
+		name           string
+		defaultBackend string
+		req            *Request
+		sni            string
+		want           string
+	}{
+		{name: "host", req: request("ssh.example.com", "/"), want: "ssh"},
+		{name: "host with port", req: request("ssh.example.com:443", "/"), want: "ssh"},
+		{name: "host case", req: request("SSH.example.com", "/"), want: "ssh"},
+		{name: "wildcard host", req: request("de.vpn.example.com", "/"), want: "openvpn"},
+		{name: "wildcard host with port", req: request("de.vpn.example.com:8080", "/"), want: "openvpn"},
+		{name: "path prefix", req: request("www.example.com", "/api/v1"), want: "api"},
+		{name: "path ignores the query", req: request("www.example.com", "/ws?to=/api/"), want: defaultBackendName},
+		{name: "path is a prefix match", req: request("www.example.com", "/apiv2"), want: defaultBackendName},
+		{name: "header", req: request("www.example.com", "/", "X-Tenant", "acme.tenants.example"), want: "tenant"},
+		{name: "header with port", req: request("www.example.com", "/", "X-Tenant", "acme.tenants.example:1"), want: "tenant"},
+		{name: "header missing", req: request("www.example.com", "/", "X-Other", "acme.tenants.example"), want: defaultBackendName},
+		{name: "sni", req: request("www.example.com", "/"), sni: "mail.example.com", want: "mail"},
+		{name: "sni without upgrade request", sni: "mail.example.com", want: "mail"},
+		{name: "first match wins", req: request("ssh.example.com", "/api/"), sni: "mail.example.com", want: "ssh"},
+		{name: "no match", req: request("www.example.com", "/"), sni: "www.example.com", want: defaultBackendName},
+		{name: "no request and no sni", want: defaultBackendName},
+		{name: "named default backend", defaultBackend: "SSH", req: request("www.example.com", "/"), want: "ssh"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter(&config.Config{
+				DstAddress:     "127.0.0.1:2222",
+				DefaultBackend: tt.defaultBackend,
+				Backends:       backends,
+				Routes:         routes,
+			})
+			got := r.Route(tt.req, tt.sni)
+			if got == nil || got.Name != tt.want {
+				t.Fatalf("Route = %+v, want %s", got, tt.want)
+			}
+			if got.Name == defaultBackendName && got.Address != "127.0.0.1:2222" {
+				t.Errorf("default backend at %s, want dst_address", got.Address)
+			}
+		})
+	}
+}
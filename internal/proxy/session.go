@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session is a client connection tracked from accept until it is closed
+type Session struct {
+	// Bytes moved through the tunnel, seen from the client, first for alignment
+	uploaded   int64
+	downloaded int64
+
+	ID         uint64
+	ClientAddr string
+	Start      time.Time
+
+	mu      sync.Mutex
+	user    string // authenticated identity, if any
+	host    string
+	sni     string
+	backend string
+	client  ProxyConnection
+	dest    ProxyConnection
+	closed  bool
+}
+
+// attach records the connections of an established tunnel. If the session
+// was closed in the meantime they are closed straight away.
+func (s *Session) attach(client, dest ProxyConnection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.client = client
+	s.dest = dest
+	if s.closed {
+		client.Close()
+		dest.Close()
+	}
+}
+
+// setUser records the identity the client authenticated as
+func (s *Session) setUser(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.user = user
+}
+
+// setRoute records where the session is being tunneled to
+func (s *Session) setRoute(host, sni, backend string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.host, s.sni, s.backend = host, sni, backend
+}
+
+// count adds n bytes moved in one direction
+func (s *Session) count(upload bool, n int) {
+	if upload {
+		atomic.AddInt64(&s.uploaded, int64(n))
+	} else {
+		atomic.AddInt64(&s.downloaded, int64(n))
+	}
+}
+
+// SessionInfo describes a session for the admin API
+type SessionInfo struct {
+	ID            uint64    `json:"id"`
+	ClientAddr    string    `json:"client_addr"`
+	User          string    `json:"user,omitempty"`
+	Host          string    `json:"host,omitempty"`
+	SNI           string    `json:"sni,omitempty"`
+	Backend       string    `json:"backend,omitempty"`
+	UploadBytes   int64     `json:"upload_bytes"`
+	DownloadBytes int64     `json:"download_bytes"`
+	Start         time.Time `json:"start"`
+}
+
+// Info returns the current state of the session
+func (s *Session) Info() SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return SessionInfo{
+		ID:            s.ID,
+		ClientAddr:    s.ClientAddr,
+		User:          s.user,
+		Host:          s.host,
+		SNI:           s.sni,
+		Backend:       s.backend,
+		UploadBytes:   atomic.LoadInt64(&s.uploaded),
+		DownloadBytes: atomic.LoadInt64(&s.downloaded),
+		Start:         s.Start,
+	}
+}
+
+// identity returns the authenticated identity, or the client IP for
+// anonymous clients
+func (s *Session) identity() string {
+	s.mu.Lock()
+	user := s.user
+	s.mu.Unlock()
+
+	if user != "" {
+		return user
+	}
+	return s.ClientIP()
+}
+
+// ClientIP returns the IP part of ClientAddr
+func (s *Session) ClientIP() string {
+	host, _, err := net.SplitHostPort(s.ClientAddr)
+	if err != nil {
+		return s.ClientAddr
+	}
+	return host
+}
+
+// close force-closes the session. With notice set, framed clients are sent
+// a going-away close frame first if it can be written without waiting. The
+// connections are closed outside the lock so a stuck client cannot block
+// Info and the other accessors.
+func (s *Session) close(notice bool) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	client, dest := s.client, s.dest
+	s.mu.Unlock()
+
+	if ws, ok := client.(*wsConn); ok && notice {
+		ws.trySendClose(closeGoingAway, "server shutting down")
+	}
+	client.Close()
+	if dest != nil {
+		dest.Close()
+	}
+}
+
+// sessionRegistry tracks in-flight sessions so they can be drained on shutdown
+type sessionRegistry struct {
+	mu       sync.Mutex
+	nextID   uint64
+	sessions map[uint64]*Session
+	changed  chan struct{}
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions: make(map[uint64]*Session),
+		changed:  make(chan struct{}),
+	}
+}
+
+// add registers a new client connection
+func (r *sessionRegistry) add(conn ProxyConnection) *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	sess := &Session{
+		ID:         r.nextID,
+		ClientAddr: remoteAddr(conn),
+		Start:      time.Now(),
+		client:     conn,
+	}
+	r.sessions[sess.ID] = sess
+	return sess
+}
+
+// remove unregisters a finished session and wakes up Drain
+func (r *sessionRegistry) remove(sess *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.sessions, sess.ID)
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// count returns the number of in-flight sessions
+func (r *sessionRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+// wait blocks until no session is left or ctx is done
+func (r *sessionRegistry) wait(ctx context.Context) error {
+	for {
+		r.mu.Lock()
+		if len(r.sessions) == 0 {
+			r.mu.Unlock()
+			return nil
+		}
+		changed := r.changed
+		r.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// list returns the in-flight sessions match selects, ordered by ID
+func (r *sessionRegistry) list(match func(*Session) bool) []*Session {
+	r.mu.Lock()
+	sessions := make([]*Session, 0, len(r.sessions))
+	for _, sess := range r.sessions {
+		if match(sess) {
+			sessions = append(sessions, sess)
+		}
+	}
+	r.mu.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
+
+// closeAll force-closes every session and returns how many there were
+func (r *sessionRegistry) closeAll(notice bool) int {
+	return r.closeMatching(notice, func(*Session) bool { return true })
+}
+
+// closeMatching force-closes the sessions match selects and returns how many there were
+func (r *sessionRegistry) closeMatching(notice bool, match func(*Session) bool) int {
+	sessions := r.list(match)
+	for _, sess := range sessions {
+		sess.close(notice)
+	}
+	return len(sessions)
+}
+
+// remoteAddr returns the peer address of conn, if it has one
+func remoteAddr(conn ProxyConnection) string {
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return c.RemoteAddr().String()
+	}
+	return ""
+}
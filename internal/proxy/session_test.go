@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientConn is a script connection from a fixed client address
+type clientConn struct {
+	*scriptConn
+	addr string
+}
+
+func newClientConn(addr string) *clientConn {
+	return &clientConn{scriptConn: newScriptConn(), addr: addr}
+}
+
+func (c *clientConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return addr
+}
+
+// ids returns the IDs of sessions
+func ids(sessions []*Session) []uint64 {
+	var ids []uint64
+	for _, sess := range sessions {
+		ids = append(ids, sess.ID)
+	}
+	return ids
+}
+
+func TestSessionRegistry(t *testing.T) {
+	r := newSessionRegistry()
+
+	first := r.add(newClientConn("192.0.2.1:5000"))
+	second := r.add(newClientConn("192.0.2.2:5000"))
+	third := r.add(newClientConn("192.0.2.1:5001"))
+	if first.ID != 1 || second.ID != 2 || third.ID != 3 {
+		t.Fatalf("IDs %d, %d, %d, want 1, 2, 3", first.ID, second.ID, third.ID)
+	}
+	if first.ClientAddr != "192.0.2.1:5000" || first.ClientIP() != "192.0.2.1" {
+		t.Errorf("client %s (%s), want 192.0.2.1:5000", first.ClientAddr, first.ClientIP())
+	}
+	if n := r.count(); n != 3 {
+		t.Errorf("%d sessions, want 3", n)
+	}
+
+	all := ids(r.list(func(*Session) bool { return true }))
+	if len(all) != 3 || all[0] != 1 || all[1] != 2 || all[2] != 3 {
+		t.Errorf("listed %v, want [1 2 3]", all)
+	}
+
+	r.remove(second)
+	if n := r.count(); n != 2 {
+		t.Errorf("%d sessions after remove, want 2", n)
+	}
+	if fourth := r.add(newClientConn("192.0.2.3:5000")); fourth.ID != 4 {
+		t.Errorf("ID %d after remove, want 4", fourth.ID)
+	}
+}
+
+func TestSessionAttach(t *testing.T) {
+	t.Run("close after attach", func(t *testing.T) {
+		r := newSessionRegistry()
+		client, dest := newClientConn("192.0.2.1:5000"), newScriptConn()
+		sess := r.add(client)
+		sess.attach(client, dest)
+
+		sess.close(false)
+		if !client.closed || !dest.closed {
+			t.Errorf("client closed %v, backend closed %v, want both", client.closed, dest.closed)
+		}
+	})
+
+	t.Run("attach after close", func(t *testing.T) {
+		r := newSessionRegistry()
+		client, dest := newClientConn("192.0.2.1:5000"), newScriptConn()
+		sess := r.add(client)
+
+		// Closed while the backend was still being dialed
+		sess.close(false)
+		if !client.closed {
+			t.Error("client left open")
+		}
+		sess.attach(client, dest)
+		if !dest.closed {
+			t.Error("backend of a closed session left open")
+		}
+	})
+}
+
+func TestCloseMatching(t *testing.T) {
+	r := newSessionRegistry()
+	clients := []*clientConn{
+		newClientConn("192.0.2.1:5000"),
+		newClientConn("192.0.2.2:5000"),
+		newClientConn("192.0.2.1:5001"),
+	}
+	for _, c := range clients {
+		r.add(c)
+	}
+
+	fromFirst := func(sess *Session) bool { return sess.ClientIP() == "192.0.2.1" }
+	if n := r.closeMatching(false, fromFirst); n != 2 {
+		t.Errorf("closed %d sessions, want 2", n)
+	}
+	if !clients[0].closed || clients[1].closed || !clients[2].closed {
+		t.Errorf("closed %v, %v, %v, want only 192.0.2.1", clients[0].closed, clients[1].closed, clients[2].closed)
+	}
+
+	// Closing leaves removal to the session handlers
+	if n := r.count(); n != 3 {
+		t.Errorf("%d sessions, want 3 until the handlers finish", n)
+	}
+	if n := r.closeMatching(false, func(sess *Session) bool { return sess.ClientIP() == "192.0.2.9" }); n != 0 {
+		t.Errorf("closed %d sessions of an unknown client", n)
+	}
+	if n := r.closeAll(false); n != 3 || !clients[1].closed {
+		t.Errorf("closeAll closed %d, want 3", n)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	p := newBenchProxy()
+	if err := p.Drain(context.Background()); err != nil {
+		t.Fatalf("drain without sessions: %v", err)
+	}
+
+	sess := p.sessions.add(newClientConn("192.0.2.1:5000"))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("drain with a session left: %v, want the deadline", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- p.Drain(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	p.sessions.remove(sess)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("drain did not notice the last session ending")
+	}
+}
+
+func TestCloseSessionsNotice(t *testing.T) {
+	tests := []struct {
+		name   string
+		notice bool
+		code   int
+	}{
+		{name: "notice", notice: true, code: closeGoingAway},
+		{name: "no notice", notice: false, code: closeNormal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newBenchProxy()
+			framed := newClientConn("192.0.2.1:5000")
+			sess := p.sessions.add(framed)
+			sess.attach(newWebSocketConn(framed), newScriptConn())
+			raw := newClientConn("192.0.2.2:5000")
+			p.sessions.add(raw)
+
+			if n := p.CloseSessions(tt.notice); n != 2 {
+				t.Fatalf("closed %d sessions, want 2", n)
+			}
+			if !framed.closed || !raw.closed {
+				t.Fatal("sessions left open")
+			}
+
+			frames := serverFrames(t, framed.out.Bytes())
+			if len(frames) != 1 || frames[0].opcode != opClose || closeCode(frames[0].payload) != tt.code {
+				t.Errorf("got frames %v, want a single close with code %d", frames, tt.code)
+			}
+			if raw.out.Len() != 0 {
+				t.Errorf("raw client got % x", raw.out.Bytes())
+			}
+		})
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+// spliceSupported reports whether net.TCPConn.ReadFrom uses splice(2)
+const spliceSupported = false
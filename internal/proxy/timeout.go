@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Reasons for timeout-driven connection closes
+const (
+	reasonHandshakeTimeout   = "handshake_timeout"
+	reasonDialTimeout        = "dial_timeout"
+	reasonIdleTimeout        = "idle_timeout"
+	reasonMaxSessionDuration = "max_session_duration"
+)
+
+// activity records when a tunnel last moved data in either direction
+type activity struct {
+	last int64
+}
+
+func newActivity() *activity {
+	a := &activity{}
+	a.touch()
+	return a
+}
+
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+func (a *activity) lastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&a.last))
+}
+
+// watchSession closes both ends of a tunnel once it has been idle for longer
+// than idleTimeout or has been open for longer than maxDuration, zero
+// disabling either
+func (p *Proxy) watchSession(idleTimeout, maxDuration time.Duration, src, dst ProxyConnection, act *activity, done <-chan struct{}) {
+	if idleTimeout <= 0 && maxDuration <= 0 {
+		return
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		reason := ""
+		next := time.Duration(1<<63 - 1)
+
+		if maxDuration > 0 {
+			left := start.Add(maxDuration).Sub(now)
+			if left <= 0 {
+				reason = reasonMaxSessionDuration
+			}
+			next = left
+		}
+		if idleTimeout > 0 && reason == "" {
+			left := act.lastSeen().Add(idleTimeout).Sub(now)
+			if left <= 0 {
+				reason = reasonIdleTimeout
+			}
+			if left < next {
+				next = left
+			}
+		}
+
+		if reason != "" {
+			p.logger.Info("Connection closed",
+				"reason", reason,
+				"duration", now.Sub(start).Round(time.Second).String())
+			p.metrics.RecordTimeout(reason)
+			src.Close()
+			dst.Close()
+			return
+		}
+
+		timer.Reset(next)
+	}
+}
+
+// isTimeout reports whether err was caused by an expired deadline or dial timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// watchedTunnel is a tunnel whose ends are watched by watchSession
+type watchedTunnel struct {
+	client, backend net.Conn // peers of the watched ends
+	act             *activity
+	done            chan struct{}
+	returned        chan struct{}
+	start           time.Time
+}
+
+func watch(t *testing.T, idleTimeout, maxDuration time.Duration) *watchedTunnel {
+	t.Helper()
+	src, client := net.Pipe()
+	dst, backend := net.Pipe()
+	tun := &watchedTunnel{
+		client:   client,
+		backend:  backend,
+		act:      newActivity(),
+		done:     make(chan struct{}),
+		returned: make(chan struct{}),
+		start:    time.Now(),
+	}
+	t.Cleanup(func() {
+		for _, c := range []net.Conn{src, client, dst, backend} {
+			c.Close()
+		}
+	})
+
+	go func() {
+		newBenchProxy().watchSession(idleTimeout, maxDuration, src, dst, tun.act, tun.done)
+		close(tun.returned)
+	}()
+	return tun
+}
+
+// closedAfter waits up to limit for both ends to be closed and returns how
+// long after the start of the tunnel that happened
+func (tun *watchedTunnel) closedAfter(t *testing.T, limit time.Duration) time.Duration {
+	t.Helper()
+	select {
+	case <-tun.returned:
+	case <-time.After(limit):
+		t.Fatalf("tunnel still open after %s", limit)
+	}
+	elapsed := time.Since(tun.start)
+
+	for _, peer := range []net.Conn{tun.client, tun.backend} {
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := peer.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+			t.Errorf("end of the tunnel left open: %v", err)
+		}
+	}
+	return elapsed
+}
+
+// open reports whether the watcher is still running
+func (tun *watchedTunnel) open() bool {
+	select {
+	case <-tun.returned:
+		return false
+	default:
+		return true
+	}
+}
+
+func TestWatchSessionIdle(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	tun := watch(t, idle, 0)
+
+	// Traffic keeps the tunnel open well past the idle timeout
+	for i := 0; i < 6; i++ {
+		time.Sleep(idle / 4)
+		tun.act.touch()
+	}
+	if !tun.open() {
+		t.Fatal("active tunnel closed")
+	}
+
+	lastTraffic := time.Since(tun.start)
+	if elapsed := tun.closedAfter(t, time.Second) - lastTraffic; elapsed < idle {
+		t.Errorf("closed %s after the last traffic, want at least %s", elapsed, idle)
+	}
+}
+
+func TestWatchSessionMaxDuration(t *testing.T) {
+	const maxDuration = 150 * time.Millisecond
+	tun := watch(t, time.Minute, maxDuration)
+
+	// Traffic does not extend the session
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				tun.act.touch()
+			}
+		}
+	}()
+
+	if elapsed := tun.closedAfter(t, time.Second); elapsed < maxDuration {
+		t.Errorf("closed after %s, want at least %s", elapsed, maxDuration)
+	}
+}
+
+func TestWatchSessionIdleBeforeMax(t *testing.T) {
+	tun := watch(t, 50*time.Millisecond, time.Minute)
+	if elapsed := tun.closedAfter(t, time.Second); elapsed > 500*time.Millisecond {
+		t.Errorf("idle tunnel closed after %s", elapsed)
+	}
+}
+
+func TestWatchSessionDone(t *testing.T) {
+	tun := watch(t, 50*time.Millisecond, 100*time.Millisecond)
+	close(tun.done)
+	select {
+	case <-tun.returned:
+	case <-time.After(time.Second):
+		t.Fatal("watcher kept running after the tunnel finished")
+	}
+
+	// The tunnel finished on its own, so the watcher leaves it alone
+	time.Sleep(150 * time.Millisecond)
+	tun.client.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := tun.client.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Errorf("read %v, want the tunnel open", err)
+	}
+}
+
+func TestWatchSessionDisabled(t *testing.T) {
+	tun := watch(t, 0, 0)
+	select {
+	case <-tun.returned:
+	case <-time.After(time.Second):
+		t.Fatal("watcher running without timeouts")
+	}
+	tun.client.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := tun.client.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Errorf("read %v, want the tunnel open", err)
+	}
+}
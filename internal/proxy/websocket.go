@@ -0,0 +1,412 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	webSocketVersion   = "13"
+	legacyWebSocketKey = "Y2FmcnQ2NTRlY2Z2Z3ludTg="
+)
+
+// handshake is the response owed to the client once its upgrade request has been accepted
+type handshake struct {
+	accept     string
+	protocol   string
+	legacy     bool
+	customCode string
+}
+
+// handshakeError is a rejected upgrade request and the HTTP status to answer it with
+type handshakeError struct {
+	status  int
+	code    string // bounded reason for metrics, reason may quote the request
+	reason  string
+	headers []string
+}
+
+func (e *handshakeError) Error() string {
+	return fmt.Sprintf("websocket upgrade rejected: %s", e.reason)
+}
+
+// negotiateWebSocket validates an RFC 6455 upgrade request and computes the
+// handshake response for it, including the selected subprotocol
+func negotiateWebSocket(req *Request, protocols []string) (*handshake, error) {
+	if req.Method != http.MethodGet {
+		return nil, &handshakeError{status: http.StatusMethodNotAllowed, code: "method_not_allowed", reason: "method " + req.Method}
+	}
+	if !headerContainsToken(req.Header, "Upgrade", "websocket") {
+		return nil, &handshakeError{status: http.StatusBadRequest, code: "missing_upgrade", reason: "missing Upgrade: websocket"}
+	}
+	if !headerContainsToken(req.Header, "Connection", "upgrade") {
+		return nil, &handshakeError{status: http.StatusBadRequest, code: "missing_connection", reason: "missing Connection: Upgrade"}
+	}
+	if version := req.Header.Get("Sec-WebSocket-Version"); version != webSocketVersion {
+		return nil, &handshakeError{
+			status:  http.StatusUpgradeRequired,
+			code:    "unsupported_version",
+			reason:  fmt.Sprintf("unsupported Sec-WebSocket-Version %q", version),
+			headers: []string{"Sec-WebSocket-Version: " + webSocketVersion},
+		}
+	}
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, &handshakeError{status: http.StatusBadRequest, code: "invalid_key", reason: "invalid Sec-WebSocket-Key"}
+	}
+
+	return &handshake{
+		accept:   computeAcceptKey(key),
+		protocol: selectSubprotocol(req.Header, protocols),
+	}, nil
+}
+
+// computeAcceptKey derives Sec-WebSocket-Accept from the client's Sec-WebSocket-Key
+func computeAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + webSocketMagicString))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// selectSubprotocol picks the first protocol offered by the client that the server supports
+func selectSubprotocol(header http.Header, supported []string) string {
+	for _, offered := range headerTokens(header, "Sec-WebSocket-Protocol") {
+		for _, s := range supported {
+			if offered == s {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// headerContainsToken reports whether a comma separated header contains token, ignoring case
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, t := range headerTokens(header, name) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerTokens splits every value of a comma separated header into trimmed tokens
+func headerTokens(header http.Header, name string) []string {
+	var tokens []string
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+	return tokens
+}
+
+// WebSocket frame opcodes (RFC 6455 section 5.2)
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// WebSocket close status codes (RFC 6455 section 7.4.1)
+const (
+	closeNormal        = 1000
+	closeGoingAway     = 1001
+	closeProtocolError = 1002
+	closeNoStatus      = 1005
+)
+
+const maxControlPayload = 125
+
+// closeFrameTimeout bounds how long closing waits for a slow client to take
+// the close frame
+const closeFrameTimeout = time.Second
+
+var errWebSocketClosed = errors.New("websocket connection closed")
+
+// wsConn carries the tunnel inside RFC 6455 frames. Reads return the payload
+// of masked client data frames and answer control frames, writes are sent as
+// unmasked binary frames since tunnel data is not UTF-8 text.
+type wsConn struct {
+	ProxyConnection
+	reader *bufio.Reader
+
+	// Read state, only touched by the reading goroutine
+	remaining int64
+	mask      [4]byte
+	maskPos   int
+	fragment  bool
+	readErr   error
+
+	// Write state, shared between the copy goroutines
+	writeMu   sync.Mutex
+	writeBuf  []byte
+	closeSent bool
+}
+
+// newWebSocketConn wraps conn, which has completed the upgrade handshake, in a framer
+func newWebSocketConn(conn ProxyConnection) *wsConn {
+	return &wsConn{
+		ProxyConnection: conn,
+		reader:          bufio.NewReaderSize(conn, defaultRequestBufferSize),
+	}
+}
+
+// Read returns the next chunk of data frame payload
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+
+		if c.remaining > 0 {
+			if int64(len(p)) > c.remaining {
+				p = p[:c.remaining]
+			}
+			n, err := c.reader.Read(p)
+			c.unmask(p[:n])
+			c.remaining -= int64(n)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+
+		if err := c.readFrameHeader(); err != nil {
+			c.readErr = err
+		}
+	}
+}
+
+// readFrameHeader consumes the next frame header, handling control frames in place
+func (c *wsConn) readFrameHeader() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := int64(header[1] & 0x7F)
+
+	if header[0]&0x70 != 0 {
+		return c.protocolError("reserved bits set")
+	}
+	if !masked {
+		return c.protocolError("unmasked client frame")
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return err
+		}
+		if ext[0]&0x80 != 0 {
+			return c.protocolError("invalid payload length")
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+
+	if _, err := io.ReadFull(c.reader, c.mask[:]); err != nil {
+		return err
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case opText, opBinary:
+		if c.fragment {
+			return c.protocolError("new message inside fragmented message")
+		}
+		c.fragment = !fin
+	case opContinuation:
+		if !c.fragment {
+			return c.protocolError("unexpected continuation frame")
+		}
+		c.fragment = !fin
+	case opClose, opPing, opPong:
+		if !fin || length > maxControlPayload {
+			return c.protocolError("invalid control frame")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		return c.handleControl(opcode, payload)
+	default:
+		return c.protocolError(fmt.Sprintf("unknown opcode %#x", opcode))
+	}
+
+	c.remaining = length
+	return nil
+}
+
+// handleControl answers ping and close frames
+func (c *wsConn) handleControl(opcode byte, payload []byte) error {
+	switch opcode {
+	case opPing:
+		return c.writeFrame(opPong, payload)
+	case opClose:
+		code := closeNoStatus
+		switch {
+		case len(payload) == 1:
+			return c.protocolError("truncated close status")
+		case len(payload) >= 2:
+			code = int(binary.BigEndian.Uint16(payload))
+			if !validCloseCode(code) {
+				return c.protocolError(fmt.Sprintf("invalid close status %d", code))
+			}
+		}
+		// Echo the client's status code back, then report EOF to the reader
+		if code == closeNoStatus {
+			code = closeNormal
+		}
+		if err := c.sendClose(code, ""); err != nil && err != errWebSocketClosed {
+			return err
+		}
+		return io.EOF
+	}
+	return nil
+}
+
+// validCloseCode reports whether a client may send code in a close frame. Codes
+// below 1000, the reserved 1004-1006 and 1015, and unassigned ones are not.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// protocolError closes the WebSocket with status 1002 and returns the reason as an error
+func (c *wsConn) protocolError(reason string) error {
+	c.sendClose(closeProtocolError, reason)
+	return errors.Errorf("websocket protocol error: %s", reason)
+}
+
+// unmask applies the client masking key to payload bytes in place
+func (c *wsConn) unmask(b []byte) {
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+// Write sends p as a single data frame
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.writeFrameLocked(opBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame sends a single unmasked frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writeFrameLocked(opcode, payload)
+}
+
+func (c *wsConn) writeFrameLocked(opcode byte, payload []byte) error {
+	if c.closeSent {
+		return errWebSocketClosed
+	}
+
+	buf := append(c.writeBuf[:0], 0x80|opcode)
+	switch length := len(payload); {
+	case length <= 125:
+		buf = append(buf, byte(length))
+	case length <= 0xFFFF:
+		buf = append(buf, 126, byte(length>>8), byte(length))
+	default:
+		buf = append(buf, 127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(length))
+	}
+	buf = append(buf, payload...)
+	c.writeBuf = buf
+
+	if opcode == opClose {
+		c.closeSent = true
+	}
+
+	_, err := c.ProxyConnection.Write(buf)
+	return errors.Wrap(err, "failed to write websocket frame")
+}
+
+// sendClose sends a close frame with the given status code, once
+func (c *wsConn) sendClose(code int, reason string) error {
+	return c.writeFrame(opClose, closePayload(code, reason))
+}
+
+// closePayload builds the payload of a close frame
+func closePayload(code int, reason string) []byte {
+	if len(reason) > maxControlPayload-2 {
+		reason = reason[:maxControlPayload-2]
+	}
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return append(payload, reason...)
+}
+
+// CloseWrite starts the closing handshake, reads continue until the client's close frame
+func (c *wsConn) CloseWrite() error {
+	if err := c.sendClose(closeNormal, ""); err != nil && err != errWebSocketClosed {
+		return err
+	}
+	return nil
+}
+
+// Close sends a normal closure frame if none was sent yet and closes the
+// connection. It never waits for a write in progress, which may be stuck on
+// a client that stopped reading.
+func (c *wsConn) Close() error {
+	c.trySendClose(closeNormal, "")
+	return c.ProxyConnection.Close()
+}
+
+// trySendClose sends a close frame on a best-effort basis before the
+// connection is closed: it is skipped while another write is in progress,
+// and bounded by closeFrameTimeout otherwise
+func (c *wsConn) trySendClose(code int, reason string) {
+	if !c.writeMu.TryLock() {
+		return
+	}
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return
+	}
+	// The connection is about to be closed, so the read deadline can go too
+	c.ProxyConnection.SetDeadline(time.Now().Add(closeFrameTimeout))
+	c.writeFrameLocked(opClose, closePayload(code, reason))
+}
@@ -0,0 +1,408 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// scriptConn is a ProxyConnection reading a fixed client script and
+// recording everything written to it
+type scriptConn struct {
+	net.Conn
+	in     *bytes.Reader
+	out    bytes.Buffer
+	closed bool
+}
+
+func newScriptConn(frames ...[]byte) *scriptConn {
+	return &scriptConn{in: bytes.NewReader(bytes.Join(frames, nil))}
+}
+
+func (c *scriptConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *scriptConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+func (c *scriptConn) SetDeadline(time.Time) error { return nil }
+func (c *scriptConn) Close() error                { c.closed = true; return nil }
+
+// frame is a decoded WebSocket frame
+type frame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// encode builds a client frame masked with a fixed key, or unmasked when
+// mask is false
+func (f frame) encode(mask bool) []byte {
+	b := []byte{f.opcode}
+	if f.fin {
+		b[0] |= 0x80
+	}
+
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+	switch n := len(f.payload); {
+	case n <= 125:
+		b = append(b, maskBit|byte(n))
+	case n <= 0xFFFF:
+		b = append(b, maskBit|126, byte(n>>8), byte(n))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+
+	if !mask {
+		return append(b, f.payload...)
+	}
+	key := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	b = append(b, key[:]...)
+	for i, c := range f.payload {
+		b = append(b, c^key[i&3])
+	}
+	return b
+}
+
+func masked(fin bool, opcode byte, payload string) []byte {
+	return frame{fin: fin, opcode: opcode, payload: []byte(payload)}.encode(true)
+}
+
+func closeFrame(code int) []byte {
+	return frame{fin: true, opcode: opClose, payload: closePayload(code, "")}.encode(true)
+}
+
+// serverFrames decodes the unmasked frames written by the server
+func serverFrames(t *testing.T, b []byte) []frame {
+	t.Helper()
+
+	var frames []frame
+	for len(b) > 0 {
+		if len(b) < 2 || b[1]&0x80 != 0 {
+			t.Fatalf("invalid server frame % x", b)
+		}
+		f := frame{fin: b[0]&0x80 != 0, opcode: b[0] & 0x0F}
+		length := int(b[1] & 0x7F)
+		b = b[2:]
+		switch length {
+		case 126:
+			length, b = int(binary.BigEndian.Uint16(b)), b[2:]
+		case 127:
+			length, b = int(binary.BigEndian.Uint64(b)), b[8:]
+		}
+		f.payload = b[:length]
+		frames = append(frames, f)
+		b = b[length:]
+	}
+	return frames
+}
+
+// closeCode returns the status code of a close frame payload
+func closeCode(payload []byte) int {
+	if len(payload) < 2 {
+		return closeNoStatus
+	}
+	return int(binary.BigEndian.Uint16(payload))
+}
+
+func TestWebSocketRead(t *testing.T) {
+	long := strings.Repeat("0123456789", 7000)
+
+	tests := []struct {
+		name    string
+		frames  [][]byte
+		data    string
+		replies []frame
+		err     error // cause of the read error, nil for a protocol error
+	}{
+		{
+			name:    "binary message and close",
+			frames:  [][]byte{masked(true, opBinary, "SSH-2.0"), closeFrame(closeNormal)},
+			data:    "SSH-2.0",
+			replies: []frame{{true, opClose, closePayload(closeNormal, "")}},
+			err:     io.EOF,
+		},
+		{
+			name:    "text message",
+			frames:  [][]byte{masked(true, opText, "hello"), closeFrame(closeNormal)},
+			data:    "hello",
+			replies: []frame{{true, opClose, closePayload(closeNormal, "")}},
+			err:     io.EOF,
+		},
+		{
+			name:    "16 bit length",
+			frames:  [][]byte{masked(true, opBinary, long[:300]), closeFrame(closeNormal)},
+			data:    long[:300],
+			replies: []frame{{true, opClose, closePayload(closeNormal, "")}},
+			err:     io.EOF,
+		},
+		{
+			name:    "64 bit length",
+			frames:  [][]byte{masked(true, opBinary, long), closeFrame(closeNormal)},
+			data:    long,
+			replies: []frame{{true, opClose, closePayload(closeNormal, "")}},
+			err:     io.EOF,
+		},
+		{
+			name: "fragmented message",
+			frames: [][]byte{
+				masked(false, opBinary, "SSH"),
+				masked(false, opContinuation, "-2"),
+				masked(true, opContinuation, ".0"),
+				closeFrame(closeNormal),
+			},
+			data:    "SSH-2.0",
+			replies: []frame{{true, opClose, closePayload(closeNormal, "")}},
+			err:     io.EOF,
+		},
+		{
+			name: "ping inside a fragmented message",
+			frames: [][]byte{
+				masked(false, opBinary, "SSH"),
+				masked(true, opPing, "are you there"),
+				masked(true, opContinuation, "-2.0"),
+				masked(true, opPong, "ignored"),
+				closeFrame(closeNormal),
+			},
+			data: "SSH-2.0",
+			replies: []frame{
+				{true, opPong, []byte("are you there")},
+				{true, opClose, closePayload(closeNormal, "")},
+			},
+			err: io.EOF,
+		},
+		{
+			name:    "close status is echoed",
+			frames:  [][]byte{closeFrame(closeGoingAway)},
+			replies: []frame{{true, opClose, closePayload(closeGoingAway, "")}},
+			err:     io.EOF,
+		},
+		{
+			name:    "close without status",
+			frames:  [][]byte{masked(true, opClose, "")},
+			replies: []frame{{true, opClose, closePayload(closeNormal, "")}},
+			err:     io.EOF,
+		},
+		{
+			name:    "application close status",
+			frames:  [][]byte{closeFrame(4000)},
+			replies: []frame{{true, opClose, closePayload(4000, "")}},
+			err:     io.EOF,
+		},
+		{
+			name:    "truncated close status",
+			frames:  [][]byte{masked(true, opClose, "\x03")},
+			replies: []frame{{true, opClose, closePayload(closeProtocolError, "truncated close status")}},
+		},
+		{
+			name:    "close status below 1000",
+			frames:  [][]byte{closeFrame(999)},
+			replies: []frame{{true, opClose, closePayload(closeProtocolError, "invalid close status 999")}},
+		},
+		{
+			name:    "reserved close status",
+			frames:  [][]byte{closeFrame(1004)},
+			replies: []frame{{true, opClose, closePayload(closeProtocolError, "invalid close status 1004")}},
+		},
+		{
+			name:    "no status code sent as status",
+			frames:  [][]byte{closeFrame(closeNoStatus)},
+			replies: []frame{{true, opClose, closePayload(closeProtocolError, "invalid close status 1005")}},
+		},
+		{
+			name:    "abnormal closure sent as status",
+			frames:  [][]byte{closeFrame(1006)},
+			replies: []frame{{true, opClose, closePayload(closeProtocolError, "invalid close status 1006")}},
+		},
+		{
+			name:    "tls failure sent as status",
+			frames:  [][]byte{closeFrame(1015)},
+			replies: []frame{{true, opClose, closePayload(closeProtocolError, "invalid close status 1015")}},
+		},
+		{
+			name:    "unassigned close status",
+			frames:  [][]byte{closeFrame(2000)},
+			replies: []frame{{true, opClose, closePayload(closeProtocolError, "invalid close status 2000")}},
+		},
+		{
+			name:    "close status above 4999",
+			frames:  [][]byte{closeFrame(5000)},
+			replies: []frame{{true, opClose, closePayload(closeProtocolError, "invalid close status 5000")}},
+		},
+		{
+			name:    "unmasked frame",
+			frames:  [][]byte{frame{fin: true, opcode: opBinary, payload: []byte("x")}.encode(false)},
+			replies: []frame{{true, opClose, closePayload(closeProtocolError, "unmasked client frame")}},
+		},
+		{
+			name:    "reserved bits",
+			frames:  [][]byte{masked(true, 0x40|opBinary, "x")},
+			replies: []frame{{true, opClose, closePayload(closeProtocolError, "reserved bits set")}},
+		},
+		{
+			name:    "unknown opcode",
+			frames:  [][]byte{masked(true, 0x3, "x")},
+			replies: []frame{{true, opClose, closePayload(closeProtocolError, "unknown opcode 0x3")}},
+		},
+		{
+			name:    "continuation without a message",
+			frames:  [][]byte{masked(true, opContinuation, "x")},
+			replies: []frame{{true, opClose, closePayload(closeProtocolError, "unexpected continuation frame")}},
+		},
+		{
+			name:    "new message inside a fragmented message",
+			frames:  [][]byte{masked(false, opBinary, "a"), masked(true, opBinary, "b")},
+			data:    "a",
+			replies: []frame{{true, opClose, closePayload(closeProtocolError, "new message inside fragmented message")}},
+		},
+		{
+			name:    "fragmented control frame",
+			frames:  [][]byte{masked(false, opPing, "x")},
+			replies: []frame{{true, opClose, closePayload(closeProtocolError, "invalid control frame")}},
+		},
+		{
+			name:    "oversized control frame",
+			frames:  [][]byte{masked(true, opPing, long[:maxControlPayload+1])},
+			replies: []frame{{true, opClose, closePayload(closeProtocolError, "invalid control frame")}},
+		},
+		{
+			name:   "truncated payload",
+			frames: [][]byte{masked(true, opBinary, "SSH-2.0")[:6+3]},
+			data:   "SSH",
+			err:    io.ErrUnexpectedEOF,
+		},
+		{
+			name:   "truncated header",
+			frames: [][]byte{masked(true, opBinary, "SSH-2.0")[:4]},
+			err:    io.ErrUnexpectedEOF,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newScriptConn(tt.frames...)
+			ws := newWebSocketConn(conn)
+
+			var data []byte
+			buf := make([]byte, 4096)
+			var err error
+			for err == nil {
+				var n int
+				n, err = ws.Read(buf)
+				data = append(data, buf[:n]...)
+			}
+
+			if string(data) != tt.data {
+				t.Errorf("read %d bytes %.20q, want %d bytes %.20q", len(data), data, len(tt.data), tt.data)
+			}
+			if tt.err != nil && errors.Cause(err) != tt.err {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && !strings.Contains(err.Error(), "protocol error") {
+				t.Errorf("got error %v, want a protocol error", err)
+			}
+
+			replies := serverFrames(t, conn.out.Bytes())
+			if len(replies) != len(tt.replies) {
+				t.Fatalf("got %d replies, want %d", len(replies), len(tt.replies))
+			}
+			for i, r := range replies {
+				want := tt.replies[i]
+				if r.fin != want.fin || r.opcode != want.opcode || !bytes.Equal(r.payload, want.payload) {
+					t.Errorf("reply %d = %v %#x %q, want %v %#x %q", i, r.fin, r.opcode, r.payload, want.fin, want.opcode, want.payload)
+				}
+			}
+
+			if _, again := ws.Read(buf); again != err {
+				t.Errorf("read after error returned %v, want %v", again, err)
+			}
+		})
+	}
+}
+
+func TestWebSocketWrite(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		conn := newScriptConn()
+		ws := newWebSocketConn(conn)
+
+		payload := bytes.Repeat([]byte{0xFF}, size)
+		if n, err := ws.Write(payload); err != nil || n != size {
+			t.Fatalf("Write(%d bytes) = %d, %v", size, n, err)
+		}
+
+		frames := serverFrames(t, conn.out.Bytes())
+		if len(frames) != 1 {
+			t.Fatalf("%d bytes sent as %d frames", size, len(frames))
+		}
+		if f := frames[0]; !f.fin || f.opcode != opBinary || !bytes.Equal(f.payload, payload) {
+			t.Errorf("%d bytes sent as fin %v opcode %#x with %d bytes", size, f.fin, f.opcode, len(f.payload))
+		}
+	}
+}
+
+func TestWebSocketClose(t *testing.T) {
+	t.Run("close frame sent once", func(t *testing.T) {
+		conn := newScriptConn()
+		ws := newWebSocketConn(conn)
+
+		if err := ws.CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ws.Write([]byte("late")); err == nil {
+			t.Error("write after the close frame succeeded")
+		}
+		if err := ws.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		frames := serverFrames(t, conn.out.Bytes())
+		if len(frames) != 1 || frames[0].opcode != opClose || closeCode(frames[0].payload) != closeNormal {
+			t.Errorf("got frames %v, want a single normal closure", frames)
+		}
+		if !conn.closed {
+			t.Error("connection left open")
+		}
+	})
+
+	t.Run("close sends a close frame", func(t *testing.T) {
+		conn := newScriptConn()
+		ws := newWebSocketConn(conn)
+
+		ws.trySendClose(closeGoingAway, "server shutting down")
+		ws.Close()
+
+		frames := serverFrames(t, conn.out.Bytes())
+		if len(frames) != 1 || closeCode(frames[0].payload) != closeGoingAway {
+			t.Errorf("got frames %v, want a single going away closure", frames)
+		}
+	})
+
+	t.Run("close skips a stuck writer", func(t *testing.T) {
+		conn := newScriptConn()
+		ws := newWebSocketConn(conn)
+
+		// A write blocked on a client that stopped reading holds the lock
+		ws.writeMu.Lock()
+		defer ws.writeMu.Unlock()
+
+		done := make(chan struct{})
+		go func() {
+			ws.Close()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Close waited for the writer")
+		}
+		if conn.out.Len() != 0 {
+			t.Errorf("wrote %d bytes past the stuck writer", conn.out.Len())
+		}
+	})
+}
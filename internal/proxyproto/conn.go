@@ -0,0 +1,100 @@
+package proxyproto
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Conn is a connection whose addresses come from the PROXY protocol header
+// sent by the load balancer in front of it
+type Conn struct {
+	net.Conn
+	header *Header
+}
+
+// Accept reads the PROXY protocol header from a freshly accepted connection,
+// waiting at most timeout for it
+func Accept(conn net.Conn, timeout time.Duration) (*Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, errors.Wrap(err, "failed to set header deadline")
+	}
+	header, err := ReadHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, errors.Wrap(err, "failed to clear header deadline")
+	}
+	return &Conn{Conn: conn, header: header}, nil
+}
+
+// Header returns the PROXY protocol header the connection started with
+func (c *Conn) Header() *Header {
+	return c.header
+}
+
+// RemoteAddr returns the client address relayed by the load balancer
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client originally connected to
+func (c *Conn) LocalAddr() net.Addr {
+	if c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite half-closes the underlying connection. It fails, leaving the
+// connection open, when the underlying connection cannot be half-closed.
+func (c *Conn) CloseWrite() error {
+	cw, ok := c.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errors.New("connection does not support half-close")
+	}
+	return cw.CloseWrite()
+}
+
+// TrustList holds the networks allowed to send PROXY protocol headers
+type TrustList []*net.IPNet
+
+// ParseTrustList parses CIDRs and bare IP addresses
+func ParseTrustList(entries []string) (TrustList, error) {
+	list := make(TrustList, 0, len(entries))
+	for _, entry := range entries {
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.Errorf("invalid address or CIDR %q", entry)
+		}
+		list = append(list, ipNet)
+	}
+	return list, nil
+}
+
+// Contains reports whether addr may send a header. An empty list trusts nobody.
+func (t TrustList) Contains(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range t {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package proxyproto
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCloseWrite(t *testing.T) {
+	t.Run("half-close", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		server, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := &Conn{Conn: server}
+		defer conn.Close()
+
+		if err := conn.CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("client read %v, want EOF", err)
+		}
+
+		// The other direction keeps flowing
+		go client.Write([]byte("x"))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+			t.Errorf("read after half-close: %v", err)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer client.Close()
+		conn := &Conn{Conn: server}
+		defer conn.Close()
+
+		if err := conn.CloseWrite(); err == nil {
+			t.Fatal("half-closed a connection without CloseWrite")
+		}
+
+		// The connection is left open
+		go client.Write([]byte("x"))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+			t.Errorf("read after a failed half-close: %v", err)
+		}
+	})
+}
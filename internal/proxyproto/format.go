@@ -0,0 +1,124 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// Version 2 TLV types (section 2.2 of the spec)
+const (
+	TLVTypeALPN      = 0x01
+	TLVTypeAuthority = 0x02
+	TLVTypeSSL       = 0x20
+
+	TLVSubtypeSSLVersion = 0x21
+	TLVSubtypeSSLCipher  = 0x23
+
+	// sslClientSSL flags a client connected over SSL/TLS in the SSL TLV
+	sslClientSSL = 0x01
+
+	// Client flags of the SSL TLV for clients that presented a certificate,
+	// on this connection or earlier in the resumed TLS session
+	SSLClientCertConn = 0x02
+	SSLClientCertSess = 0x04
+)
+
+// SSLTLV builds the SSL TLV for a client that completed a TLS handshake.
+// client holds the SSLClientCert flags, verified reports whether the client
+// certificate was checked against a CA; verify is non-zero otherwise.
+func SSLTLV(client byte, verified bool, version, cipher string) TLV {
+	var b bytes.Buffer
+	b.WriteByte(sslClientSSL | client)
+	verify := uint32(1)
+	if verified {
+		verify = 0
+	}
+	binary.Write(&b, binary.BigEndian, verify)
+	writeTLV(&b, TLVSubtypeSSLVersion, []byte(version))
+	writeTLV(&b, TLVSubtypeSSLCipher, []byte(cipher))
+	return TLV{Type: TLVTypeSSL, Value: b.Bytes()}
+}
+
+// Format encodes the header in the wire format of its version. Addresses of
+// different families are both sent as IPv6, missing addresses are announced
+// as UNKNOWN (v1) or an unspecified family (v2). Local headers carry no
+// addresses and use the LOCAL command in v2. TLVs are only sent by v2.
+func (h *Header) Format() ([]byte, error) {
+	src, dst := h.Source, h.Destination
+	cmd := byte(v2CmdProxy)
+	if h.Local {
+		src, dst, cmd = nil, nil, v2CmdLocal
+	}
+	if src != nil && dst != nil && (src.IP.To4() == nil) != (dst.IP.To4() == nil) {
+		src = &net.TCPAddr{IP: src.IP.To16(), Port: src.Port}
+		dst = &net.TCPAddr{IP: dst.IP.To16(), Port: dst.Port}
+	}
+
+	switch h.Version {
+	case 1:
+		return formatV1(src, dst), nil
+	case 2:
+		return formatV2(cmd, src, dst, h.TLVs)
+	}
+	return nil, errors.Errorf("unsupported PROXY protocol version %d", h.Version)
+}
+
+func formatV1(src, dst *net.TCPAddr) []byte {
+	if src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	if srcIP, dstIP := src.IP.To4(), dst.IP.To4(); srcIP != nil && dstIP != nil {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, src.Port, dst.Port))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", v6String(src.IP), v6String(dst.IP), src.Port, dst.Port))
+}
+
+// v6String formats ip in IPv6 notation, net.IP would print IPv4-mapped
+// addresses in dotted form which TCP6 lines cannot carry
+func v6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func formatV2(cmd byte, src, dst *net.TCPAddr, tlvs []TLV) ([]byte, error) {
+	var addrs bytes.Buffer
+	famProto := byte(v2FamilyUnspec << 4)
+	if src != nil && dst != nil {
+		srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+		famProto = v2FamilyInet<<4 | v2ProtoStream
+		if srcIP == nil || dstIP == nil {
+			srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+			famProto = v2FamilyInet6<<4 | v2ProtoStream
+		}
+		addrs.Write(srcIP)
+		addrs.Write(dstIP)
+		binary.Write(&addrs, binary.BigEndian, uint16(src.Port))
+		binary.Write(&addrs, binary.BigEndian, uint16(dst.Port))
+	}
+	for _, tlv := range tlvs {
+		writeTLV(&addrs, tlv.Type, tlv.Value)
+	}
+	if addrs.Len() > 0xFFFF {
+		return nil, errors.New("PROXY protocol header too large")
+	}
+
+	b := make([]byte, 0, v2HeaderLength+addrs.Len())
+	b = append(b, v2Signature...)
+	b = append(b, 2<<4|cmd, famProto)
+	b = append(b, byte(addrs.Len()>>8), byte(addrs.Len()))
+	return append(b, addrs.Bytes()...), nil
+}
+
+func writeTLV(b *bytes.Buffer, typ byte, value []byte) {
+	b.WriteByte(typ)
+	b.WriteByte(byte(len(value) >> 8))
+	b.WriteByte(byte(len(value)))
+	b.Write(value)
+}
@@ -0,0 +1,157 @@
+package proxyproto
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func tcpAddr(ip string, port int) *net.TCPAddr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func TestFormatV1(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    *net.TCPAddr
+		dst    *net.TCPAddr
+		expect string
+	}{
+		{"tcp4", tcpAddr("192.0.2.1", 56324), tcpAddr("198.51.100.2", 443), "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n"},
+		{"tcp6", tcpAddr("2001:db8::1", 56324), tcpAddr("2001:db8::2", 443), "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"},
+		{"mapped ipv4", tcpAddr("::ffff:192.0.2.1", 56324), tcpAddr("::ffff:198.51.100.2", 443), "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n"},
+		{"mixed families", tcpAddr("192.0.2.1", 56324), tcpAddr("2001:db8::2", 443), "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 443\r\n"},
+		{"no addresses", nil, nil, "PROXY UNKNOWN\r\n"},
+		{"no destination", tcpAddr("192.0.2.1", 56324), nil, "PROXY UNKNOWN\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Header{Version: 1, Source: tt.src, Destination: tt.dst, TLVs: []TLV{{Type: TLVTypeAuthority, Value: []byte("ignored")}}}
+			b, err := h.Format()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.expect {
+				t.Fatalf("got %q, want %q", b, tt.expect)
+			}
+			if _, err := ReadHeader(bytes.NewReader(b)); err != nil {
+				t.Errorf("formatted header does not parse: %v", err)
+			}
+		})
+	}
+
+	t.Run("local", func(t *testing.T) {
+		h := &Header{Version: 1, Local: true, Source: tcpAddr("192.0.2.1", 56324), Destination: tcpAddr("198.51.100.2", 443)}
+		b, err := h.Format()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "PROXY UNKNOWN\r\n" {
+			t.Errorf("got %q, want an UNKNOWN header", b)
+		}
+	})
+}
+
+func TestFormatV2(t *testing.T) {
+	authority := TLV{Type: TLVTypeAuthority, Value: []byte("example.com")}
+
+	tests := []struct {
+		name   string
+		src    *net.TCPAddr
+		dst    *net.TCPAddr
+		tlvs   []TLV
+		expect []byte
+	}{
+		{"tcp4", tcpAddr("192.0.2.1", 56324), tcpAddr("198.51.100.2", 443), nil, v2(0x21, 0x11, inet4())},
+		{"tcp6", tcpAddr("2001:db8::1", 56324), tcpAddr("2001:db8::2", 443), nil, v2(0x21, 0x21, inet6())},
+		{"tlvs", tcpAddr("192.0.2.1", 56324), tcpAddr("198.51.100.2", 443), []TLV{authority}, v2(0x21, 0x11, inet4(), tlv(TLVTypeAuthority, "example.com"))},
+		{"no addresses", nil, nil, []TLV{authority}, v2(0x21, 0x00, tlv(TLVTypeAuthority, "example.com"))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := (&Header{Version: 2, Source: tt.src, Destination: tt.dst, TLVs: tt.tlvs}).Format()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, tt.expect) {
+				t.Errorf("got % x\nwant % x", b, tt.expect)
+			}
+		})
+	}
+
+	t.Run("local", func(t *testing.T) {
+		h := &Header{Version: 2, Local: true, Source: tcpAddr("192.0.2.1", 56324), Destination: tcpAddr("198.51.100.2", 443)}
+		b, err := h.Format()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := v2(0x20, 0x00); !bytes.Equal(b, want) {
+			t.Errorf("got % x\nwant % x", b, want)
+		}
+		parsed, err := ReadHeader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !parsed.Local || parsed.Source != nil || parsed.Destination != nil {
+			t.Errorf("parsed %+v, want a local header without addresses", parsed)
+		}
+	})
+
+	t.Run("mixed families round trip", func(t *testing.T) {
+		h := &Header{Version: 2, Source: tcpAddr("192.0.2.1", 56324), Destination: tcpAddr("2001:db8::2", 443)}
+		b, err := h.Format()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ReadHeader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !parsed.Source.IP.Equal(h.Source.IP) || parsed.Source.Port != 56324 || !parsed.Destination.IP.Equal(h.Destination.IP) {
+			t.Errorf("got %s to %s", parsed.Source, parsed.Destination)
+		}
+	})
+
+	t.Run("oversized", func(t *testing.T) {
+		h := &Header{Version: 2, TLVs: []TLV{{Type: 0xEE, Value: make([]byte, 0xFFFF)}}}
+		if _, err := h.Format(); err == nil {
+			t.Error("formatted a header larger than 64 KB")
+		}
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		if _, err := (&Header{Version: 3}).Format(); err == nil {
+			t.Error("formatted a version 3 header")
+		}
+	})
+}
+
+func TestSSLTLV(t *testing.T) {
+	tests := []struct {
+		name     string
+		client   byte
+		verified bool
+		expect   []byte
+	}{
+		{"no client certificate", 0, false, []byte{0x01, 0, 0, 0, 1}},
+		{"verified certificate", SSLClientCertConn | SSLClientCertSess, true, []byte{0x07, 0, 0, 0, 0}},
+		{"resumed session", SSLClientCertSess, true, []byte{0x05, 0, 0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SSLTLV(tt.client, tt.verified, "TLSv1.3", "TLS_AES_128_GCM_SHA256")
+			if got.Type != TLVTypeSSL {
+				t.Errorf("type %#x, want %#x", got.Type, TLVTypeSSL)
+			}
+
+			expect := append(tt.expect, tlv(TLVSubtypeSSLVersion, "TLSv1.3")...)
+			expect = append(expect, tlv(TLVSubtypeSSLCipher, "TLS_AES_128_GCM_SHA256")...)
+			if !bytes.Equal(got.Value, expect) {
+				t.Errorf("got % x\nwant % x", got.Value, expect)
+			}
+		})
+	}
+}
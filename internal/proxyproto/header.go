@@ -0,0 +1,218 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107 // including the CRLF, see section 2.1 of the spec
+	v1MinLength = 15  // "PROXY UNKNOWN\r\n"
+
+	v2HeaderLength = 16
+)
+
+// v2Signature starts every binary (version 2) header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Version 2 commands, address families and transport protocols
+const (
+	v2CmdLocal = 0x0
+	v2CmdProxy = 0x1
+
+	v2FamilyUnspec = 0x0
+	v2FamilyInet   = 0x1
+	v2FamilyInet6  = 0x2
+	v2FamilyUnix   = 0x3
+
+	v2ProtoStream = 0x1
+)
+
+var (
+	// ErrNoHeader is returned when a connection does not start with a PROXY header
+	ErrNoHeader = errors.New("missing PROXY protocol header")
+
+	errInvalidHeader = errors.New("invalid PROXY protocol header")
+)
+
+// TLV is a type-length-value extension carried by a version 2 header
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header is a parsed PROXY protocol header. Source and Destination are nil
+// when the sender did not relay addresses (v1 UNKNOWN, v2 LOCAL or a
+// non-TCP family); the connection's own addresses apply then.
+type Header struct {
+	Version     int
+	Local       bool // the sender's own connection, such as a health check (v2 LOCAL)
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+	TLVs        []TLV
+}
+
+// ReadHeader reads a version 1 or 2 header from r. It never reads past the
+// end of the header, so r can be used for the payload afterwards.
+func ReadHeader(r io.Reader) (*Header, error) {
+	buf := make([]byte, v1MinLength, v1MaxLength)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, errors.Wrap(err, "failed to read PROXY protocol header")
+	}
+
+	switch {
+	case bytes.HasPrefix(buf, v2Signature):
+		return readV2(r, buf)
+	case bytes.HasPrefix(buf, []byte(v1Prefix)):
+		return readV1(r, buf)
+	}
+	return nil, ErrNoHeader
+}
+
+// readV1 reads the rest of a text header line and parses it
+func readV1(r io.Reader, buf []byte) (*Header, error) {
+	b := make([]byte, 1)
+	for buf[len(buf)-1] != '\n' {
+		if len(buf) == v1MaxLength {
+			return nil, errors.Wrap(errInvalidHeader, "v1 header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, errors.Wrap(err, "failed to read PROXY protocol header")
+		}
+		buf = append(buf, b[0])
+	}
+
+	line := string(buf)
+	if !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.Wrap(errInvalidHeader, "v1 header not terminated by CRLF")
+	}
+	fields := strings.Split(strings.TrimSuffix(line, "\r\n"), " ")
+
+	h := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 {
+		return nil, errors.Wrapf(errInvalidHeader, "v1 header has %d fields", len(fields))
+	}
+
+	var family int
+	switch fields[1] {
+	case "TCP4":
+		family = 4
+	case "TCP6":
+		family = 6
+	default:
+		return nil, errors.Wrapf(errInvalidHeader, "unsupported v1 protocol %q", fields[1])
+	}
+
+	var err error
+	if h.Source, err = parseV1Addr(fields[2], fields[4], family); err != nil {
+		return nil, err
+	}
+	if h.Destination, err = parseV1Addr(fields[3], fields[5], family); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func parseV1Addr(host, port string, family int) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (family == 6) != strings.Contains(host, ":") {
+		return nil, errors.Wrapf(errInvalidHeader, "invalid v1 address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, errors.Wrapf(errInvalidHeader, "invalid v1 port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readV2 reads the rest of a binary header and parses it
+func readV2(r io.Reader, buf []byte) (*Header, error) {
+	buf = buf[:v2HeaderLength]
+	if _, err := io.ReadFull(r, buf[v1MinLength:]); err != nil {
+		return nil, errors.Wrap(err, "failed to read PROXY protocol header")
+	}
+
+	verCmd, famProto := buf[12], buf[13]
+	if verCmd>>4 != 2 {
+		return nil, errors.Wrapf(errInvalidHeader, "unsupported v2 version %d", verCmd>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(buf[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errors.Wrap(err, "failed to read PROXY protocol addresses")
+	}
+
+	h := &Header{Version: 2}
+	switch verCmd & 0xF {
+	case v2CmdLocal:
+		// Health checks from the balancer itself, addresses are ignored
+		h.Local = true
+		return h, nil
+	case v2CmdProxy:
+	default:
+		return nil, errors.Wrapf(errInvalidHeader, "unsupported v2 command %d", verCmd&0xF)
+	}
+
+	var addrLen int
+	switch famProto >> 4 {
+	case v2FamilyInet:
+		addrLen = 2*net.IPv4len + 4
+	case v2FamilyInet6:
+		addrLen = 2*net.IPv6len + 4
+	case v2FamilyUnix:
+		addrLen = 216
+	case v2FamilyUnspec:
+		addrLen = 0
+	default:
+		return nil, errors.Wrapf(errInvalidHeader, "unsupported v2 address family %d", famProto>>4)
+	}
+	if len(payload) < addrLen {
+		return nil, errors.Wrap(errInvalidHeader, "v2 address block too short")
+	}
+
+	if famProto&0xF == v2ProtoStream && (famProto>>4 == v2FamilyInet || famProto>>4 == v2FamilyInet6) {
+		ipLen := (addrLen - 4) / 2
+		h.Source = &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), payload[:ipLen]...)),
+			Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+		}
+		h.Destination = &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), payload[ipLen:2*ipLen]...)),
+			Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+		}
+	}
+
+	tlvs, err := parseTLVs(payload[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	h.TLVs = tlvs
+	return h, nil
+}
+
+// parseTLVs splits the extension block following the addresses
+func parseTLVs(b []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, errors.Wrap(errInvalidHeader, "truncated v2 TLV")
+		}
+		length := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+length {
+			return nil, errors.Wrap(errInvalidHeader, "truncated v2 TLV value")
+		}
+		tlvs = append(tlvs, TLV{Type: b[0], Value: b[3 : 3+length]})
+		b = b[3+length:]
+	}
+	return tlvs, nil
+}
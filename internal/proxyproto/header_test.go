@@ -0,0 +1,319 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// v2 builds a binary header around an address and TLV block
+func v2(verCmd, famProto byte, block ...[]byte) []byte {
+	payload := bytes.Join(block, nil)
+	b := append([]byte(nil), v2Signature...)
+	b = append(b, verCmd, famProto)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	return append(b, payload...)
+}
+
+// inet4 is the address block of 192.0.2.1:56324 to 198.51.100.2:443
+func inet4() []byte {
+	return []byte{192, 0, 2, 1, 198, 51, 100, 2, 0xDC, 0x04, 0x01, 0xBB}
+}
+
+// inet6 is the address block of [2001:db8::1]:56324 to [2001:db8::2]:443
+func inet6() []byte {
+	b := append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...)
+	return append(b, 0xDC, 0x04, 0x01, 0xBB)
+}
+
+func tlv(typ byte, value string) []byte {
+	var b bytes.Buffer
+	writeTLV(&b, typ, []byte(value))
+	return b.Bytes()
+}
+
+func TestReadHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		version int
+		src     string
+		dst     string
+		tlvs    []TLV
+		err     error // cause of the error
+	}{
+		// Version 1
+		{
+			name:    "v1 tcp4",
+			input:   []byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n"),
+			version: 1,
+			src:     "192.0.2.1:56324",
+			dst:     "198.51.100.2:443",
+		},
+		{
+			name:    "v1 tcp6",
+			input:   []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"),
+			version: 1,
+			src:     "[2001:db8::1]:56324",
+			dst:     "[2001:db8::2]:443",
+		},
+		{
+			name:    "v1 unknown",
+			input:   []byte("PROXY UNKNOWN\r\n"),
+			version: 1,
+		},
+		{
+			name:    "v1 unknown with addresses",
+			input:   []byte("PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"),
+			version: 1,
+		},
+		{
+			name:    "v1 longest header",
+			input:   []byte("PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n"),
+			version: 1,
+			src:     "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535",
+			dst:     "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535",
+		},
+		{
+			name:  "v1 oversized",
+			input: []byte("PROXY UNKNOWN " + strings.Repeat("f", v1MaxLength) + "\r\n"),
+			err:   errInvalidHeader,
+		},
+		{
+			name:  "v1 bare line feed",
+			input: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\n"),
+			err:   errInvalidHeader,
+		},
+		{
+			name:  "v1 missing ports",
+			input: []byte("PROXY TCP4 192.0.2.1 198.51.100.2\r\n"),
+			err:   errInvalidHeader,
+		},
+		{
+			name:  "v1 unsupported protocol",
+			input: []byte("PROXY UDP4 192.0.2.1 198.51.100.2 56324 443\r\n"),
+			err:   errInvalidHeader,
+		},
+		{
+			name:  "v1 family mismatch",
+			input: []byte("PROXY TCP6 192.0.2.1 198.51.100.2 56324 443\r\n"),
+			err:   errInvalidHeader,
+		},
+		{
+			name:  "v1 invalid address",
+			input: []byte("PROXY TCP4 192.0.2 198.51.100.2 56324 443\r\n"),
+			err:   errInvalidHeader,
+		},
+		{
+			name:  "v1 port with leading zero",
+			input: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 056324 443\r\n"),
+			err:   errInvalidHeader,
+		},
+		{
+			name:  "v1 port out of range",
+			input: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 65536 443\r\n"),
+			err:   errInvalidHeader,
+		},
+		{
+			name:  "v1 truncated",
+			input: []byte("PROXY TCP4 192.0.2.1 198.51"),
+			err:   io.EOF,
+		},
+		{
+			name:  "shorter than any header",
+			input: []byte("PROXY TCP4"),
+			err:   io.ErrUnexpectedEOF,
+		},
+
+		// Version 2
+		{
+			name:    "v2 tcp4",
+			input:   v2(0x21, 0x11, inet4()),
+			version: 2,
+			src:     "192.0.2.1:56324",
+			dst:     "198.51.100.2:443",
+		},
+		{
+			name:    "v2 tcp6",
+			input:   v2(0x21, 0x21, inet6()),
+			version: 2,
+			src:     "[2001:db8::1]:56324",
+			dst:     "[2001:db8::2]:443",
+		},
+		{
+			name:    "v2 local",
+			input:   v2(0x20, 0x11, inet4()),
+			version: 2,
+		},
+		{
+			name:    "v2 unspecified family",
+			input:   v2(0x21, 0x00),
+			version: 2,
+		},
+		{
+			name:    "v2 udp addresses are ignored",
+			input:   v2(0x21, 0x12, inet4(), tlv(TLVTypeAuthority, "example.com")),
+			version: 2,
+			tlvs:    []TLV{{Type: TLVTypeAuthority, Value: []byte("example.com")}},
+		},
+		{
+			name:    "v2 unix addresses are ignored",
+			input:   v2(0x21, 0x31, make([]byte, 216)),
+			version: 2,
+		},
+		{
+			name:    "v2 tlvs",
+			input:   v2(0x21, 0x11, inet4(), tlv(TLVTypeAuthority, "example.com"), tlv(TLVTypeALPN, "h2"), tlv(0xE0, "")),
+			version: 2,
+			src:     "192.0.2.1:56324",
+			dst:     "198.51.100.2:443",
+			tlvs: []TLV{
+				{Type: TLVTypeAuthority, Value: []byte("example.com")},
+				{Type: TLVTypeALPN, Value: []byte("h2")},
+				{Type: 0xE0, Value: []byte{}},
+			},
+		},
+		{
+			name:    "v2 largest header",
+			input:   v2(0x21, 0x11, inet4(), tlv(0xEE, strings.Repeat("x", 0xFFFF-12-3))),
+			version: 2,
+			src:     "192.0.2.1:56324",
+			dst:     "198.51.100.2:443",
+			tlvs:    []TLV{{Type: 0xEE, Value: []byte(strings.Repeat("x", 0xFFFF-12-3))}},
+		},
+		{
+			name:  "v2 truncated tlv",
+			input: v2(0x21, 0x11, inet4(), []byte{TLVTypeALPN, 0}),
+			err:   errInvalidHeader,
+		},
+		{
+			name:  "v2 tlv longer than the header",
+			input: v2(0x21, 0x11, inet4(), []byte{TLVTypeALPN, 0, 3, 'h', '2'}),
+			err:   errInvalidHeader,
+		},
+		{
+			name:  "v2 short address block",
+			input: v2(0x21, 0x21, inet4()),
+			err:   errInvalidHeader,
+		},
+		{
+			name:  "v2 unsupported version",
+			input: v2(0x31, 0x11, inet4()),
+			err:   errInvalidHeader,
+		},
+		{
+			name:  "v2 unsupported command",
+			input: v2(0x22, 0x11, inet4()),
+			err:   errInvalidHeader,
+		},
+		{
+			name:  "v2 unsupported family",
+			input: v2(0x21, 0x41, inet4()),
+			err:   errInvalidHeader,
+		},
+		{
+			name:  "v2 truncated addresses",
+			input: v2(0x21, 0x11, inet4())[:v2HeaderLength+6],
+			err:   io.ErrUnexpectedEOF,
+		},
+		{
+			name:  "v2 truncated fixed header",
+			input: v2(0x21, 0x11, inet4())[:v1MinLength],
+			err:   io.EOF,
+		},
+
+		{
+			name:  "no header",
+			input: []byte("SSH-2.0-OpenSSH_9.6\r\n"),
+			err:   ErrNoHeader,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const payload = "SSH-2.0-OpenSSH_9.6\r\n"
+			r := bytes.NewReader(append(tt.input, payload...))
+			if tt.err != nil {
+				r = bytes.NewReader(tt.input)
+			}
+
+			h, err := ReadHeader(r)
+			if tt.err != nil {
+				if errors.Cause(err) != tt.err {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if h.Version != tt.version {
+				t.Errorf("version %d, want %d", h.Version, tt.version)
+			}
+			if got := addrString(h.Source); got != tt.src {
+				t.Errorf("source %s, want %s", got, tt.src)
+			}
+			if got := addrString(h.Destination); got != tt.dst {
+				t.Errorf("destination %s, want %s", got, tt.dst)
+			}
+			if len(h.TLVs) != len(tt.tlvs) {
+				t.Fatalf("got %d TLVs, want %d", len(h.TLVs), len(tt.tlvs))
+			}
+			for i, got := range h.TLVs {
+				if got.Type != tt.tlvs[i].Type || !bytes.Equal(got.Value, tt.tlvs[i].Value) {
+					t.Errorf("TLV %d = %#x %.20q, want %#x %.20q", i, got.Type, got.Value, tt.tlvs[i].Type, tt.tlvs[i].Value)
+				}
+			}
+
+			if rest, _ := io.ReadAll(r); string(rest) != payload {
+				t.Errorf("payload after the header = %q, want %q", rest, payload)
+			}
+		})
+	}
+}
+
+func addrString(addr *net.TCPAddr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestTrustList(t *testing.T) {
+	list, err := ParseTrustList([]string{"10.0.0.0/8", "192.0.2.10", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		list    TrustList
+		addr    net.Addr
+		trusted bool
+	}{
+		{list, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}, true},
+		{list, &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 1}, true},
+		{list, &net.TCPAddr{IP: net.ParseIP("192.0.2.11"), Port: 1}, false},
+		{list, &net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 1}, true},
+		{list, &net.TCPAddr{IP: net.ParseIP("2001:db8::5"), Port: 1}, true},
+		{list, &net.UnixAddr{Name: "/run/balancer.sock", Net: "unix"}, false},
+		{nil, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.list.Contains(tt.addr); got != tt.trusted {
+			t.Errorf("Contains(%s) with %d entries = %v, want %v", tt.addr, len(tt.list), got, tt.trusted)
+		}
+	}
+
+	for _, entry := range []string{"10.0.0.0/33", "balancer", ""} {
+		if _, err := ParseTrustList([]string{entry}); err == nil {
+			t.Errorf("ParseTrustList(%q) succeeded", entry)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// upgradeEnv lists the names of the files passed to an upgraded process,
+	// in order, starting at file descriptor 3
+	upgradeEnv = "GOWSOOS_UPGRADE_FDS"
+
+	// upgradeReadyName is the pipe the new process writes to once it accepts connections
+	upgradeReadyName = "ready"
+
+	// upgradeTimeout bounds how long the old process waits for the new one to start
+	upgradeTimeout = 30 * time.Second
+)
+
+// newFile wraps an inherited descriptor, tests replace it to avoid touching
+// descriptors the test binary did not inherit
+var newFile = os.NewFile
+
+// inheritedFiles returns the files handed over by a parent process during a
+// binary upgrade, keyed by name
+func inheritedFiles() map[string]*os.File {
+	names := os.Getenv(upgradeEnv)
+	if names == "" {
+		return nil
+	}
+	os.Unsetenv(upgradeEnv)
+
+	files := make(map[string]*os.File)
+	for i, name := range strings.Split(names, ",") {
+		files[name] = newFile(uintptr(3+i), name)
+	}
+	return files
+}
+
+// listen returns the socket-activated listener named name, or the one
+// inherited from an upgrade if it is bound to addr, otherwise it opens a new
+// one. Listeners are remembered for Upgrade.
+func (s *Server) listen(name, addr string) (*net.TCPListener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to resolve TCP address")
+	}
+
+	// The socket unit decides the address of activated sockets
+	if f, ok := s.activated[name]; ok {
+		delete(s.activated, name)
+		listener, err := fileListener(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to use socket-activated %s listener", name)
+		}
+		s.logger.Info("Using socket-activated listener", "name", name, "address", listener.Addr().String())
+		s.listeners[name] = listener
+		return listener, nil
+	}
+
+	if f, ok := s.inherited[name]; ok {
+		delete(s.inherited, name)
+		listener, err := fileListener(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to use inherited %s listener", name)
+		}
+		if sameAddr(listener.Addr().(*net.TCPAddr), tcpAddr) {
+			s.logger.Info("Using inherited listener", "name", name, "address", addr)
+			s.listeners[name] = listener
+			return listener, nil
+		}
+		// The address changed with the upgrade, let the old socket go
+		listener.Close()
+	}
+
+	listener, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+	s.listeners[name] = listener
+	return listener, nil
+}
+
+// fileListener turns an inherited file into a TCP listener
+func fileListener(f *os.File) (*net.TCPListener, error) {
+	defer f.Close()
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	listener, ok := l.(*net.TCPListener)
+	if !ok {
+		l.Close()
+		return nil, errors.New("not a TCP listener")
+	}
+	return listener, nil
+}
+
+// sameAddr reports whether a bound listener address satisfies a configured one
+func sameAddr(bound, want *net.TCPAddr) bool {
+	if bound.Port != want.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return bound.IP.IsUnspecified()
+	}
+	return bound.IP.Equal(want.IP)
+}
+
+// upgradeEnviron returns the environment for the new process. WATCHDOG_PID is
+// dropped because the new process takes over the watchdog as the main process.
+func upgradeEnviron() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "WATCHDOG_PID=") || strings.HasPrefix(kv, upgradeEnv+"=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// finishInherit tells the parent process this one is accepting connections
+// and closes passed-in listeners the configuration does not use
+func (s *Server) finishInherit() {
+	for name, f := range s.activated {
+		s.logger.Warn("Ignoring unused socket-activated listener", "name", name)
+		f.Close()
+	}
+	s.activated = nil
+
+	for name, f := range s.inherited {
+		if name == upgradeReadyName {
+			if _, err := f.Write([]byte{1}); err != nil {
+				s.logger.Warn("Failed to notify parent process", "error", err)
+			}
+		}
+		f.Close()
+	}
+	s.inherited = nil
+}
+
+// Upgrade starts the current executable as a new process and hands it the
+// listening sockets. It returns once the new process accepts connections;
+// the caller then stops this server so its sessions drain. On error this
+// server keeps running untouched.
+func (s *Server) Upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "failed to locate executable")
+	}
+
+	names := make([]string, 0, len(s.listeners)+1)
+	for name := range s.listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, name := range names {
+		f, err := s.listeners[name].File()
+		if err != nil {
+			return errors.Wrapf(err, "failed to duplicate %s listener", name)
+		}
+		files = append(files, f)
+	}
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "failed to create ready pipe")
+	}
+	defer ready.Close()
+	names = append(names, upgradeReadyName)
+	files = append(files, readyW)
+
+	// The new process loads the state files on start, so they must be
+	// current; from then on only it writes them
+	s.saveBans()
+	s.saveLedger()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(upgradeEnviron(), upgradeEnv+"="+strings.Join(names, ","))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "failed to start new process")
+	}
+	s.logger.Info("Started new process", "pid", cmd.Process.Pid, "executable", exe)
+
+	// Only the child may hold the write end, so a crash shows up as EOF
+	readyW.Close()
+	go cmd.Wait()
+
+	if err := s.waitReady(ready, upgradeTimeout); err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+
+	s.persistMu.Lock()
+	s.mu.Lock()
+	s.upgraded = true
+	s.mu.Unlock()
+	s.persistMu.Unlock()
+
+	return nil
+}
+
+// waitReady waits for the new process to report on the ready pipe that it
+// accepts connections. A crash before that closes the pipe and fails at once.
+func (s *Server) waitReady(ready *os.File, timeout time.Duration) error {
+	if err := ready.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		s.logger.Debug("Failed to set ready deadline", "error", err)
+	}
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		return errors.Wrap(err, "new process did not become ready")
+	}
+	return nil
+}
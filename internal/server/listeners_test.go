@@ -0,0 +1,254 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// testServer returns a server with only the fields the listener code uses
+func testServer() *Server {
+	return &Server{
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		listeners: make(map[string]*net.TCPListener),
+	}
+}
+
+// fakeFiles replaces newFile for the duration of a test and records the
+// descriptor each returned file stands for
+func fakeFiles(t *testing.T) map[*os.File]uintptr {
+	t.Helper()
+
+	fds := make(map[*os.File]uintptr)
+	dir := t.TempDir()
+	newFile = func(fd uintptr, name string) *os.File {
+		f, err := os.CreateTemp(dir, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fds[f] = fd
+		return f
+	}
+	t.Cleanup(func() {
+		newFile = os.NewFile
+		for f := range fds {
+			f.Close()
+		}
+	})
+	return fds
+}
+
+func TestInheritedFiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    string
+		expect map[string]uintptr
+	}{
+		{name: "listeners and ready pipe", env: "http,tls,ready", expect: map[string]uintptr{"http": 3, "tls": 4, "ready": 5}},
+		{name: "ready pipe only", env: "ready", expect: map[string]uintptr{"ready": 3}},
+		{name: "not upgraded", env: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fds := fakeFiles(t)
+			t.Setenv(upgradeEnv, tt.env)
+
+			files := inheritedFiles()
+			if len(files) != len(tt.expect) {
+				t.Fatalf("got %d files, want %d", len(files), len(tt.expect))
+			}
+			for name, fd := range tt.expect {
+				f, ok := files[name]
+				if !ok {
+					t.Fatalf("no file named %q", name)
+				}
+				if fds[f] != fd {
+					t.Errorf("%q is descriptor %d, want %d", name, fds[f], fd)
+				}
+			}
+
+			// Processes started later must not inherit the list
+			if tt.env != "" {
+				if _, ok := os.LookupEnv(upgradeEnv); ok {
+					t.Errorf("%s is still set", upgradeEnv)
+				}
+			}
+		})
+	}
+}
+
+func TestUpgradeEnviron(t *testing.T) {
+	t.Setenv("WATCHDOG_PID", "1")
+	t.Setenv(upgradeEnv, "http")
+	t.Setenv("GOWSOOS_TEST", "kept")
+
+	kept := false
+	for _, kv := range upgradeEnviron() {
+		switch kv {
+		case "WATCHDOG_PID=1", upgradeEnv + "=http":
+			t.Errorf("%s passed to the new process", kv)
+		case "GOWSOOS_TEST=kept":
+			kept = true
+		}
+	}
+	if !kept {
+		t.Error("environment not passed to the new process")
+	}
+}
+
+func TestSameAddr(t *testing.T) {
+	tests := []struct {
+		bound string
+		want  string
+		same  bool
+	}{
+		{"0.0.0.0:80", ":80", true},
+		{"[::]:80", ":80", true},
+		{"0.0.0.0:80", "0.0.0.0:80", true},
+		{"127.0.0.1:80", "127.0.0.1:80", true},
+		{"0.0.0.0:80", ":8080", false},
+		{"127.0.0.1:80", ":80", false},
+		{"0.0.0.0:80", "127.0.0.1:80", false},
+		{"127.0.0.1:80", "127.0.0.2:80", false},
+	}
+
+	for _, tt := range tests {
+		bound, err := net.ResolveTCPAddr("tcp", tt.bound)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := net.ResolveTCPAddr("tcp", tt.want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sameAddr(bound, want); got != tt.same {
+			t.Errorf("sameAddr(%s, %s) = %v, want %v", tt.bound, tt.want, got, tt.same)
+		}
+	}
+}
+
+// inheritListener opens a listener and returns it along with the duplicate
+// a parent process would pass on
+func inheritListener(t *testing.T) (*net.TCPListener, *os.File) {
+	t.Helper()
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	f, err := l.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, f
+}
+
+func TestListenInherited(t *testing.T) {
+	parent, f := inheritListener(t)
+	s := testServer()
+	s.inherited = map[string]*os.File{"http": f}
+
+	addr := parent.Addr().String()
+	listener, err := s.listen("http", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if listener.Addr().String() != addr {
+		t.Errorf("listening on %s, want the inherited %s", listener.Addr(), addr)
+	}
+	if s.listeners["http"] != listener || len(s.inherited) != 0 {
+		t.Errorf("listener not taken over: %v, %v", s.listeners, s.inherited)
+	}
+
+	// Connections queued on the shared socket reach the new process
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	parent.Close()
+	listener.SetDeadline(time.Now().Add(time.Second))
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("inherited listener does not accept: %v", err)
+	}
+	accepted.Close()
+}
+
+func TestListenInheritedMoved(t *testing.T) {
+	_, f := inheritListener(t)
+	s := testServer()
+	s.inherited = map[string]*os.File{"http": f}
+
+	listener, err := s.listen("http", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if s.listeners["http"] != listener || len(s.inherited) != 0 {
+		t.Errorf("listener not replaced: %v, %v", s.listeners, s.inherited)
+	}
+	if _, err := f.Stat(); err == nil {
+		t.Error("inherited socket for the old address still open")
+	}
+}
+
+func TestReadyPipe(t *testing.T) {
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ready.Close()
+	_, unused := inheritListener(t)
+
+	child := testServer()
+	child.inherited = map[string]*os.File{upgradeReadyName: readyW, "tls": unused}
+	child.finishInherit()
+
+	if err := testServer().waitReady(ready, time.Second); err != nil {
+		t.Fatalf("parent not notified: %v", err)
+	}
+	if child.inherited != nil {
+		t.Errorf("inherited files kept: %v", child.inherited)
+	}
+	for _, f := range []*os.File{readyW, unused} {
+		if _, err := f.Stat(); err == nil {
+			t.Errorf("%s still open", f.Name())
+		}
+	}
+}
+
+func TestReadyPipeFailure(t *testing.T) {
+	tests := []struct {
+		name  string
+		child func(w *os.File) // what the new process does with the write end
+	}{
+		{name: "crash", child: func(w *os.File) { w.Close() }},
+		{name: "hang", child: func(w *os.File) {}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ready, readyW, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ready.Close()
+			defer readyW.Close()
+
+			tt.child(readyW)
+			start := time.Now()
+			if err := testServer().waitReady(ready, 100*time.Millisecond); err == nil {
+				t.Fatal("waitReady succeeded, want an error")
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("waitReady took %s", elapsed)
+			}
+		})
+	}
+}
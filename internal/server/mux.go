@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"time"
+
+	"gowsoos/internal/proxy"
+)
+
+// Protocols the multiplexing listener tells apart
+const (
+	protocolTLS  = "tls"
+	protocolSSH  = "ssh"
+	protocolHTTP = "http"
+)
+
+const (
+	tlsHandshakeRecord = 0x16
+	sshBannerPrefix    = "SSH-"
+)
+
+// startMuxServer accepts connections speaking SSH, TLS or HTTP on one port
+func (s *Server) startMuxServer(listener *net.TCPListener) error {
+	cfg := s.currentConfig()
+	defer listener.Close()
+
+	s.logger.Info("Multiplexing Server listening",
+		slog.String("address", listener.Addr().String()),
+		slog.String("redirect", cfg.DstAddress))
+
+	// Setup graceful shutdown
+	go func() {
+		<-s.ctx.Done()
+		s.logger.Info("Shutting down multiplexing server...")
+		listener.Close()
+	}()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		default:
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				if s.ctx.Err() != nil {
+					continue // Listener closed by shutdown
+				}
+				s.logger.Error("Failed to accept multiplexed connection", "error", err)
+				continue
+			}
+
+			if err := s.configureConnection(conn); err != nil {
+				s.logger.Error("Failed to configure connection", "error", err)
+				conn.Close()
+				continue
+			}
+
+			s.conns.Add(1)
+			go s.handleMuxConnection(conn)
+		}
+	}
+}
+
+// handleMuxConnection sniffs the protocol of a multiplexed connection and
+// dispatches it: TLS is terminated in-process, SSH goes straight to the
+// backend and everything else takes the HTTP/WebSocket handshake path
+func (s *Server) handleMuxConnection(conn net.Conn) {
+	defer s.conns.Done()
+
+	cfg := s.currentConfig()
+	conn, ok := s.acceptProxyHeader(cfg, conn, cfg.MuxProxyProtocol)
+	if !ok {
+		return
+	}
+	if !s.checkACL(conn) || !s.checkGuard(conn) {
+		return
+	}
+
+	peeked := proxy.NewPeekedConn(conn)
+	protocol, err := sniffProtocol(peeked, cfg.GetSniffTimeout())
+	if err != nil {
+		s.logger.Debug("Failed to detect protocol",
+			"client", conn.RemoteAddr().String(),
+			"error", err)
+		s.metrics.RecordError("mux", "sniff")
+		conn.Close()
+		return
+	}
+	s.logger.Debug("Detected protocol",
+		"client", conn.RemoteAddr().String(),
+		"protocol", protocol)
+
+	switch protocol {
+	case protocolTLS:
+		if s.tlsConfig == nil {
+			s.logger.Warn("Dropping TLS client, tls_enabled is off",
+				"client", conn.RemoteAddr().String())
+			s.metrics.RecordError("mux", "tls_disabled")
+			conn.Close()
+			return
+		}
+		s.serve(cfg, peeked, true)
+	case protocolSSH:
+		s.serveDirect(peeked)
+	default:
+		s.serve(cfg, peeked, false)
+	}
+}
+
+// serveDirect admits a raw SSH client and forwards it to the default backend
+func (s *Server) serveDirect(conn net.Conn) {
+	release, err := s.admission.Acquire(s.connCtx, remoteIP(conn.RemoteAddr()))
+	if err != nil {
+		// An HTTP error response would corrupt the SSH banner exchange, just close
+		s.recordRejection(conn, err)
+		conn.Close()
+		return
+	}
+	defer release()
+
+	s.proxy.HandleDirect(s.connCtx, conn)
+}
+
+// sniffProtocol looks at the first bytes of a connection without consuming
+// them. A client sending nothing within timeout is taken for an SSH client
+// waiting for the server banner.
+func sniffProtocol(conn *proxy.PeekedConn, timeout time.Duration) (string, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return "", err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	first, err := conn.Peek(1)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return protocolSSH, nil
+		}
+		return "", err
+	}
+
+	switch first[0] {
+	case tlsHandshakeRecord:
+		return protocolTLS, nil
+	case sshBannerPrefix[0]:
+		// Anything short of the full prefix is left to the HTTP parser to reject
+		if prefix, _ := conn.Peek(len(sshBannerPrefix)); bytes.Equal(prefix, []byte(sshBannerPrefix)) {
+			return protocolSSH, nil
+		}
+	}
+	return protocolHTTP, nil
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"gowsoos/internal/config"
+	"gowsoos/internal/proxy"
+	"gowsoos/internal/proxyproto"
+)
+
+// sniffTimeout is short so silent clients do not slow the tests down
+const sniffTimeout = 50 * time.Millisecond
+
+// balancerConn is a connection from a load balancer address
+type balancerConn struct {
+	net.Conn
+}
+
+func (c balancerConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+}
+
+// pipeClient returns the server side of a connection whose client writes
+// sends in order and then closes it if close is set
+func pipeClient(t *testing.T, sends []string, close bool) net.Conn {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	go func() {
+		for _, b := range sends {
+			if _, err := client.Write([]byte(b)); err != nil {
+				return
+			}
+		}
+		if close {
+			client.Close()
+		}
+	}()
+	return server
+}
+
+// readAll reads what is left of a sniffed connection until the client stops sending
+func readAll(conn net.Conn) string {
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	b, _ := io.ReadAll(conn)
+	return string(b)
+}
+
+func TestSniffProtocol(t *testing.T) {
+	tests := []struct {
+		name     string
+		sends    []string
+		close    bool
+		protocol string
+		fails    bool
+	}{
+		{name: "ssh banner", sends: []string{"SSH-2.0-OpenSSH_9.6\r\n"}, protocol: protocolSSH},
+		{name: "ssh banner in parts", sends: []string{"SS", "H-2.0-PuTTY\r\n"}, protocol: protocolSSH},
+		{name: "tls", sends: []string{"\x16\x03\x01\x02\x00\x01"}, protocol: protocolTLS},
+		{name: "http", sends: []string{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"}, protocol: protocolHTTP},
+		{name: "http connect", sends: []string{"CONNECT example.com:443 HTTP/1.1\r\n\r\n"}, protocol: protocolHTTP},
+		{name: "S but not ssh", sends: []string{"SOURCE / HTTP/1.0\r\n\r\n"}, protocol: protocolHTTP},
+		{name: "stalled ssh prefix", sends: []string{"SS"}, protocol: protocolHTTP},
+		{name: "short then closed", sends: []string{"S"}, close: true, protocol: protocolHTTP},
+		{name: "silent client", protocol: protocolSSH},
+		{name: "closed without data", close: true, fails: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peeked := proxy.NewPeekedConn(pipeClient(t, tt.sends, tt.close))
+
+			start := time.Now()
+			protocol, err := sniffProtocol(peeked, sniffTimeout)
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("detected %s, want an error", protocol)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if protocol != tt.protocol {
+				t.Errorf("detected %s, want %s", protocol, tt.protocol)
+			}
+			if elapsed := time.Since(start); elapsed > 10*sniffTimeout {
+				t.Errorf("sniffing took %s", elapsed)
+			}
+
+			// Sniffing consumes nothing and leaves no deadline behind
+			var sent string
+			for _, b := range tt.sends {
+				sent += b
+			}
+			if got := readAll(peeked); got != sent {
+				t.Errorf("read %q after sniffing, want %q", got, sent)
+			}
+		})
+	}
+}
+
+func TestSniffAfterProxyHeader(t *testing.T) {
+	// The v2 signature starts with \r\n, which must not be taken for HTTP
+	v2, err := (&proxyproto.Header{
+		Version:     2,
+		Source:      &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51000},
+		Destination: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 443},
+	}).Format()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := "PROXY TCP4 203.0.113.7 10.0.0.2 51000 443\r\n"
+
+	tests := []struct {
+		name     string
+		header   string
+		sends    string
+		protocol string
+	}{
+		{name: "v1 then tls", header: v1, sends: "\x16\x03\x01\x02\x00\x01", protocol: protocolTLS},
+		{name: "v1 then http", header: v1, sends: "GET / HTTP/1.1\r\n\r\n", protocol: protocolHTTP},
+		{name: "v1 then silent ssh", header: v1, protocol: protocolSSH},
+		{name: "v2 then ssh", header: string(v2), sends: "SSH-2.0-OpenSSH_9.6\r\n", protocol: protocolSSH},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer()
+			s.proxyTrust, _ = proxyproto.ParseTrustList([]string{"10.0.0.0/8"})
+
+			conn := balancerConn{pipeClient(t, []string{tt.header, tt.sends}, false)}
+			accepted, ok := s.acceptProxyHeader(config.DefaultConfig(), conn, true)
+			if !ok {
+				t.Fatal("header refused")
+			}
+			if got := accepted.RemoteAddr().String(); got != "203.0.113.7:51000" {
+				t.Errorf("client %s, want the relayed 203.0.113.7:51000", got)
+			}
+
+			peeked := proxy.NewPeekedConn(accepted)
+			protocol, err := sniffProtocol(peeked, sniffTimeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if protocol != tt.protocol {
+				t.Errorf("detected %s, want %s", protocol, tt.protocol)
+			}
+			if got := readAll(peeked); got != tt.sends {
+				t.Errorf("read %q after the header, want %q", got, tt.sends)
+			}
+		})
+	}
+}
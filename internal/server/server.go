@@ -5,75 +5,273 @@ import (
 	"crypto/tls"
 	"log/slog"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
+	"gowsoos/internal/accounting"
+	"gowsoos/internal/acl"
+	"gowsoos/internal/admin"
 	"gowsoos/internal/config"
+	"gowsoos/internal/health"
+	"gowsoos/internal/limiter"
 	"gowsoos/internal/metrics"
 	"gowsoos/internal/proxy"
+	"gowsoos/internal/proxyproto"
+	"gowsoos/internal/systemd"
+)
+
+const (
+	heartbeatWindow            = 10 * time.Second
+	rejectTimeout              = 5 * time.Second
+	stateMaintenanceInterval   = 10 * time.Second
+	serviceUnavailableResponse = "HTTP/1.1 503 Service Unavailable\r\n" +
+		"Content-Length: 0\r\n" +
+		"Connection: close\r\n\r\n"
 )
 
 // Server manages HTTP and TLS servers
 type Server struct {
+	heartbeat int64 // unix nanoseconds of the last HTTP accept loop pass, first for alignment
+	phase     int32 // phaseStarting, phaseServing or phaseDraining
+
+	mu        sync.RWMutex
 	config    *config.Config
 	logger    *slog.Logger
 	metrics   *metrics.Metrics
 	proxy     *proxy.Proxy
-	wg        sync.WaitGroup
-	ctx       context.Context
-	cancel    context.CancelFunc
+	admission *limiter.Admission
+	acl       *acl.ACL
+	guard     *limiter.Guard
+	prober    *health.Prober
+	// ledgerFile is the accounting file loaded on start, saved to until exit
+	// or until an upgraded process takes it over
+	ledgerFile string
+	version    admin.Version
+	certs      *proxy.CertStore
+	tlsConfig  *tls.Config
+	// proxyTrust lists the balancers allowed to send PROXY protocol headers
+	proxyTrust proxyproto.TrustList
+	listeners  map[string]*net.TCPListener
+	activated  map[string]*os.File
+	inherited  map[string]*os.File
+	wg         sync.WaitGroup
+	conns      sync.WaitGroup
+	stopOnce   sync.Once
+	upgraded   bool
+	persistMu  sync.Mutex // serializes state file writes with the upgrade handoff
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	// connCtx outlives ctx during an upgrade so in-flight handshakes complete
+	connCtx    context.Context
+	connCancel context.CancelFunc
+
+	// metricsCtx outlives ctx so health checks see the drain
+	metricsCtx  context.Context
+	stopMetrics context.CancelFunc
+	metricsWG   sync.WaitGroup
 }
 
+// Server phases reported by the readiness endpoint
+const (
+	phaseStarting int32 = iota
+	phaseServing
+	phaseDraining
+)
+
 // NewServer creates a new server instance
 func NewServer(cfg *config.Config, logger *slog.Logger, m *metrics.Metrics) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
-	
-	return &Server{
+	connCtx, connCancel := context.WithCancel(context.Background())
+	metricsCtx, stopMetrics := context.WithCancel(context.Background())
+
+	s := &Server{
 		config:  cfg,
 		logger:  logger,
 		metrics: m,
 		proxy:   proxy.NewProxy(cfg, logger, m),
-		ctx:     ctx,
-		cancel:  cancel,
+		admission: limiter.NewAdmission(
+			cfg.MaxConnections,
+			cfg.MaxConnectionsPerIP,
+			cfg.LimitPolicy == "queue",
+			time.Duration(cfg.QueueTimeout)*time.Second,
+		),
+		acl:         acl.New(),
+		guard:       limiter.NewGuard(guardConfig(cfg)),
+		prober:      health.NewProber(health.SettingsFor(cfg), logger),
+		listeners:   make(map[string]*net.TCPListener),
+		activated:   systemd.ListenFiles(),
+		inherited:   inheritedFiles(),
+		ctx:         ctx,
+		cancel:      cancel,
+		connCtx:     connCtx,
+		connCancel:  connCancel,
+		metricsCtx:  metricsCtx,
+		stopMetrics: stopMetrics,
+	}
+	s.proxy.OnHandshakeFailure(s.recordHandshakeFailure)
+	return s
+}
+
+// guardConfig returns the connection rate limit and ban settings
+func guardConfig(cfg *config.Config) limiter.GuardConfig {
+	return limiter.GuardConfig{
+		Window:              time.Duration(cfg.RateLimitWindow) * time.Second,
+		MaxConnections:      cfg.RateLimitConnections,
+		BanAfterConnections: cfg.BanAfterConnections,
+		BanAfterFailures:    cfg.BanAfterFailures,
+		BanDuration:         time.Duration(cfg.BanDuration) * time.Second,
 	}
 }
 
 // Start starts both HTTP and TLS servers
 func (s *Server) Start() error {
-	serverErrChan := make(chan error, 2)
+	cfg := s.currentConfig()
+	serverErrChan := make(chan error, 3)
+
+	proxyTrust, err := proxyproto.ParseTrustList(cfg.ProxyProtocolTrusted)
+	if err != nil {
+		return errors.Wrap(err, "invalid proxy_protocol_trusted")
+	}
+	s.proxyTrust = proxyTrust
+
+	if err := s.proxy.Authenticator().Reload(cfg); err != nil {
+		return errors.Wrap(err, "failed to load credentials")
+	}
+
+	if err := s.acl.Reload(cfg); err != nil {
+		return errors.Wrap(err, "failed to load ACL")
+	}
+	if len(cfg.ACLRules) > 0 {
+		s.logger.Info("ACL loaded", "rules", s.acl.Rules(), "default", cfg.ACLDefault, "dry_run", cfg.ACLDryRun)
+	}
+
+	// Usage counts towards quotas across restarts, losing them is worth failing the start
+	if cfg.AccountingEnabled && cfg.AccountingFile != "" {
+		accounts, err := accounting.Load(cfg.AccountingFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to load accounting ledger")
+		}
+		s.proxy.Ledger().Restore(accounts)
+		s.ledgerFile = cfg.AccountingFile
+	}
+
+	// Bans survive restarts, a broken ban file is not worth failing the start over
+	if cfg.BanFile != "" {
+		bans, err := limiter.LoadBans(cfg.BanFile)
+		if err != nil {
+			s.logger.Warn("Failed to load bans", "error", err)
+		} else if len(bans) > 0 {
+			s.guard.Restore(bans)
+			active := len(s.guard.Bans())
+			s.metrics.SetActiveBans(active)
+			s.logger.Info("Bans restored", "count", active)
+		}
+	}
+
+	// Load certificates up front so a bad TLS setup fails the start
+	if cfg.TLSEnabled {
+		certs, err := proxy.NewCertStore(cfg)
+		if err != nil {
+			return errors.Wrap(err, "failed to load TLS certificates")
+		}
+		s.certs = certs
+		s.tlsConfig = proxy.TLSConfig(certs)
+		s.logger.Info("TLS certificates loaded", "count", certs.Count())
+	}
+
+	// Open every listener before serving, reusing sockets handed over by an upgrade
+	httpListener, err := s.listen("http", cfg.Address)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen on HTTP server")
+	}
+
+	var tlsListener *net.TCPListener
+	if cfg.TLSEnabled {
+		if tlsListener, err = s.listen("tls", cfg.TLSAddress); err != nil {
+			return errors.Wrap(err, "failed to listen on TLS server")
+		}
+	}
+
+	var muxListener *net.TCPListener
+	if cfg.MuxAddress != "" {
+		if muxListener, err = s.listen("mux", cfg.MuxAddress); err != nil {
+			return errors.Wrap(err, "failed to listen on multiplexing server")
+		}
+	}
+
+	var metricsListener *net.TCPListener
+	if cfg.MetricsEnabled {
+		if metricsListener, err = s.listen("metrics", cfg.MetricsPort); err != nil {
+			return errors.Wrap(err, "failed to listen on metrics server")
+		}
+	}
+
+	atomic.StoreInt32(&s.phase, phaseServing)
 
 	// Start HTTP server
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
-		if err := s.startHTTPServer(); err != nil {
+		if err := s.startHTTPServer(httpListener); err != nil && s.ctx.Err() == nil {
 			serverErrChan <- errors.Wrap(err, "HTTP server failed")
 		}
 	}()
 
 	// Start TLS server if enabled
-	if s.config.TLSEnabled {
+	if tlsListener != nil {
 		s.wg.Add(1)
 		go func() {
 			defer s.wg.Done()
-			if err := s.startTLSServer(); err != nil {
+			if err := s.startTLSServer(tlsListener); err != nil && s.ctx.Err() == nil {
 				serverErrChan <- errors.Wrap(err, "TLS server failed")
 			}
 		}()
 	}
 
-	// Start metrics server if enabled
-	if s.config.MetricsEnabled {
+	// Start multiplexing server if enabled
+	if muxListener != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.startMuxServer(muxListener); err != nil && s.ctx.Err() == nil {
+				serverErrChan <- errors.Wrap(err, "multiplexing server failed")
+			}
+		}()
+	}
+
+	s.wg.Add(1)
+	go s.maintainState()
+
+	// Start metrics server if enabled, it serves the admin API and health
+	// checks as well and keeps running until the drain is over
+	if metricsListener != nil {
+		s.metrics.Handle(admin.Prefix, admin.NewHandler(s.proxy, s.currentConfig, s.version, s.logger))
+		healthHandler := health.NewHandler(s, s.prober)
+		s.metrics.Handle(health.PathHealth, healthHandler)
+		s.metrics.Handle(health.PathLiveness, healthHandler)
+		s.metrics.Handle(health.PathReadiness, healthHandler)
+
 		s.wg.Add(1)
 		go func() {
 			defer s.wg.Done()
-			if err := s.metrics.StartMetricsServer(s.config.MetricsPort); err != nil {
+			s.prober.Run(s.ctx)
+		}()
+
+		s.metricsWG.Add(1)
+		go func() {
+			defer s.metricsWG.Done()
+			if err := s.metrics.StartMetricsServer(s.metricsCtx, metricsListener); err != nil {
 				s.logger.Error("Metrics server failed", "error", err)
 			}
 		}()
 	}
 
+	s.finishInherit()
+
 	// Wait for any server to fail
 	go func() {
 		err := <-serverErrChan
@@ -86,11 +284,186 @@ func (s *Server) Start() error {
 	return nil
 }
 
-// Stop gracefully shuts down all servers
+// Reload applies a new validated configuration. Routes, limits, handshake
+// settings and certificates take effect for new connections, established
+// tunnels keep the settings they started with. Listener addresses cannot
+// change without a restart.
+func (s *Server) Reload(cfg *config.Config) error {
+	old := s.currentConfig()
+
+	proxyTrust, err := proxyproto.ParseTrustList(cfg.ProxyProtocolTrusted)
+	if err != nil {
+		return errors.Wrap(err, "invalid proxy_protocol_trusted")
+	}
+
+	// Certificates, credentials and ACL files are the only parts that can
+	// fail. All of them are loaded before any is swapped in, so a failed
+	// reload leaves everything untouched.
+	var applyCerts func()
+	if s.certs != nil && cfg.TLSEnabled {
+		if applyCerts, err = s.certs.Prepare(cfg); err != nil {
+			return errors.Wrap(err, "failed to reload TLS certificates")
+		}
+	}
+	applyCredentials, err := s.proxy.Authenticator().Prepare(cfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to reload credentials")
+	}
+	applyACL, err := s.acl.Prepare(cfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to reload ACL")
+	}
+
+	if applyCerts != nil {
+		applyCerts()
+		s.logger.Info("TLS certificates reloaded", "count", s.certs.Count())
+	}
+	applyCredentials()
+	applyACL()
+
+	for _, name := range restartRequired(old, cfg) {
+		s.logger.Warn("Setting change requires a restart", "setting", name)
+	}
+
+	s.admission.SetLimits(
+		cfg.MaxConnections,
+		cfg.MaxConnectionsPerIP,
+		cfg.LimitPolicy == "queue",
+		time.Duration(cfg.QueueTimeout)*time.Second,
+	)
+	s.guard.SetConfig(guardConfig(cfg))
+	s.prober.SetSettings(health.SettingsFor(cfg))
+	s.proxy.Reload(cfg)
+
+	s.mu.Lock()
+	s.config = cfg
+	s.proxyTrust = proxyTrust
+	s.mu.Unlock()
+
+	return nil
+}
+
+// restartRequired lists the changed settings that only apply on startup
+func restartRequired(old, cfg *config.Config) []string {
+	var names []string
+	if old.Address != cfg.Address {
+		names = append(names, "address")
+	}
+	if old.TLSEnabled != cfg.TLSEnabled {
+		names = append(names, "tls_enabled")
+	}
+	if old.TLSAddress != cfg.TLSAddress {
+		names = append(names, "tls_address")
+	}
+	if old.MuxAddress != cfg.MuxAddress {
+		names = append(names, "mux_address")
+	}
+	if old.AccountingEnabled != cfg.AccountingEnabled {
+		names = append(names, "accounting_enabled")
+	}
+	if old.AccountingFile != cfg.AccountingFile {
+		names = append(names, "accounting_file")
+	}
+	if old.MetricsEnabled != cfg.MetricsEnabled {
+		names = append(names, "metrics_enabled")
+	}
+	if old.MetricsPort != cfg.MetricsPort {
+		names = append(names, "metrics_port")
+	}
+	return names
+}
+
+// SetVersion sets the build reported by the admin API, before Start
+func (s *Server) SetVersion(version admin.Version) {
+	s.version = version
+}
+
+// ActiveSessions returns the number of connections being handled
+func (s *Server) ActiveSessions() int {
+	return s.proxy.ActiveSessions()
+}
+
+// Alive reports whether the HTTP accept loop is still turning over
+func (s *Server) Alive() bool {
+	last := time.Unix(0, atomic.LoadInt64(&s.heartbeat))
+	return time.Since(last) < heartbeatWindow
+}
+
+// Live reports whether the server accepts connections, or is draining them
+func (s *Server) Live() bool {
+	return atomic.LoadInt32(&s.phase) == phaseDraining || s.Alive()
+}
+
+// Serving returns why new tunnels are not taken, nil once every listener is
+// bound and until the server starts draining
+func (s *Server) Serving() error {
+	switch atomic.LoadInt32(&s.phase) {
+	case phaseStarting:
+		return errors.New("listeners not bound yet")
+	case phaseDraining:
+		return errors.New("draining")
+	}
+	return nil
+}
+
+// currentConfig returns the configuration in effect
+func (s *Server) currentConfig() *config.Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+// Stop gracefully shuts down all servers. New connections are refused, active
+// sessions get up to drain_timeout to finish before the rest are closed.
 func (s *Server) Stop() {
+	s.stopOnce.Do(s.shutdown)
+}
+
+func (s *Server) shutdown() {
 	s.logger.Info("Shutting down servers...")
+	atomic.StoreInt32(&s.phase, phaseDraining)
 	s.cancel()
 	s.wg.Wait()
+
+	// After an upgrade the new process serves clients, so connections still
+	// handshaking here are let through instead of being turned away. It
+	// answers health checks on the shared metrics socket as well.
+	s.mu.RLock()
+	upgraded := s.upgraded
+	s.mu.RUnlock()
+	if upgraded {
+		s.stopMetrics()
+	} else {
+		s.connCancel()
+	}
+
+	cfg := s.currentConfig()
+	if active := s.proxy.ActiveSessions(); active > 0 {
+		s.logger.Info("Draining sessions",
+			"active", active,
+			"timeout", cfg.GetDrainTimeout())
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.GetDrainTimeout())
+		err := s.proxy.Drain(ctx)
+		cancel()
+
+		if err != nil {
+			cut := s.proxy.CloseSessions(cfg.DrainNotice)
+			s.logger.Warn("Drain timeout expired, closed remaining sessions", "sessions", cut)
+		} else {
+			s.logger.Info("All sessions drained")
+		}
+	}
+	s.connCancel()
+	s.conns.Wait()
+
+	// Drained tunnels were accounted until the end. After an upgrade their
+	// last traffic is not saved since the new process owns the ledger.
+	s.saveLedger()
+
+	s.stopMetrics()
+	s.metricsWG.Wait()
+
 	s.logger.Info("All servers stopped")
 }
 
@@ -100,21 +473,13 @@ func (s *Server) Wait() {
 }
 
 // startHTTPServer sets up the HTTP proxy server
-func (s *Server) startHTTPServer() error {
-	addr, err := net.ResolveTCPAddr("tcp", s.config.Address)
-	if err != nil {
-		return errors.Wrap(err, "failed to resolve TCP address")
-	}
-
-	listener, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		return errors.Wrap(err, "failed to listen on HTTP server")
-	}
+func (s *Server) startHTTPServer(listener *net.TCPListener) error {
+	cfg := s.currentConfig()
 	defer listener.Close()
 
 	s.logger.Info("HTTP Server listening",
-		slog.String("address", s.config.Address),
-		slog.String("redirect", s.config.DstAddress))
+		slog.String("address", listener.Addr().String()),
+		slog.String("redirect", cfg.DstAddress))
 
 	// Setup graceful shutdown
 	go func() {
@@ -129,6 +494,8 @@ func (s *Server) startHTTPServer() error {
 		case <-s.ctx.Done():
 			return s.ctx.Err()
 		default:
+			atomic.StoreInt64(&s.heartbeat, time.Now().UnixNano())
+
 			// Set accept timeout to allow context checking
 			if err := listener.SetDeadline(time.Now().Add(1 * time.Second)); err != nil {
 				s.logger.Error("Failed to set deadline", "error", err)
@@ -140,6 +507,9 @@ func (s *Server) startHTTPServer() error {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue // Timeout is normal for context checking
 				}
+				if s.ctx.Err() != nil {
+					continue // Listener closed by shutdown
+				}
 				s.logger.Error("Failed to accept TCP connection", "error", err)
 				continue
 			}
@@ -152,27 +522,20 @@ func (s *Server) startHTTPServer() error {
 			}
 
 			// Handle connection
-			go s.proxy.HandleConnection(s.ctx, conn, false)
+			s.conns.Add(1)
+			go s.handleConnection(conn, false)
 		}
 	}
 }
 
 // startTLSServer sets up the TLS proxy server
-func (s *Server) startTLSServer() error {
-	tlsConfig, err := proxy.TLSConfig(s.config.TLSPrivateKey, s.config.TLSPublicKey)
-	if err != nil {
-		return errors.Wrap(err, "failed to create TLS config")
-	}
-
-	listener, err := tls.Listen("tcp", s.config.TLSAddress, tlsConfig)
-	if err != nil {
-		return errors.Wrap(err, "failed to listen on TLS server")
-	}
+func (s *Server) startTLSServer(listener *net.TCPListener) error {
+	cfg := s.currentConfig()
 	defer listener.Close()
 
 	s.logger.Info("TLS Server listening",
-		slog.String("address", s.config.TLSAddress),
-		slog.String("redirect", s.config.DstAddress))
+		slog.String("address", listener.Addr().String()),
+		slog.String("redirect", cfg.DstAddress))
 
 	// Setup graceful shutdown
 	go func() {
@@ -187,27 +550,318 @@ func (s *Server) startTLSServer() error {
 		case <-s.ctx.Done():
 			return s.ctx.Err()
 		default:
-			conn, err := listener.Accept()
+			conn, err := listener.AcceptTCP()
 			if err != nil {
+				if s.ctx.Err() != nil {
+					continue // Listener closed by shutdown
+				}
 				s.logger.Error("Failed to accept TLS connection", "error", err)
 				continue
 			}
 
-			// Handle connection
-			go s.proxy.HandleConnection(s.ctx, conn, true)
+			// Configure connection
+			if err := s.configureConnection(conn); err != nil {
+				s.logger.Error("Failed to configure connection", "error", err)
+				conn.Close()
+				continue
+			}
+
+			// Handle connection, TLS starts after an optional PROXY header
+			s.conns.Add(1)
+			go s.handleConnection(conn, true)
+		}
+	}
+}
+
+// handleConnection admits an accepted connection and hands it to the proxy
+func (s *Server) handleConnection(conn net.Conn, isTLS bool) {
+	defer s.conns.Done()
+
+	cfg := s.currentConfig()
+	enabled := cfg.ProxyProtocol
+	if isTLS {
+		enabled = cfg.TLSProxyProtocol
+	}
+	conn, ok := s.acceptProxyHeader(cfg, conn, enabled)
+	if !ok {
+		return
+	}
+	if !s.checkACL(conn) || !s.checkGuard(conn) {
+		return
+	}
+
+	s.serve(cfg, conn, isTLS)
+}
+
+// checkACL applies the access control rules to the client address, which is
+// the one from the PROXY header when there is one. Denied connections are
+// closed without a response; in dry-run mode they are only reported.
+func (s *Server) checkACL(conn net.Conn) bool {
+	decision := s.acl.Check(conn.RemoteAddr())
+	if decision.Allowed {
+		return true
+	}
+
+	s.metrics.RecordACLDenied(decision.Rule, decision.DryRun)
+	if decision.DryRun {
+		s.logger.Info("Connection would be denied by ACL",
+			"client", conn.RemoteAddr().String(),
+			"rule", decision.Rule)
+		return true
+	}
+
+	s.logger.Debug("Connection denied by ACL",
+		"client", conn.RemoteAddr().String(),
+		"rule", decision.Rule)
+	conn.Close()
+	return false
+}
+
+// checkGuard applies the connection rate limit and bans to the client address.
+// Refused connections are closed without a response, leaving scanners nothing
+// to go on.
+func (s *Server) checkGuard(conn net.Conn) bool {
+	ban, err := s.guard.Connect(remoteIP(conn.RemoteAddr()))
+	if ban != nil {
+		s.recordBan(ban)
+	}
+	if err == nil {
+		return true
+	}
+
+	reason := ""
+	if limitErr, ok := err.(*limiter.LimitError); ok {
+		reason = limitErr.Reason
+	}
+	s.logger.Debug("Connection refused",
+		"client", conn.RemoteAddr().String(),
+		"reason", reason)
+	s.metrics.RecordRejection(reason)
+	conn.Close()
+	return false
+}
+
+// recordHandshakeFailure counts a failed handshake towards a ban of ip
+func (s *Server) recordHandshakeFailure(ip string) {
+	if ban := s.guard.Failure(ip); ban != nil {
+		s.recordBan(ban)
+	}
+}
+
+func (s *Server) recordBan(ban *limiter.Ban) {
+	s.logger.Warn("Client banned",
+		"ip", ban.IP,
+		"reason", ban.Reason,
+		"until", ban.Until.Format(time.RFC3339))
+	s.metrics.RecordBan(ban.Reason)
+	s.metrics.SetActiveBans(len(s.guard.Bans()))
+}
+
+// maintainState expires bans and rate limit windows, and persists the ban
+// table and the accounting ledger whenever they changed, until shutdown
+func (s *Server) maintainState() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(stateMaintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.saveBans()
+			return
+		case <-ticker.C:
+			s.metrics.SetActiveBans(s.guard.Expire())
+			s.saveBans()
+			s.saveLedger()
 		}
 	}
 }
 
+// saveBans writes the ban table to ban_file if it changed. After an upgrade
+// the new process owns the file.
+func (s *Server) saveBans() {
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+
+	path := s.currentConfig().BanFile
+	if path == "" || s.handedOff() {
+		return
+	}
+	bans, changed := s.guard.Changed()
+	if !changed {
+		return
+	}
+	if err := limiter.SaveBans(path, bans); err != nil {
+		s.logger.Error("Failed to save bans", "error", err)
+	}
+}
+
+// saveLedger prunes idle accounts and writes the accounting ledger back to
+// the file it was loaded from if it changed. After an upgrade the new
+// process owns the file, pruning continues for the tunnels still draining.
+func (s *Server) saveLedger() {
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+
+	ledger := s.proxy.Ledger()
+	if pruned := ledger.Prune(time.Now()); pruned > 0 {
+		s.logger.Debug("Pruned idle accounts", "count", pruned)
+	}
+	if s.ledgerFile == "" || s.handedOff() {
+		return
+	}
+	accounts, changed := ledger.Changed()
+	if !changed {
+		return
+	}
+	if err := accounting.Save(s.ledgerFile, accounts); err != nil {
+		s.logger.Error("Failed to save accounting ledger", "error", err)
+	}
+}
+
+// handedOff reports whether an upgraded process took over the listeners,
+// and with them the state files
+func (s *Server) handedOff() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.upgraded
+}
+
+// acceptProxyHeader consumes the PROXY protocol header of a connection from a
+// trusted balancer when the listener expects one. It closes conn and returns
+// false if the header is invalid.
+func (s *Server) acceptProxyHeader(cfg *config.Config, conn net.Conn, enabled bool) (net.Conn, bool) {
+	if !s.expectProxyHeader(conn, enabled) {
+		return conn, true
+	}
+
+	pc, err := proxyproto.Accept(conn, cfg.GetHandshakeTimeout())
+	if err != nil {
+		s.logger.Warn("Invalid PROXY protocol header",
+			"peer", conn.RemoteAddr().String(),
+			"error", err)
+		s.metrics.RecordError("proxy_protocol", "invalid_header")
+		conn.Close()
+		return nil, false
+	}
+	return pc, true
+}
+
+// serve terminates TLS if needed, admits the connection and hands it to the proxy
+func (s *Server) serve(cfg *config.Config, conn net.Conn, isTLS bool) {
+	// With passthrough rules the ClientHello decides who terminates TLS
+	if isTLS && len(cfg.TLSPassthrough) > 0 {
+		hello, peeked, err := proxy.PeekClientHello(conn, cfg.GetHandshakeTimeout())
+		if err != nil {
+			s.logger.Debug("Failed to read ClientHello",
+				"client", conn.RemoteAddr().String(),
+				"error", err)
+			s.metrics.RecordError("tls", "client_hello")
+			conn.Close()
+			return
+		}
+		if backend := s.proxy.Passthrough(hello); backend != nil {
+			s.passThrough(peeked, backend, hello)
+			return
+		}
+		conn = peeked
+	}
+
+	if isTLS {
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+
+	release, err := s.admission.Acquire(s.connCtx, remoteIP(conn.RemoteAddr()))
+	if err != nil {
+		s.rejectConnection(conn, err)
+		return
+	}
+	defer release()
+
+	s.proxy.HandleConnection(s.connCtx, conn, isTLS)
+}
+
+// expectProxyHeader reports whether conn must start with a PROXY protocol
+// header: the listener has it enabled and the peer is a trusted balancer
+func (s *Server) expectProxyHeader(conn net.Conn, enabled bool) bool {
+	if !enabled {
+		return false
+	}
+
+	s.mu.RLock()
+	trusted := s.proxyTrust
+	s.mu.RUnlock()
+
+	if !trusted.Contains(conn.RemoteAddr()) {
+		s.logger.Debug("Ignoring PROXY protocol from untrusted peer", "peer", conn.RemoteAddr().String())
+		return false
+	}
+	return true
+}
+
+// rejectConnection answers a connection over the limits with HTTP 503 and closes it
+func (s *Server) rejectConnection(conn net.Conn, err error) {
+	defer conn.Close()
+
+	s.recordRejection(conn, err)
+
+	// TLS connections run the handshake on the first write, bound its reads too
+	if err := conn.SetDeadline(time.Now().Add(rejectTimeout)); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte(serviceUnavailableResponse)); err != nil {
+		s.logger.Debug("Failed to write rejection response", "error", err)
+	}
+}
+
+// recordRejection logs and counts a connection turned away by admission control
+func (s *Server) recordRejection(conn net.Conn, err error) {
+	reason := "shutdown"
+	if limitErr, ok := err.(*limiter.LimitError); ok {
+		reason = limitErr.Reason
+	}
+	s.logger.Warn("Connection rejected",
+		"client", conn.RemoteAddr().String(),
+		"reason", reason)
+	s.metrics.RecordRejection(reason)
+}
+
+// passThrough relays a TLS connection to a backend without terminating it,
+// under the same admission limits as terminated connections
+func (s *Server) passThrough(conn *proxy.PeekedConn, backend *proxy.Backend, hello *proxy.ClientHello) {
+	release, err := s.admission.Acquire(s.connCtx, remoteIP(conn.RemoteAddr()))
+	if err != nil {
+		// An HTTP error response means nothing inside a TLS stream, just close
+		s.recordRejection(conn, err)
+		conn.Close()
+		return
+	}
+	defer release()
+
+	s.proxy.HandlePassthrough(s.connCtx, conn, backend, hello)
+}
+
+// remoteIP returns the IP part of a remote address
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
 // configureConnection configures TCP connection settings
 func (s *Server) configureConnection(conn *net.TCPConn) error {
+	cfg := s.currentConfig()
+
 	// Enable keep-alive
-	if err := conn.SetKeepAlive(s.config.KeepAlive); err != nil {
+	if err := conn.SetKeepAlive(cfg.KeepAlive); err != nil {
 		return errors.Wrap(err, "failed to set keep-alive")
 	}
 
 	// Set keep-alive period (if supported)
-	if s.config.KeepAlive {
+	if cfg.KeepAlive {
 		if err := conn.SetKeepAlivePeriod(30 * time.Second); err != nil {
 			// Some systems may not support this, log but don't fail
 			s.logger.Debug("Failed to set keep-alive period", "error", err)
@@ -215,7 +869,7 @@ func (s *Server) configureConnection(conn *net.TCPConn) error {
 	}
 
 	// Set no delay for better performance
-	if err := conn.SetNoDelay(s.config.NoDelay); err != nil {
+	if err := conn.SetNoDelay(cfg.NoDelay); err != nil {
 		return errors.Wrap(err, "failed to set no delay")
 	}
 
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gowsoos/internal/config"
+	"gowsoos/internal/metrics"
+	"gowsoos/internal/proxy"
+)
+
+// writeCert writes a self-signed certificate for name and its key to dir
+func writeCert(t *testing.T, dir, name string) config.CertificateConfig {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pair := config.CertificateConfig{Cert: filepath.Join(dir, name+".crt"), Key: filepath.Join(dir, name+".key")}
+	if err := os.WriteFile(pair.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pair.Key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+// reloadConfig returns a configuration whose certificate, token, passthrough
+// route, connection limit and ACL all carry name, so a test can tell which
+// configuration each component runs with
+func reloadConfig(t *testing.T, name string, maxConnections int) *config.Config {
+	t.Helper()
+	cfg := config.DefaultConfig()
+	cfg.TLSEnabled = true
+	cfg.TLSPrivateKey, cfg.TLSPublicKey = "", ""
+	cfg.TLSCertificates = []config.CertificateConfig{writeCert(t, t.TempDir(), name+".example.com")}
+	cfg.AuthMethods = []string{"bearer"}
+	cfg.AuthTokens = []string{name + ":" + name + "-token"}
+	cfg.Backends = map[string]config.BackendConfig{name: {Address: "127.0.0.1:8443"}}
+	cfg.TLSPassthrough = []config.RouteConfig{{Match: "sni", Value: "tunnel.example.com", Backend: name}}
+	cfg.MaxConnections = maxConnections
+	cfg.ACLRules = []config.ACLRuleConfig{{Name: name, Action: "deny", CIDRs: []string{"192.0.2.0/24"}}}
+	return cfg
+}
+
+// loadedServer returns a server with the configuration loaded as Start does,
+// without listening
+func loadedServer(t *testing.T, cfg *config.Config) *Server {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := NewServer(cfg, logger, metrics.NewMetrics(false, logger))
+	if err := s.proxy.Authenticator().Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.acl.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := proxy.NewCertStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.certs = certs
+	return s
+}
+
+// serverState is what a reload changes, as seen by new connections
+type serverState struct {
+	config      *config.Config
+	certificate string // name of the default certificate
+	identity    string // identity of the "one-token" bearer token
+	passthrough string // backend of the passthrough route
+	admitted    int    // sessions admitted from one client
+	aclRule     string // rule matching 192.0.2.1
+}
+
+func stateOf(t *testing.T, s *Server) serverState {
+	t.Helper()
+	st := serverState{config: s.currentConfig()}
+
+	cert, err := s.certs.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.certificate = cert.Leaf.Subject.CommonName
+
+	header := http.Header{"Authorization": {"Bearer one-token"}}
+	st.identity, _ = s.proxy.Authenticator().Authenticate(header, "/")
+
+	if backend := s.proxy.Passthrough(&proxy.ClientHello{ServerName: "tunnel.example.com"}); backend != nil {
+		st.passthrough = backend.Name
+	}
+
+	for {
+		release, err := s.admission.Acquire(context.Background(), "198.51.100.1")
+		if err != nil || st.admitted == 10 {
+			break
+		}
+		defer release()
+		st.admitted++
+	}
+
+	st.aclRule = s.acl.Check(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}).Rule
+	return st
+}
+
+func TestReload(t *testing.T) {
+	first := reloadConfig(t, "one", 1)
+	s := loadedServer(t, first)
+	want := serverState{config: first, certificate: "one.example.com", identity: "one", passthrough: "one", admitted: 1, aclRule: "one"}
+	if got := stateOf(t, s); got != want {
+		t.Fatalf("loaded %+v, want %+v", got, want)
+	}
+
+	second := reloadConfig(t, "two", 2)
+	if err := s.Reload(second); err != nil {
+		t.Fatal(err)
+	}
+	want = serverState{config: second, certificate: "two.example.com", passthrough: "two", admitted: 2, aclRule: "two"}
+	if got := stateOf(t, s); got != want {
+		t.Errorf("reloaded %+v, want %+v", got, want)
+	}
+}
+
+func TestReloadFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(cfg *config.Config)
+	}{
+		{name: "proxy_protocol_trusted", corrupt: func(cfg *config.Config) { cfg.ProxyProtocolTrusted = []string{"not-an-address"} }},
+		{name: "missing certificate", corrupt: func(cfg *config.Config) { cfg.TLSCertificates[0].Cert += ".missing" }},
+		{name: "certificate with the wrong key", corrupt: func(cfg *config.Config) {
+			cfg.TLSCertificates[0].Key = writeCert(t, t.TempDir(), "other.example.com").Key
+		}},
+		{name: "missing token file", corrupt: func(cfg *config.Config) { cfg.AuthTokensFile = filepath.Join(t.TempDir(), "tokens") }},
+		{name: "missing htpasswd file", corrupt: func(cfg *config.Config) { cfg.AuthHtpasswdFile = filepath.Join(t.TempDir(), "htpasswd") }},
+		{name: "missing ACL file", corrupt: func(cfg *config.Config) { cfg.ACLRules[0].File = filepath.Join(t.TempDir(), "blocklist") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := reloadConfig(t, "one", 1)
+			s := loadedServer(t, first)
+			before := stateOf(t, s)
+
+			// Everything else in the new configuration is valid, none of it
+			// may be applied
+			second := reloadConfig(t, "two", 2)
+			tt.corrupt(second)
+			if err := s.Reload(second); err == nil {
+				t.Fatal("reload succeeded, want an error")
+			}
+			if got := stateOf(t, s); got != before {
+				t.Errorf("state after a failed reload %+v, want %+v", got, before)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package statefile
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+// Read decodes the JSON file at path into v. A file that does not exist yet
+// leaves v untouched.
+func Read(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", path)
+	}
+	return errors.Wrapf(json.Unmarshal(data, v), "failed to parse %s", path)
+}
+
+// Write encodes v as indented JSON and replaces the file at path atomically.
+// The file and its directory are synced before returning, so a crash leaves
+// either the previous or the new content on disk.
+func Write(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode %s", path)
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", path)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to write %s", path)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to sync %s", path)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "failed to write %s", path)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrapf(err, "failed to replace %s", path)
+	}
+	return syncDir(dir)
+}
+
+// syncDir persists a rename within dir. Windows cannot sync directories,
+// renames are durable there once they return.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", dir)
+	}
+	defer d.Close()
+	return errors.Wrapf(d.Sync(), "failed to sync %s", dir)
+}
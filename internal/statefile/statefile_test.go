@@ -0,0 +1,65 @@
+package statefile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteRead(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	want := map[string]int{"a": 1, "b": 2}
+	if err := Write(path, want); err != nil {
+		t.Fatal(err)
+	}
+	// Replacing an existing file works the same
+	want["c"] = 3
+	if err := Write(path, want); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]int)
+	if err := Read(path, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got["c"] != 3 {
+		t.Errorf("read %v, want %v", got, want)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary files left behind: %d entries", len(entries))
+	}
+}
+
+func TestReadMissing(t *testing.T) {
+	got := map[string]int{"kept": 1}
+	if err := Read(filepath.Join(t.TempDir(), "missing.json"), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["kept"] != 1 {
+		t.Errorf("missing file changed the value: %v", got)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte("{truncated"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]int
+	if err := Read(path, &got); err == nil {
+		t.Error("parsed a truncated file")
+	}
+}
+
+func TestWriteMissingDirectory(t *testing.T) {
+	if err := Write(filepath.Join(t.TempDir(), "missing", "state.json"), 1); err == nil {
+		t.Error("wrote into a missing directory")
+	}
+}
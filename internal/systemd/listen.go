@@ -0,0 +1,60 @@
+package systemd
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation
+const listenFDsStart = 3
+
+// newFile wraps an inherited descriptor, tests replace it to avoid touching
+// the descriptors of the test process
+var newFile = os.NewFile
+
+// ListenFiles returns the sockets passed by systemd socket activation, keyed by
+// the FileDescriptorName= of the socket unit. Sockets without a name are
+// reported under "unknown", as systemd names them. The LISTEN_* variables are
+// cleared so child processes do not pick them up.
+func ListenFiles() map[string]*os.File {
+	return listenFiles(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"))
+}
+
+func listenFiles(pid, fds, fdNames string) map[string]*os.File {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count <= 0 {
+		return nil
+	}
+
+	var names []string
+	if fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	files := make(map[string]*os.File, count)
+	for i := 0; i < count; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := newFile(uintptr(listenFDsStart+i), name)
+		if _, ok := files[name]; ok {
+			// Only one socket per name is used, keep the first
+			f.Close()
+			continue
+		}
+		files[name] = f
+	}
+	return files
+}
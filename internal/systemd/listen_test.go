@@ -0,0 +1,128 @@
+package systemd
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+// fakeFiles replaces newFile for the duration of a test and records the
+// descriptor each returned file stands for
+func fakeFiles(t *testing.T) map[*os.File]uintptr {
+	t.Helper()
+
+	fds := make(map[*os.File]uintptr)
+	dir := t.TempDir()
+	newFile = func(fd uintptr, name string) *os.File {
+		f, err := os.CreateTemp(dir, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fds[f] = fd
+		return f
+	}
+	t.Cleanup(func() {
+		newFile = os.NewFile
+		for f := range fds {
+			f.Close()
+		}
+	})
+	return fds
+}
+
+func TestListenFiles(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+
+	tests := []struct {
+		name   string
+		pid    string
+		fds    string
+		names  string
+		expect map[string]uintptr
+	}{
+		{
+			name:   "named sockets",
+			pid:    self,
+			fds:    "2",
+			names:  "http:tls",
+			expect: map[string]uintptr{"http": 3, "tls": 4},
+		},
+		{
+			name:   "missing names",
+			pid:    self,
+			fds:    "2",
+			names:  "http",
+			expect: map[string]uintptr{"http": 3, "unknown": 4},
+		},
+		{
+			name:   "empty name",
+			pid:    self,
+			fds:    "2",
+			names:  ":tls",
+			expect: map[string]uintptr{"unknown": 3, "tls": 4},
+		},
+		{
+			name:   "duplicate names keep the first",
+			pid:    self,
+			fds:    "3",
+			names:  "http:http:mux",
+			expect: map[string]uintptr{"http": 3, "mux": 5},
+		},
+		{
+			name:  "pid mismatch",
+			pid:   strconv.Itoa(os.Getpid() + 1),
+			fds:   "1",
+			names: "http",
+		},
+		{
+			name: "no pid",
+			fds:  "1",
+		},
+		{
+			name: "no sockets",
+			pid:  self,
+			fds:  "0",
+		},
+		{
+			name: "invalid count",
+			pid:  self,
+			fds:  "two",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fds := fakeFiles(t)
+
+			files := listenFiles(tt.pid, tt.fds, tt.names)
+			if len(files) != len(tt.expect) {
+				t.Fatalf("got %d files, want %d", len(files), len(tt.expect))
+			}
+			for name, fd := range tt.expect {
+				f, ok := files[name]
+				if !ok {
+					t.Fatalf("no file named %q", name)
+				}
+				if fds[f] != fd {
+					t.Errorf("%q is descriptor %d, want %d", name, fds[f], fd)
+				}
+			}
+		})
+	}
+}
+
+func TestListenFilesClearsEnvironment(t *testing.T) {
+	fakeFiles(t)
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "http")
+
+	if files := ListenFiles(); len(files) != 1 {
+		t.Fatalf("got %d files, want 1", len(files))
+	}
+	for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(key); ok {
+			t.Errorf("%s is still set", key)
+		}
+	}
+}
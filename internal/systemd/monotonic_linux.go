@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package systemd
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// monotonic returns CLOCK_MONOTONIC, the clock systemd expects in MONOTONIC_USEC
+var monotonic = func() time.Duration {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0
+	}
+	return time.Duration(ts.Nano())
+}
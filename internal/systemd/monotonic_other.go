@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package systemd
+
+import "time"
+
+// monotonic is unknown without systemd, the timestamp is left out
+var monotonic = func() time.Duration {
+	return 0
+}
@@ -0,0 +1,125 @@
+package systemd
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Notifier reports service state to systemd over the socket in $NOTIFY_SOCKET.
+// Without a notify socket every method is a no-op, so it is always safe to use.
+type Notifier struct {
+	addr     *net.UnixAddr
+	watchdog time.Duration
+}
+
+// NewNotifier creates a notifier from the environment systemd sets for the service
+func NewNotifier() *Notifier {
+	return newNotifier(os.Getenv("NOTIFY_SOCKET"), os.Getenv("WATCHDOG_USEC"), os.Getenv("WATCHDOG_PID"))
+}
+
+func newNotifier(socket, watchdogUsec, watchdogPID string) *Notifier {
+	n := &Notifier{}
+	if socket == "" {
+		return n
+	}
+
+	// A leading "@" denotes a socket in the abstract namespace
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	n.addr = &net.UnixAddr{Name: socket, Net: "unixgram"}
+
+	// The watchdog applies to this process only if systemd addressed it to us
+	if watchdogPID == "" || watchdogPID == strconv.Itoa(os.Getpid()) {
+		if usec, err := strconv.ParseInt(watchdogUsec, 10, 64); err == nil && usec > 0 {
+			n.watchdog = time.Duration(usec) * time.Microsecond
+		}
+	}
+	return n
+}
+
+// Enabled reports whether the process runs under a service manager expecting notifications
+func (n *Notifier) Enabled() bool {
+	return n.addr != nil
+}
+
+// Notify sends one or more newline separated KEY=VALUE assignments
+func (n *Notifier) Notify(state string) error {
+	if n.addr == nil {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, n.addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to notify socket")
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return errors.Wrap(err, "failed to send notification")
+	}
+	return nil
+}
+
+// Ready tells systemd that startup or a reload has finished. MAINPID is sent
+// along so a process started by a binary upgrade takes over as the main process.
+func (n *Notifier) Ready(status string) error {
+	return n.Notify("READY=1\nMAINPID=" + strconv.Itoa(os.Getpid()) + "\nSTATUS=" + status)
+}
+
+// Reloading tells systemd that the configuration is being reloaded. Type=notify-reload
+// units require the CLOCK_MONOTONIC timestamp to tell this reload from an older one.
+func (n *Notifier) Reloading() error {
+	state := "RELOADING=1\n"
+	if now := monotonic(); now > 0 {
+		state += "MONOTONIC_USEC=" + strconv.FormatInt(now.Microseconds(), 10) + "\n"
+	}
+	return n.Notify(state + "STATUS=Reloading configuration")
+}
+
+// Stopping tells systemd that shutdown has begun
+func (n *Notifier) Stopping(status string) error {
+	return n.Notify("STOPPING=1\nSTATUS=" + status)
+}
+
+// Status updates the free-form status line shown by systemctl status
+func (n *Notifier) Status(status string) error {
+	return n.Notify("STATUS=" + status)
+}
+
+// WatchdogInterval returns the watchdog timeout, zero if the watchdog is disabled
+func (n *Notifier) WatchdogInterval() time.Duration {
+	if n.addr == nil {
+		return 0
+	}
+	return n.watchdog
+}
+
+// RunWatchdog sends keepalives at half the watchdog interval until ctx is
+// done. It returns straight away when the watchdog is disabled.
+func (n *Notifier) RunWatchdog(ctx context.Context, alive func() bool) {
+	interval := n.WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if alive() {
+				n.Notify("WATCHDOG=1")
+			}
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package systemd
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listenNotify binds a notify socket in a temporary directory
+func listenNotify(t *testing.T) (*net.UnixConn, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, path
+}
+
+// receive returns the next notification sent to conn
+func receive(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotifierMessages(t *testing.T) {
+	defer func(saved func() time.Duration) { monotonic = saved }(monotonic)
+	monotonic = func() time.Duration { return 90*time.Second + 1500*time.Microsecond }
+
+	conn, path := listenNotify(t)
+	n := newNotifier(path, "", "")
+	if !n.Enabled() {
+		t.Fatal("notifier with a socket is disabled")
+	}
+
+	tests := []struct {
+		name   string
+		send   func() error
+		expect string
+	}{
+		{"ready", func() error { return n.Ready("Serving") }, "READY=1\nMAINPID=" + strconv.Itoa(os.Getpid()) + "\nSTATUS=Serving"},
+		{"reloading", n.Reloading, "RELOADING=1\nMONOTONIC_USEC=90001500\nSTATUS=Reloading configuration"},
+		{"stopping", func() error { return n.Stopping("Draining") }, "STOPPING=1\nSTATUS=Draining"},
+		{"status", func() error { return n.Status("3 sessions") }, "STATUS=3 sessions"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.send(); err != nil {
+				t.Fatal(err)
+			}
+			if got := receive(t, conn); got != tt.expect {
+				t.Errorf("got %q, want %q", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestMonotonic(t *testing.T) {
+	first := monotonic()
+	if first <= 0 {
+		t.Skip("no monotonic clock on this platform")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if elapsed := monotonic() - first; elapsed < 10*time.Millisecond {
+		t.Errorf("clock advanced %v over 10ms", elapsed)
+	}
+}
+
+func TestNotifierAbstractSocket(t *testing.T) {
+	name := "gowsoos-test-" + strconv.Itoa(os.Getpid())
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: "\x00" + name, Net: "unixgram"})
+	if err != nil {
+		t.Skip("abstract sockets not supported:", err)
+	}
+	defer conn.Close()
+
+	if err := newNotifier("@"+name, "", "").Status("ok"); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, conn); got != "STATUS=ok" {
+		t.Errorf("got %q, want %q", got, "STATUS=ok")
+	}
+}
+
+func TestNotifierDisabled(t *testing.T) {
+	n := newNotifier("", "30000000", "")
+	if n.Enabled() {
+		t.Error("notifier without a socket is enabled")
+	}
+	if err := n.Ready("Serving"); err != nil {
+		t.Errorf("notify without a socket: %v", err)
+	}
+	if interval := n.WatchdogInterval(); interval != 0 {
+		t.Errorf("watchdog without a socket: %v", interval)
+	}
+}
+
+func TestNotifierWatchdogInterval(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+
+	tests := []struct {
+		name   string
+		usec   string
+		pid    string
+		expect time.Duration
+	}{
+		{"unset", "", "", 0},
+		{"any pid", "30000000", "", 30 * time.Second},
+		{"this pid", "500000", self, 500 * time.Millisecond},
+		{"other pid", "30000000", strconv.Itoa(os.Getpid() + 1), 0},
+		{"zero", "0", "", 0},
+		{"invalid", "soon", "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newNotifier("/run/notify", tt.usec, tt.pid)
+			if got := n.WatchdogInterval(); got != tt.expect {
+				t.Errorf("got %v, want %v", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestRunWatchdog(t *testing.T) {
+	conn, path := listenNotify(t)
+	n := newNotifier(path, "20000", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		n.RunWatchdog(ctx, func() bool { return true })
+		close(done)
+	}()
+
+	if got := receive(t, conn); got != "WATCHDOG=1" {
+		t.Errorf("got %q, want %q", got, "WATCHDOG=1")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("RunWatchdog did not return after cancel")
+	}
+}
+
+func TestRunWatchdogSkipsWhenStalled(t *testing.T) {
+	conn, path := listenNotify(t)
+	n := newNotifier(path, "20000", "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	n.RunWatchdog(ctx, func() bool { return false })
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 64)); err == nil {
+		t.Errorf("got a keepalive of %d bytes from a stalled server", n)
+	}
+}